@@ -0,0 +1,194 @@
+package ipam
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	bbolt "go.etcd.io/bbolt"
+)
+
+// bolt stores prefixes in a embedded key value database file,
+// every tenant is a bucket which contains the json serialized prefixes by cidr.
+type bolt struct {
+	db *bbolt.DB
+}
+
+// NewBoltStorage creates a new Storage which uses a bbolt database stored in the file at path.
+// The file is locked exclusively as long as the storage is open.
+func NewBoltStorage(path string) (*bolt, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open database:%v", err)
+	}
+	return &bolt{
+		db: db,
+	}, nil
+}
+
+// Close releases the database file.
+func (b *bolt) Close() error {
+	return b.db.Close()
+}
+
+func (b *bolt) CreatePrefix(prefix Prefix, tenantid string) (Prefix, error) {
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(tenantid))
+		if err != nil {
+			return fmt.Errorf("unable to create tenant bucket:%v", err)
+		}
+		existing := bucket.Get([]byte(prefix.Cidr))
+		if existing != nil {
+			prefix, err = unmarshalPrefix(existing)
+			return err
+		}
+		prefix.version = int64(0)
+		pj, err := json.Marshal(prefix.toPrefixJSON())
+		if err != nil {
+			return fmt.Errorf("unable to marshal prefix:%v", err)
+		}
+		return bucket.Put([]byte(prefix.Cidr), pj)
+	})
+	if err != nil {
+		return Prefix{}, err
+	}
+	return prefix, nil
+}
+
+func (b *bolt) ReadPrefix(prefix string, tenantid string) (Prefix, error) {
+	var result Prefix
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(tenantid))
+		if bucket == nil {
+			return errors.Errorf("Prefix %s not found", prefix)
+		}
+		value := bucket.Get([]byte(prefix))
+		if value == nil {
+			return errors.Errorf("Prefix %s not found", prefix)
+		}
+		var err error
+		result, err = unmarshalPrefix(value)
+		return err
+	})
+	if err != nil {
+		return Prefix{}, err
+	}
+	return result, nil
+}
+
+func (b *bolt) ReadAllPrefixes(tenantid string) ([]Prefix, error) {
+	result := []Prefix{}
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(tenantid))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(_, value []byte) error {
+			p, err := unmarshalPrefix(value)
+			if err != nil {
+				return err
+			}
+			result = append(result, p)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// UpdatePrefix tries to update the prefix.
+// Returns OptimisticLockError if it does not succeed due to a concurrent update.
+func (b *bolt) UpdatePrefix(prefix Prefix, tenantid string) (Prefix, error) {
+	oldVersion := prefix.version
+	prefix.version = oldVersion + 1
+	pn, err := json.Marshal(prefix.toPrefixJSON())
+	if err != nil {
+		return Prefix{}, fmt.Errorf("unable to marshal prefix:%v", err)
+	}
+	err = b.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(tenantid))
+		if bucket == nil {
+			return fmt.Errorf("prefix not found:%s", prefix.Cidr)
+		}
+		value := bucket.Get([]byte(prefix.Cidr))
+		if value == nil {
+			return fmt.Errorf("prefix not found:%s", prefix.Cidr)
+		}
+		existing, err := unmarshalPrefix(value)
+		if err != nil {
+			return err
+		}
+		if existing.version != oldVersion {
+			return newOptimisticLockError(fmt.Sprintf("prefix %s has version %d, expected %d", prefix.Cidr, existing.version, oldVersion))
+		}
+		return bucket.Put([]byte(prefix.Cidr), pn)
+	})
+	if err != nil {
+		return Prefix{}, err
+	}
+	return prefix, nil
+}
+
+func (b *bolt) DeletePrefix(prefix Prefix, tenantid string) (Prefix, error) {
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(tenantid))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete([]byte(prefix.Cidr))
+	})
+	if err != nil {
+		return Prefix{}, fmt.Errorf("unable to delete prefix:%v", err)
+	}
+	return prefix, nil
+}
+
+// ApplyChanges applies the changes of a transaction in a single database transaction.
+func (b *bolt) ApplyChanges(_ context.Context, changes []PrefixChange) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		for _, c := range changes {
+			bucket, err := tx.CreateBucketIfNotExists([]byte(c.Tenantid))
+			if err != nil {
+				return fmt.Errorf("unable to create tenant bucket:%v", err)
+			}
+			var stored *Prefix
+			if value := bucket.Get([]byte(c.Prefix.Cidr)); value != nil {
+				existing, err := unmarshalPrefix(value)
+				if err != nil {
+					return err
+				}
+				stored = &existing
+			}
+			err = c.Conflict(stored)
+			if err != nil {
+				return err
+			}
+			prefix := c.Prefix
+			switch c.Op {
+			case ChangeCreate:
+				prefix.version = int64(0)
+			case ChangeUpdate:
+				prefix.version++
+			case ChangeDelete:
+				err = bucket.Delete([]byte(prefix.Cidr))
+				if err != nil {
+					return fmt.Errorf("unable to delete prefix:%v", err)
+				}
+				continue
+			}
+			pj, err := json.Marshal(prefix.toPrefixJSON())
+			if err != nil {
+				return fmt.Errorf("unable to marshal prefix:%v", err)
+			}
+			err = bucket.Put([]byte(prefix.Cidr), pj)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
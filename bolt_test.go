@@ -0,0 +1,84 @@
+package ipam
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func newBoltForTest(t *testing.T) *bolt {
+	dir, err := ioutil.TempDir("", "go-ipam")
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	b, err := NewBoltStorage(filepath.Join(dir, "ipam.bolt"))
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		b.Close()
+	})
+	return b
+}
+
+func Test_bolt_ReadPrefix(t *testing.T) {
+	b := newBoltForTest(t)
+
+	// Prefix
+	p, err := b.ReadPrefix("12.0.0.0/8", tenantid)
+	require.NotNil(t, err)
+	require.Equal(t, "Prefix 12.0.0.0/8 not found", err.Error())
+	require.Empty(t, p)
+
+	prefix := Prefix{Cidr: "12.0.0.0/16", ParentCidr: "12.0.0.0/8"}
+	p, err = b.CreatePrefix(prefix, tenantid)
+	require.Nil(t, err)
+	require.NotNil(t, p)
+
+	p, err = b.ReadPrefix("12.0.0.0/16", tenantid)
+	require.Nil(t, err)
+	require.Equal(t, "12.0.0.0/16", p.Cidr)
+	require.Equal(t, "12.0.0.0/8", p.ParentCidr)
+
+	// Prefix of other tenant
+	p, err = b.ReadPrefix("12.0.0.0/16", "othertenant")
+	require.NotNil(t, err)
+	require.Equal(t, "Prefix 12.0.0.0/16 not found", err.Error())
+	require.Empty(t, p)
+}
+
+func Test_bolt_UpdatePrefix_OptimisticLock(t *testing.T) {
+	b := newBoltForTest(t)
+
+	prefix := Prefix{Cidr: "13.0.0.0/16"}
+	_, err := b.CreatePrefix(prefix, tenantid)
+	require.Nil(t, err)
+
+	p1, err := b.ReadPrefix(prefix.Cidr, tenantid)
+	require.Nil(t, err)
+	p2, err := b.ReadPrefix(prefix.Cidr, tenantid)
+	require.Nil(t, err)
+
+	p1.ParentCidr = "13.0.0.0/8"
+	_, err = b.UpdatePrefix(p1, tenantid)
+	require.Nil(t, err)
+
+	// p2 was read before p1 was updated
+	p2.ParentCidr = "13.0.0.0/12"
+	_, err = b.UpdatePrefix(p2, tenantid)
+	require.NotNil(t, err)
+	_, isOptimisticLock := errors.Cause(err).(OptimisticLockError)
+	require.True(t, isOptimisticLock, "error must be of type OptimisticLockError")
+
+	p, err := b.ReadPrefix(prefix.Cidr, tenantid)
+	require.Nil(t, err)
+	require.Equal(t, "13.0.0.0/8", p.ParentCidr)
+
+	// Not existing Prefix
+	_, err = b.UpdatePrefix(Prefix{Cidr: "1.2.3.4/24"}, tenantid)
+	require.NotNil(t, err)
+	require.Equal(t, "prefix not found:1.2.3.4/24", err.Error())
+}
@@ -0,0 +1,207 @@
+package ipam
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+func (i *ipamer) AcquireIPs(prefixCidr string, n int, tenantid string, opts ...AcquireOption) ([]IP, error) {
+	return i.AcquireIPsContext(context.Background(), prefixCidr, n, tenantid, opts...)
+}
+
+func (i *ipamer) AcquireIPsContext(ctx context.Context, prefixCidr string, n int, tenantid string, opts ...AcquireOption) ([]IP, error) {
+	return i.acquireIPs(ctx, prefixCidr, n, false, tenantid, newAcquireOptions(opts))
+}
+
+func (i *ipamer) AcquireContiguousIPs(prefixCidr string, n int, tenantid string, opts ...AcquireOption) ([]IP, error) {
+	return i.AcquireContiguousIPsContext(context.Background(), prefixCidr, n, tenantid, opts...)
+}
+
+func (i *ipamer) AcquireContiguousIPsContext(ctx context.Context, prefixCidr string, n int, tenantid string, opts ...AcquireOption) ([]IP, error) {
+	return i.acquireIPs(ctx, prefixCidr, n, true, tenantid, newAcquireOptions(opts))
+}
+
+func (i *ipamer) acquireIPs(ctx context.Context, prefixCidr string, n int, contiguous bool, tenantid string, o acquireOptions) ([]IP, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("number of ips:%d must be positive", n)
+	}
+	if o.stickyKey != "" {
+		return nil, fmt.Errorf("a sticky key can only be bound to a single ip")
+	}
+	var ips []IP
+	return ips, retryOnOptimisticLock(ctx, func() error {
+		var err error
+		ips, err = i.acquireIPsInternal(ctx, prefixCidr, n, contiguous, tenantid, o)
+		return err
+	})
+}
+
+// acquireIPsInternal acquires n ips according to the allocation strategy of the prefix
+// and persists them with a single update of the prefix. No ip is acquired if there are less than n free ips.
+func (i *ipamer) acquireIPsInternal(ctx context.Context, prefixCidr string, n int, contiguous bool, tenantid string, o acquireOptions) ([]IP, error) {
+	prefix, a, err := i.prepareIPAcquisition(ctx, prefixCidr, tenantid, o, false)
+	if err != nil {
+		return nil, err
+	}
+	from, err := i.searchStart(prefix, a.start, a.end, o)
+	if err != nil {
+		return nil, err
+	}
+
+	// the free ranges are checked against the ips, they are rebuilt once if the ips were modified directly
+	var candidates []*big.Int
+	for rebuilt := false; ; rebuilt = true {
+		if contiguous {
+			candidates = prefix.freeBlock(from, n)
+		} else {
+			candidates = prefix.freeIPs(from, n)
+		}
+		stale := false
+		for _, c := range candidates {
+			if prefix.used(intToIP(c, a.bits).String()) {
+				stale = true
+				break
+			}
+		}
+		if len(candidates) == n && !stale {
+			break
+		}
+		if rebuilt || !(stale || prefix.freeRangesStale(nil, "", a.ipnet)) {
+			if contiguous {
+				return nil, fmt.Errorf("%w: no %d contiguous ips in prefix: %s left", ErrNoIPAvailable, n, prefix.Cidr)
+			}
+			return nil, fmt.Errorf("%w: no %d ips in prefix: %s left, length of prefix.ips: %d", ErrNoIPAvailable, n, prefix.Cidr, prefix.acquiredips())
+		}
+		err = prefix.rebuildFreeRanges()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := make([]IP, 0, n)
+	for _, c := range candidates {
+		result = append(result, prefix.acquire(c, a, o))
+	}
+	if i.strategyOf(prefix) == RoundRobin {
+		last := candidates[len(candidates)-1]
+		prefix.advanceCursor(new(big.Int).Add(last, big.NewInt(1)), a.start, a.end)
+	}
+	_, err = i.contextStorage().UpdatePrefixContext(ctx, *prefix, tenantid)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to persist %d acquired ips of prefix:%s", n, prefix.Cidr)
+	}
+	return result, nil
+}
+
+// freeIPs returns up to n free ips at or after from, wrapping around at the end of the free ranges.
+func (p *Prefix) freeIPs(from *big.Int, n int) []*big.Int {
+	var result []*big.Int
+	if len(p.freeRanges) == 0 {
+		return result
+	}
+	first := p.freeRangeIndexFrom(from)
+	if first == len(p.freeRanges) {
+		first, from = 0, p.freeRanges[0].start
+	}
+	for k := 0; k <= len(p.freeRanges) && len(result) < n; k++ {
+		index := (first + k) % len(p.freeRanges)
+		r := p.freeRanges[index]
+		ip := new(big.Int).Set(r.start)
+		end := r.end
+		switch {
+		case k == 0 && r.start.Cmp(from) < 0:
+			// the range containing from is continued behind from and its rest is visited last
+			ip.Set(from)
+		case k == len(p.freeRanges):
+			if r.start.Cmp(from) >= 0 {
+				return result
+			}
+			end = from
+		}
+		for ; ip.Cmp(end) < 0 && len(result) < n; ip.Add(ip, big.NewInt(1)) {
+			result = append(result, new(big.Int).Set(ip))
+		}
+	}
+	return result
+}
+
+// freeBlock returns n free ips with consecutive addresses, starting with the first such block at or after from
+// and wrapping around at the end of the free ranges. It returns nil if there is no such block.
+func (p *Prefix) freeBlock(from *big.Int, n int) []*big.Int {
+	if len(p.freeRanges) == 0 {
+		return nil
+	}
+	size := big.NewInt(int64(n))
+	first := p.freeRangeIndexFrom(from)
+	if first == len(p.freeRanges) {
+		first, from = 0, p.freeRanges[0].start
+	}
+	for k := 0; k <= len(p.freeRanges); k++ {
+		r := p.freeRanges[(first+k)%len(p.freeRanges)]
+		start := r.start
+		switch {
+		case k == 0 && r.start.Cmp(from) < 0:
+			// the range containing from is searched behind from and as a whole last
+			start = from
+		case k == len(p.freeRanges) && r.start.Cmp(from) >= 0:
+			return nil
+		}
+		if new(big.Int).Sub(r.end, start).Cmp(size) < 0 {
+			continue
+		}
+		result := make([]*big.Int, 0, n)
+		for j := 0; j < n; j++ {
+			result = append(result, new(big.Int).Add(start, big.NewInt(int64(j))))
+		}
+		return result
+	}
+	return nil
+}
+
+func (i *ipamer) ReleaseIPs(prefixCidr string, ips []string, tenantid string) (*Prefix, error) {
+	return i.ReleaseIPsContext(context.Background(), prefixCidr, ips, tenantid)
+}
+
+func (i *ipamer) ReleaseIPsContext(ctx context.Context, prefixCidr string, ips []string, tenantid string) (*Prefix, error) {
+	var prefix *Prefix
+	return prefix, retryOnOptimisticLock(ctx, func() error {
+		var err error
+		prefix, err = i.releaseIPsInternal(ctx, prefixCidr, ips, tenantid)
+		return err
+	})
+}
+
+// releaseIPsInternal releases the ips with a single update of the prefix.
+// No ip is released if one of them is not acquired.
+func (i *ipamer) releaseIPsInternal(ctx context.Context, prefixCidr string, ips []string, tenantid string) (*Prefix, error) {
+	prefix, err := i.readPrefix(ctx, prefixCidr, tenantid)
+	if err != nil {
+		return nil, err
+	}
+	if prefix == nil {
+		return nil, fmt.Errorf("%w: unable to find prefix for cidr:%s", ErrNotFound, prefixCidr)
+	}
+	now := i.now()
+	for _, ip := range ips {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			return nil, fmt.Errorf("given ip:%s in not valid", ip)
+		}
+		if _, ok := prefix.Ips[parsed.String()]; !ok {
+			return nil, fmt.Errorf("%w: unable to release ip:%s because it is not allocated in prefix:%s", ErrNotFound, ip, prefixCidr)
+		}
+		err := prefix.release(parsed.String(), now)
+		if err != nil {
+			return nil, err
+		}
+	}
+	updated, err := i.contextStorage().UpdatePrefixContext(ctx, *prefix, tenantid)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to release %d ips of prefix:%s", len(ips), prefixCidr)
+	}
+	return &updated, nil
+}
@@ -0,0 +1,128 @@
+package ipam
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func ipStrings(ips []IP) []string {
+	result := []string{}
+	for _, ip := range ips {
+		result = append(result, ip.IP.String())
+	}
+	return result
+}
+
+func TestIpamer_AcquireIPs(t *testing.T) {
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		p, err := ipam.NewPrefix("10.90.0.0/28", tenantid)
+		require.Nil(t, err)
+		_, err = ipam.AcquireSpecificIP(p.Cidr, "10.90.0.3", tenantid)
+		require.Nil(t, err)
+
+		ips, err := ipam.AcquireIPs(p.Cidr, 4, tenantid, WithMetadata(IPMetadata{Owner: "cluster-1"}))
+		require.Nil(t, err)
+		require.Equal(t, []string{"10.90.0.1", "10.90.0.2", "10.90.0.4", "10.90.0.5"}, ipStrings(ips))
+		require.Equal(t, "cluster-1", ips[0].Metadata.Owner)
+		owned, err := ipam.IPsByOwner("cluster-1", tenantid)
+		require.Nil(t, err)
+		require.Len(t, owned, 4)
+
+		// all or nothing
+		_, err = ipam.AcquireIPs(p.Cidr, 10, tenantid)
+		require.True(t, errors.Is(err, ErrNoIPAvailable))
+		require.Len(t, ipam.PrefixFrom(p.Cidr, tenantid).Ips, 5)
+		ips, err = ipam.AcquireIPs(p.Cidr, 9, tenantid)
+		require.Nil(t, err)
+		require.Len(t, ips, 9)
+		require.Equal(t, uint64(16), ipam.PrefixFrom(p.Cidr, tenantid).Usage().AcquiredIPs)
+
+		_, err = ipam.AcquireIPs(p.Cidr, 0, tenantid)
+		require.EqualError(t, err, "number of ips:0 must be positive")
+		_, err = ipam.AcquireIPs(p.Cidr, 2, tenantid, WithStickyKey("a"))
+		require.EqualError(t, err, "a sticky key can only be bound to a single ip")
+	})
+}
+
+func TestIpamer_AcquireContiguousIPs(t *testing.T) {
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		p, err := ipam.NewPrefix("10.91.0.0/28", tenantid)
+		require.Nil(t, err)
+		for _, ip := range []string{"10.91.0.3", "10.91.0.8"} {
+			_, err = ipam.AcquireSpecificIP(p.Cidr, ip, tenantid)
+			require.Nil(t, err)
+		}
+
+		ips, err := ipam.AcquireContiguousIPs(p.Cidr, 4, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, []string{"10.91.0.4", "10.91.0.5", "10.91.0.6", "10.91.0.7"}, ipStrings(ips))
+		ips, err = ipam.AcquireContiguousIPs(p.Cidr, 2, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, []string{"10.91.0.1", "10.91.0.2"}, ipStrings(ips))
+
+		// 10.91.0.9 - 10.91.0.14 are the only contiguous free ips left
+		_, err = ipam.AcquireContiguousIPs(p.Cidr, 7, tenantid)
+		require.True(t, errors.Is(err, ErrNoIPAvailable))
+		require.Len(t, ipam.PrefixFrom(p.Cidr, tenantid).Ips, 8)
+		ips, err = ipam.AcquireContiguousIPs(p.Cidr, 6, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, "10.91.0.9", ips[0].IP.String())
+		require.Equal(t, "10.91.0.14", ips[5].IP.String())
+	})
+}
+
+func TestIpamer_ReleaseIPs(t *testing.T) {
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		p, err := ipam.NewPrefix("10.92.0.0/24", tenantid)
+		require.Nil(t, err)
+		ips, err := ipam.AcquireIPs(p.Cidr, 200, tenantid)
+		require.Nil(t, err)
+		require.Len(t, ipam.PrefixFrom(p.Cidr, tenantid).Ips, 200)
+
+		// all or nothing
+		_, err = ipam.ReleaseIPs(p.Cidr, []string{"10.92.0.1", "10.92.0.250"}, tenantid)
+		require.True(t, errors.Is(err, ErrNotFound))
+		require.Len(t, ipam.PrefixFrom(p.Cidr, tenantid).Ips, 200)
+
+		released, err := ipam.ReleaseIPs(p.Cidr, ipStrings(ips[:150]), tenantid)
+		require.Nil(t, err)
+		require.Len(t, released.Ips, 50)
+		ip, err := ipam.AcquireIP(p.Cidr, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, "10.92.0.1", ip.IP.String())
+	})
+}
+
+func TestPrefix_freeIPsAndBlock(t *testing.T) {
+	ipam := &ipamer{}
+	p, err := ipam.newPrefix("10.93.0.0/28", WithReservedIPs())
+	require.Nil(t, err)
+	for _, ip := range []string{"10.93.0.2", "10.93.0.3", "10.93.0.10", "10.93.0.15"} {
+		p.Ips[ip] = true
+	}
+	err = p.rebuildFreeRanges()
+	require.Nil(t, err)
+	format := func(ips []*big.Int) []string {
+		result := []string{}
+		for _, ip := range ips {
+			result = append(result, intToIP(ip, 32).String())
+		}
+		return result
+	}
+	from, err := ipStringToInt("10.93.0.12")
+	require.Nil(t, err)
+	require.Equal(t, []string{"10.93.0.12", "10.93.0.13", "10.93.0.14", "10.93.0.0", "10.93.0.1"}, format(p.freeIPs(from, 5)))
+	require.Len(t, p.freeIPs(from, 20), 12)
+	require.Equal(t, []string{"10.93.0.4", "10.93.0.5", "10.93.0.6", "10.93.0.7"}, format(p.freeBlock(from, 4)))
+	require.Equal(t, []string{"10.93.0.12", "10.93.0.13"}, format(p.freeBlock(from, 2)))
+	require.Nil(t, p.freeBlock(from, 7))
+
+	// behind the last free range the search wraps around
+	from, err = ipStringToInt("10.93.0.15")
+	require.Nil(t, err)
+	require.Equal(t, []string{"10.93.0.0", "10.93.0.1"}, format(p.freeIPs(from, 2)))
+	require.Equal(t, []string{"10.93.0.4", "10.93.0.5", "10.93.0.6"}, format(p.freeBlock(from, 3)))
+}
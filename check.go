@@ -0,0 +1,332 @@
+package ipam
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// FindingKind is the kind of inconsistency in the stored prefixes found by Check.
+type FindingKind string
+
+const (
+	// FindingInvalidPrefix is a prefix whose cidr can not be parsed.
+	FindingInvalidPrefix FindingKind = "invalid-prefix"
+	// FindingMissingParent is a child prefix whose parent does not exist, repaired by removing the link to the parent.
+	FindingMissingParent FindingKind = "missing-parent"
+	// FindingChildOutsideParent is a child prefix which is not contained in its parent.
+	FindingChildOutsideParent FindingKind = "child-outside-parent"
+	// FindingUnmarkedChild is a child prefix which is not marked as acquired by its parent,
+	// repaired by marking it as acquired.
+	FindingUnmarkedChild FindingKind = "unmarked-child"
+	// FindingMissingChild is a child prefix marked as acquired by its parent which does not exist,
+	// repaired by removing the mark from the parent.
+	FindingMissingChild FindingKind = "missing-child"
+	// FindingUnlinkedChild is a child prefix marked as acquired by its parent which does not link back to it,
+	// repaired by linking it to the parent if it has no other parent.
+	FindingUnlinkedChild FindingKind = "unlinked-child"
+	// FindingOverlappingPrefixes are two prefixes with the same parent, or both without one, which overlap.
+	FindingOverlappingPrefixes FindingKind = "overlapping-prefixes"
+	// FindingIPOutsidePrefix is an acquired or quarantined ip which is not contained in its prefix,
+	// repaired by removing the ip from the prefix.
+	FindingIPOutsidePrefix FindingKind = "ip-outside-prefix"
+	// FindingReservedIPAcquired is a reserved ip which is acquired, repaired by removing it from the acquired ips.
+	FindingReservedIPAcquired FindingKind = "reserved-ip-acquired"
+)
+
+// Finding is an inconsistency in the stored prefixes found by Check.
+type Finding struct {
+	Kind FindingKind `json:"kind"`
+	// Prefix is the cidr of the inconsistent prefix.
+	Prefix string `json:"prefix"`
+	// Subject is the ip or the cidr of the other prefix concerned, if any.
+	Subject    string `json:"subject,omitempty"`
+	Message    string `json:"message"`
+	Repairable bool   `json:"repairable"`
+	Repaired   bool   `json:"repaired"`
+}
+
+// CheckOption configures Check.
+type CheckOption func(*checkOptions)
+
+type checkOptions struct {
+	repair bool
+}
+
+// WithRepair repairs the repairable findings of Check, all repairs are stored in one atomic storage operation.
+// A Storage which does not implement MultiPrefixStorage stores the repair of a single prefix only,
+// if several prefixes need a repair ErrNotAtomic is returned and nothing is repaired.
+func WithRepair() CheckOption {
+	return func(o *checkOptions) {
+		o.repair = true
+	}
+}
+
+func newCheckOptions(opts []CheckOption) checkOptions {
+	o := checkOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+func (i *ipamer) Check(tenantid string, opts ...CheckOption) ([]Finding, error) {
+	return i.CheckContext(context.Background(), tenantid, opts...)
+}
+
+func (i *ipamer) CheckContext(ctx context.Context, tenantid string, opts ...CheckOption) ([]Finding, error) {
+	o := newCheckOptions(opts)
+	var findings []Finding
+	return findings, retryOnOptimisticLock(ctx, func() error {
+		var err error
+		findings, err = i.checkInternal(ctx, tenantid, o)
+		return err
+	})
+}
+
+// checker collects the findings of the prefixes of a tenant and repairs them if requested.
+type checker struct {
+	prefixes map[string]*Prefix
+	nets     map[string]*net.IPNet
+	repair   bool
+	modified map[string]bool
+	findings []Finding
+}
+
+// report adds a finding, fix repairs it and returns the modified prefix, it is nil if the finding is not repairable.
+func (c *checker) report(kind FindingKind, prefix, subject, message string, fix func() *Prefix) {
+	f := Finding{Kind: kind, Prefix: prefix, Subject: subject, Message: message, Repairable: fix != nil}
+	if c.repair && fix != nil {
+		c.modified[fix().Cidr] = true
+		f.Repaired = true
+	}
+	c.findings = append(c.findings, f)
+}
+
+func (i *ipamer) checkInternal(ctx context.Context, tenantid string, o checkOptions) ([]Finding, error) {
+	prefixes, err := i.contextStorage().ReadAllPrefixesContext(ctx, tenantid)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read prefixes:%v", err)
+	}
+	c := &checker{
+		prefixes: make(map[string]*Prefix),
+		nets:     make(map[string]*net.IPNet),
+		repair:   o.repair,
+		modified: make(map[string]bool),
+		findings: []Finding{},
+	}
+	cidrs := []string{}
+	for n := range prefixes {
+		p := &prefixes[n]
+		c.prefixes[p.Cidr] = p
+		cidrs = append(cidrs, p.Cidr)
+	}
+	sort.Strings(cidrs)
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			c.report(FindingInvalidPrefix, cidr, "", fmt.Sprintf("prefix %s is invalid:%v", cidr, err), nil)
+			continue
+		}
+		c.nets[cidr] = ipnet
+	}
+	for _, cidr := range cidrs {
+		if c.nets[cidr] == nil {
+			continue
+		}
+		c.checkParent(c.prefixes[cidr])
+		c.checkChildren(c.prefixes[cidr])
+		c.checkIPs(c.prefixes[cidr])
+	}
+	c.checkOverlaps(cidrs)
+	sort.SliceStable(c.findings, func(i, j int) bool {
+		return c.findings[i].Prefix < c.findings[j].Prefix
+	})
+
+	if len(c.modified) == 0 {
+		return c.findings, nil
+	}
+	var changes []PrefixChange
+	for _, cidr := range cidrs {
+		if c.modified[cidr] {
+			changes = append(changes, PrefixChange{Tenantid: tenantid, Prefix: *c.prefixes[cidr], Op: ChangeUpdate})
+		}
+	}
+	err = applyChanges(ctx, i.storage, changes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to repair %d prefixes", len(changes))
+	}
+	return c.findings, nil
+}
+
+// checkParent checks the link of a child prefix to its parent.
+func (c *checker) checkParent(p *Prefix) {
+	if p.ParentCidr == "" {
+		return
+	}
+	parent, ok := c.prefixes[p.ParentCidr]
+	if !ok || c.nets[p.ParentCidr] == nil {
+		c.report(FindingMissingParent, p.Cidr, p.ParentCidr, fmt.Sprintf("parent prefix %s of %s does not exist", p.ParentCidr, p.Cidr), func() *Prefix {
+			p.ParentCidr = ""
+			return p
+		})
+		return
+	}
+	if !contains(c.nets[parent.Cidr], c.nets[p.Cidr]) {
+		c.report(FindingChildOutsideParent, p.Cidr, parent.Cidr, fmt.Sprintf("child prefix %s is not contained in its parent %s", p.Cidr, parent.Cidr), nil)
+		return
+	}
+	available, ok := parent.availableChildPrefixes[p.Cidr]
+	if !ok || available {
+		c.report(FindingUnmarkedChild, p.Cidr, parent.Cidr, fmt.Sprintf("child prefix %s is not marked as acquired by its parent %s", p.Cidr, parent.Cidr), func() *Prefix {
+			parent.availableChildPrefixes[p.Cidr] = false
+			return parent
+		})
+	}
+}
+
+// checkChildren checks that the child prefixes marked as acquired by the prefix exist and link back to it.
+func (c *checker) checkChildren(p *Prefix) {
+	var children []string
+	for child, available := range p.availableChildPrefixes {
+		if !available {
+			children = append(children, child)
+		}
+	}
+	sort.Strings(children)
+	for _, cidr := range children {
+		child, ok := c.prefixes[cidr]
+		switch {
+		case !ok:
+			c.report(FindingMissingChild, p.Cidr, cidr, fmt.Sprintf("child prefix %s acquired from %s does not exist", cidr, p.Cidr), func() *Prefix {
+				delete(p.availableChildPrefixes, cidr)
+				return p
+			})
+		case child.ParentCidr == "":
+			var fix func() *Prefix
+			if c.nets[cidr] != nil && contains(c.nets[p.Cidr], c.nets[cidr]) {
+				fix = func() *Prefix {
+					child.ParentCidr = p.Cidr
+					return child
+				}
+			}
+			c.report(FindingUnlinkedChild, p.Cidr, cidr, fmt.Sprintf("child prefix %s acquired from %s has no parent", cidr, p.Cidr), fix)
+		case child.ParentCidr != p.Cidr:
+			c.report(FindingUnlinkedChild, p.Cidr, cidr, fmt.Sprintf("child prefix %s acquired from %s has the parent %s", cidr, p.Cidr, child.ParentCidr), nil)
+		}
+	}
+}
+
+// checkIPs checks that the acquired and quarantined ips are contained in the prefix and no reserved ip is acquired.
+func (c *checker) checkIPs(p *Prefix) {
+	ipnet := c.nets[p.Cidr]
+	repaired := false
+	for _, ip := range sortedIPs(p.Ips, p.quarantinedIPs()) {
+		parsed := net.ParseIP(ip)
+		if parsed == nil || !ipnet.Contains(parsed) {
+			c.report(FindingIPOutsidePrefix, p.Cidr, ip, fmt.Sprintf("ip %s is not contained in prefix %s", ip, p.Cidr), func() *Prefix {
+				p.dropIP(ip)
+				repaired = true
+				return p
+			})
+			continue
+		}
+		if _, acquired := p.Ips[ip]; acquired && p.reserved[ip] {
+			c.report(FindingReservedIPAcquired, p.Cidr, ip, fmt.Sprintf("reserved ip %s of prefix %s is acquired", ip, p.Cidr), func() *Prefix {
+				p.dropIP(ip)
+				repaired = true
+				return p
+			})
+		}
+	}
+	if repaired {
+		// the free ranges are rebuilt on the next acquisition
+		p.freeRanges = nil
+	}
+}
+
+// dropIP removes the ip with its metadata and lease from the acquired and quarantined ips.
+func (p *Prefix) dropIP(ip string) {
+	delete(p.Ips, ip)
+	delete(p.metadata, ip)
+	delete(p.leases, ip)
+	delete(p.quarantined, ip)
+}
+
+// sortedIPs returns the keys of the maps ordered by address, keys which are no ips are ordered first.
+func sortedIPs(maps ...map[string]bool) []string {
+	seen := make(map[string]bool)
+	result := []string{}
+	for _, m := range maps {
+		for ip := range m {
+			if !seen[ip] {
+				seen[ip] = true
+				result = append(result, ip)
+			}
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, errA := ipStringToInt(result[i])
+		b, errB := ipStringToInt(result[j])
+		switch {
+		case errA != nil && errB != nil:
+			return result[i] < result[j]
+		case errA != nil || errB != nil:
+			return errA != nil
+		}
+		return a.Cmp(b) < 0
+	})
+	return result
+}
+
+// checkOverlaps checks that prefixes with the same parent, or both without one, do not overlap.
+func (c *checker) checkOverlaps(cidrs []string) {
+	type bounds struct {
+		cidr       string
+		start, end *big.Int
+	}
+	siblings := make(map[string][]bounds)
+	for _, cidr := range cidrs {
+		ipnet := c.nets[cidr]
+		if ipnet == nil {
+			continue
+		}
+		start, bits := ipToInt(ipnet.IP)
+		ones, _ := ipnet.Mask.Size()
+		key := fmt.Sprintf("%s/%d", c.prefixes[cidr].ParentCidr, bits)
+		siblings[key] = append(siblings[key], bounds{cidr: cidr, start: start, end: new(big.Int).Add(start, blockSize(bits, ones))})
+	}
+	keys := []string{}
+	for key := range siblings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		group := siblings[key]
+		sort.Slice(group, func(i, j int) bool {
+			return group[i].start.Cmp(group[j].start) < 0
+		})
+		// the prefix reaching furthest so far overlaps every later one starting before its end
+		var furthest *bounds
+		for n := range group {
+			b := &group[n]
+			if furthest != nil && b.start.Cmp(furthest.end) < 0 {
+				c.report(FindingOverlappingPrefixes, b.cidr, furthest.cidr, fmt.Sprintf("prefix %s overlaps %s", b.cidr, furthest.cidr), nil)
+			}
+			if furthest == nil || b.end.Cmp(furthest.end) > 0 {
+				furthest = b
+			}
+		}
+	}
+}
+
+// contains returns true if inner is contained in outer.
+func contains(outer, inner *net.IPNet) bool {
+	outerOnes, outerBits := outer.Mask.Size()
+	innerOnes, innerBits := inner.Mask.Size()
+	return outerBits == innerBits && outerOnes <= innerOnes && outer.Contains(inner.IP)
+}
@@ -0,0 +1,137 @@
+package ipam
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIpamer_Check(t *testing.T) {
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		parent, err := ipam.NewPrefix("10.120.0.0/16", tenantid)
+		require.Nil(t, err)
+		_, err = ipam.AcquireChildPrefix(parent.Cidr, 24, tenantid)
+		require.Nil(t, err)
+		findings, err := ipam.Check(tenantid)
+		require.Nil(t, err)
+		require.Empty(t, findings)
+
+		// a parent marking a child which does not exist
+		parent = ipam.PrefixFrom(parent.Cidr, tenantid)
+		parent.availableChildPrefixes["10.120.5.0/24"] = false
+		_, err = ipam.storage.UpdatePrefix(*parent, tenantid)
+		require.Nil(t, err)
+		// a child not marked by its parent
+		unmarked, err := ipam.newPrefix("10.120.1.0/24")
+		require.Nil(t, err)
+		unmarked.ParentCidr = parent.Cidr
+		_, err = ipam.storage.CreatePrefix(*unmarked, tenantid)
+		require.Nil(t, err)
+		// a child whose parent does not exist
+		orphan, err := ipam.newPrefix("10.121.0.0/24")
+		require.Nil(t, err)
+		orphan.ParentCidr = "10.200.0.0/16"
+		_, err = ipam.storage.CreatePrefix(*orphan, tenantid)
+		require.Nil(t, err)
+		// an ip outside of its prefix
+		outside, err := ipam.newPrefix("10.122.0.0/24")
+		require.Nil(t, err)
+		outside.Ips["10.123.0.1"] = true
+		_, err = ipam.storage.CreatePrefix(*outside, tenantid)
+		require.Nil(t, err)
+		// overlapping prefixes without a parent
+		_, err = ipam.NewPrefix("10.120.128.0/17", tenantid)
+		require.Nil(t, err)
+
+		expected := []Finding{
+			{Kind: FindingUnmarkedChild, Prefix: "10.120.1.0/24", Subject: "10.120.0.0/16", Message: "child prefix 10.120.1.0/24 is not marked as acquired by its parent 10.120.0.0/16", Repairable: true},
+			{Kind: FindingMissingChild, Prefix: "10.120.0.0/16", Subject: "10.120.5.0/24", Message: "child prefix 10.120.5.0/24 acquired from 10.120.0.0/16 does not exist", Repairable: true},
+			{Kind: FindingOverlappingPrefixes, Prefix: "10.120.128.0/17", Subject: "10.120.0.0/16", Message: "prefix 10.120.128.0/17 overlaps 10.120.0.0/16"},
+			{Kind: FindingMissingParent, Prefix: "10.121.0.0/24", Subject: "10.200.0.0/16", Message: "parent prefix 10.200.0.0/16 of 10.121.0.0/24 does not exist", Repairable: true},
+			{Kind: FindingIPOutsidePrefix, Prefix: "10.122.0.0/24", Subject: "10.123.0.1", Message: "ip 10.123.0.1 is not contained in prefix 10.122.0.0/24", Repairable: true},
+		}
+		findings, err = ipam.Check(tenantid)
+		require.Nil(t, err)
+		require.ElementsMatch(t, expected, findings)
+
+		findings, err = ipam.Check(tenantid, WithRepair())
+		require.Nil(t, err)
+		for n := range expected {
+			expected[n].Repaired = expected[n].Repairable
+		}
+		require.ElementsMatch(t, expected, findings)
+
+		findings, err = ipam.Check(tenantid)
+		require.Nil(t, err)
+		require.Equal(t, []Finding{expected[2]}, findings)
+		require.Equal(t, map[string]bool{"10.120.0.0/24": false, "10.120.1.0/24": false}, ipam.PrefixFrom(parent.Cidr, tenantid).availableChildPrefixes)
+		require.Empty(t, ipam.PrefixFrom(orphan.Cidr, tenantid).ParentCidr)
+		require.Empty(t, ipam.PrefixFrom(outside.Cidr, tenantid).Ips)
+		ip, err := ipam.AcquireIP(outside.Cidr, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, "10.122.0.1", ip.IP.String())
+	})
+}
+
+func TestIpamer_CheckChildrenAndReservedIPs(t *testing.T) {
+	ipam := &ipamer{storage: NewMemory()}
+	parent, err := ipam.NewPrefix("10.124.0.0/16", tenantid)
+	require.Nil(t, err)
+	child, err := ipam.AcquireChildPrefix(parent.Cidr, 24, tenantid)
+	require.Nil(t, err)
+
+	// a child of another parent and a child without parent
+	other, err := ipam.NewPrefix("10.125.0.0/16", tenantid)
+	require.Nil(t, err)
+	other.availableChildPrefixes[child.Cidr] = false
+	_, err = ipam.storage.UpdatePrefix(*other, tenantid)
+	require.Nil(t, err)
+	child = ipam.PrefixFrom(child.Cidr, tenantid)
+	child.ParentCidr = ""
+	child.Ips["10.124.0.0"] = true
+	child.Ips["10.124.0.7"] = true
+	_, err = ipam.storage.UpdatePrefix(*child, tenantid)
+	require.Nil(t, err)
+
+	findings, err := ipam.Check(tenantid, WithRepair())
+	require.Nil(t, err)
+	require.Equal(t, []Finding{
+		{Kind: FindingUnlinkedChild, Prefix: "10.124.0.0/16", Subject: "10.124.0.0/24", Message: "child prefix 10.124.0.0/24 acquired from 10.124.0.0/16 has no parent", Repairable: true, Repaired: true},
+		{Kind: FindingReservedIPAcquired, Prefix: "10.124.0.0/24", Subject: "10.124.0.0", Message: "reserved ip 10.124.0.0 of prefix 10.124.0.0/24 is acquired", Repairable: true, Repaired: true},
+		{Kind: FindingUnlinkedChild, Prefix: "10.125.0.0/16", Subject: "10.124.0.0/24", Message: "child prefix 10.124.0.0/24 acquired from 10.125.0.0/16 has the parent 10.124.0.0/16"},
+	}, findings)
+	child = ipam.PrefixFrom(child.Cidr, tenantid)
+	require.Equal(t, parent.Cidr, child.ParentCidr)
+	require.Equal(t, map[string]bool{"10.124.0.7": true}, child.Ips)
+}
+
+func TestIpamer_CheckRepairWithoutMultiPrefixStorage(t *testing.T) {
+	ipam := &ipamer{storage: &singlePrefixStorage{Storage: NewMemory()}}
+	// two prefixes with an ip outside of them
+	for _, cidr := range []string{"10.124.0.0/24", "10.125.0.0/24"} {
+		outside, err := ipam.newPrefix(cidr)
+		require.Nil(t, err)
+		outside.Ips["10.126.0.1"] = true
+		_, err = ipam.storage.CreatePrefix(*outside, tenantid)
+		require.Nil(t, err)
+	}
+
+	// the repairs of several prefixes are not stored one by one
+	_, err := ipam.Check(tenantid, WithRepair())
+	require.True(t, errors.Is(err, ErrNotAtomic), "error must be ErrNotAtomic")
+	require.Len(t, ipam.PrefixFrom("10.124.0.0/24", tenantid).Ips, 1)
+	require.Len(t, ipam.PrefixFrom("10.125.0.0/24", tenantid).Ips, 1)
+
+	// the repair of a single prefix is stored
+	stored, err := ipam.storage.ReadPrefix("10.125.0.0/24", tenantid)
+	require.Nil(t, err)
+	stored.Ips = map[string]bool{}
+	_, err = ipam.storage.UpdatePrefix(stored, tenantid)
+	require.Nil(t, err)
+	findings, err := ipam.Check(tenantid, WithRepair())
+	require.Nil(t, err)
+	require.Len(t, findings, 1)
+	require.True(t, findings[0].Repaired)
+	require.Empty(t, ipam.PrefixFrom("10.124.0.0/24", tenantid).Ips)
+}
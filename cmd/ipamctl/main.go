@@ -0,0 +1,128 @@
+// Command ipamctl maintains the prefixes and ips stored by go-ipam.
+//
+// Usage:
+//
+//	ipamctl check -storage sqlite -dsn /var/lib/ipam/ipam.db -tenant tenant [-repair] [-json]
+//
+// check validates the stored prefixes of a tenant and prints the inconsistencies found,
+// with -repair the repairable ones are repaired. It exits with 2 if inconsistencies remain.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	goipam "github.com/chrholme/go-ipam"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] != "check" {
+		fmt.Fprintln(stderr, "usage: ipamctl check [flags]")
+		return 1
+	}
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	storage := flags.String("storage", "sqlite", "the storage: sqlite, postgres, bolt or redis")
+	dsn := flags.String("dsn", "", "the sqlite or bolt database file, the postgres dsn or the redis address")
+	schema := flags.String("schema", "", "the schema of the postgres tables")
+	tablePrefix := flags.String("table-prefix", "", "the prefix of the sqlite or postgres tables")
+	password := flags.String("redis-password", "", "the password of redis")
+	db := flags.Int("redis-db", 0, "the database of redis")
+	tenant := flags.String("tenant", "", "the tenant whose prefixes are checked")
+	repair := flags.Bool("repair", false, "repair the repairable inconsistencies")
+	asJSON := flags.Bool("json", false, "print the inconsistencies as json")
+	err := flags.Parse(args[1:])
+	if err != nil {
+		return 1
+	}
+	if *dsn == "" {
+		fmt.Fprintln(stderr, "-dsn is required")
+		return 1
+	}
+
+	var sqlOpts []goipam.SQLOption
+	if *schema != "" {
+		sqlOpts = append(sqlOpts, goipam.WithSchema(*schema))
+	}
+	if *tablePrefix != "" {
+		sqlOpts = append(sqlOpts, goipam.WithTablePrefix(*tablePrefix))
+	}
+	s, err := openStorage(*storage, *dsn, *password, *db, sqlOpts)
+	if err != nil {
+		fmt.Fprintf(stderr, "unable to open storage:%v\n", err)
+		return 1
+	}
+	defer s.Close()
+
+	var opts []goipam.CheckOption
+	if *repair {
+		opts = append(opts, goipam.WithRepair())
+	}
+	findings, err := goipam.NewWithStorage(s).Check(*tenant, opts...)
+	if err != nil {
+		fmt.Fprintf(stderr, "unable to check prefixes:%v\n", err)
+		return 1
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(findings)
+		if err != nil {
+			fmt.Fprintf(stderr, "unable to print findings:%v\n", err)
+			return 1
+		}
+	} else {
+		w := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "KIND\tPREFIX\tSUBJECT\tSTATE\tMESSAGE")
+		for _, f := range findings {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", f.Kind, f.Prefix, f.Subject, state(f), f.Message)
+		}
+		w.Flush()
+	}
+
+	for _, f := range findings {
+		if !f.Repaired {
+			return 2
+		}
+	}
+	return 0
+}
+
+func state(f goipam.Finding) string {
+	switch {
+	case f.Repaired:
+		return "repaired"
+	case f.Repairable:
+		return "repairable"
+	}
+	return "manual"
+}
+
+// closableStorage is a storage which holds a database connection or file.
+type closableStorage interface {
+	goipam.Storage
+	Close() error
+}
+
+func openStorage(kind, dsn, password string, db int, sqlOpts []goipam.SQLOption) (closableStorage, error) {
+	switch kind {
+	case "sqlite":
+		return goipam.NewSQLiteStorage(dsn, sqlOpts...)
+	case "postgres":
+		return goipam.NewPostgresStorageFromDSN(dsn, sqlOpts...)
+	case "bolt":
+		return goipam.NewBoltStorage(dsn)
+	case "redis":
+		return goipam.NewRedisStorage(dsn, password, db)
+	}
+	return nil, fmt.Errorf("unknown storage:%s", kind)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	goipam "github.com/chrholme/go-ipam"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipamctl")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ipam.db")
+	storage, err := goipam.NewBoltStorage(path)
+	require.Nil(t, err)
+	ipam := goipam.NewWithStorage(storage)
+	parent, err := ipam.NewPrefix("10.0.0.0/16", "tenant")
+	require.Nil(t, err)
+	child, err := ipam.AcquireChildPrefix(parent.Cidr, 24, "tenant")
+	require.Nil(t, err)
+	// the child is lost, its parent still marks it as acquired
+	_, err = storage.DeletePrefix(*child, "tenant")
+	require.Nil(t, err)
+	require.Nil(t, storage.Close())
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"check", "-storage", "bolt", "-dsn", path, "-tenant", "tenant", "-json"}, &stdout, &stderr)
+	require.Equal(t, 2, code, stderr.String())
+	var findings []goipam.Finding
+	require.Nil(t, json.Unmarshal(stdout.Bytes(), &findings))
+	require.Len(t, findings, 1)
+	require.Equal(t, goipam.FindingMissingChild, findings[0].Kind)
+	require.False(t, findings[0].Repaired)
+
+	stdout.Reset()
+	code = run([]string{"check", "-storage", "bolt", "-dsn", path, "-tenant", "tenant", "-repair"}, &stdout, &stderr)
+	require.Equal(t, 0, code, stderr.String())
+	require.True(t, strings.Contains(stdout.String(), "missing-child  10.0.0.0/16  10.0.0.0/24  repaired"), stdout.String())
+
+	stdout.Reset()
+	code = run([]string{"check", "-storage", "bolt", "-dsn", path, "-tenant", "tenant", "-json"}, &stdout, &stderr)
+	require.Equal(t, 0, code, stderr.String())
+	require.Equal(t, "[]\n", stdout.String())
+
+	code = run([]string{"check", "-storage", "etcd", "-dsn", path}, &stdout, &stderr)
+	require.Equal(t, 1, code)
+	require.Contains(t, stderr.String(), "unknown storage:etcd")
+}
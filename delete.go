@@ -0,0 +1,117 @@
+package ipam
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// DeleteOption configures DeletePrefixRecursive.
+type DeleteOption func(*deleteOptions)
+
+type deleteOptions struct {
+	dryRun bool
+}
+
+// WithDryRun returns the Prefixes DeletePrefixRecursive would delete without deleting them.
+func WithDryRun() DeleteOption {
+	return func(o *deleteOptions) {
+		o.dryRun = true
+	}
+}
+
+func newDeleteOptions(opts []DeleteOption) deleteOptions {
+	o := deleteOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+func (i *ipamer) DeletePrefixRecursive(cidr string, tenantid string, opts ...DeleteOption) ([]Prefix, error) {
+	return i.DeletePrefixRecursiveContext(context.Background(), cidr, tenantid, opts...)
+}
+
+func (i *ipamer) DeletePrefixRecursiveContext(ctx context.Context, cidr string, tenantid string, opts ...DeleteOption) ([]Prefix, error) {
+	o := newDeleteOptions(opts)
+	var deleted []Prefix
+	return deleted, retryOnOptimisticLock(ctx, func() error {
+		var err error
+		deleted, err = i.deletePrefixRecursiveInternal(ctx, cidr, tenantid, o)
+		return err
+	})
+}
+
+// deletePrefixRecursiveInternal deletes the prefix with its ips and all its descendants and releases it from its parent
+// in one atomic storage operation. The deleted prefixes are returned bottom-up, children before their parent.
+func (i *ipamer) deletePrefixRecursiveInternal(ctx context.Context, cidr string, tenantid string, o deleteOptions) ([]Prefix, error) {
+	root, err := i.readPrefix(ctx, cidr, tenantid)
+	if err != nil {
+		return nil, err
+	}
+	if root == nil {
+		return nil, fmt.Errorf("%w: delete prefix:%s", ErrNotFound, cidr)
+	}
+	deleted := []Prefix{}
+	visited := make(map[string]bool)
+	var collect func(p *Prefix) error
+	collect = func(p *Prefix) error {
+		visited[p.Cidr] = true
+		var children []string
+		for child, available := range p.availableChildPrefixes {
+			if !available && !visited[child] {
+				children = append(children, child)
+			}
+		}
+		sort.Strings(children)
+		for _, c := range children {
+			// a child which does not exist or belongs to another parent is only dropped from this prefix
+			child, err := i.readPrefix(ctx, c, tenantid)
+			if err != nil {
+				return err
+			}
+			if child != nil && child.ParentCidr == p.Cidr {
+				err = collect(child)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		deleted = append(deleted, *p)
+		return nil
+	}
+	err = collect(root)
+	if err != nil {
+		return nil, err
+	}
+	if o.dryRun {
+		return deleted, nil
+	}
+	// a Storage deletes a prefix without checking its version, ips acquired concurrently would be deleted unnoticed
+	if _, ok := i.storage.(MultiPrefixStorage); !ok {
+		return nil, fmt.Errorf("%w: the storage can not delete prefix:%s with its descendants", ErrNotAtomic, cidr)
+	}
+
+	changes := make([]PrefixChange, 0, len(deleted)+1)
+	for _, p := range deleted {
+		changes = append(changes, PrefixChange{Tenantid: tenantid, Prefix: p, Op: ChangeDelete})
+	}
+	if root.ParentCidr != "" {
+		parent, err := i.readPrefix(ctx, root.ParentCidr, tenantid)
+		if err != nil {
+			return nil, err
+		}
+		if parent != nil {
+			delete(parent.availableChildPrefixes, root.Cidr)
+			parent.dropAvailableChildPrefixes()
+			changes = append(changes, PrefixChange{Tenantid: tenantid, Prefix: *parent, Op: ChangeUpdate})
+		}
+	}
+	err = applyChanges(ctx, i.storage, changes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to delete prefix:%s with %d descendants", cidr, len(deleted)-1)
+	}
+	return deleted, nil
+}
@@ -0,0 +1,81 @@
+package ipam
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIpamer_DeletePrefixRecursive(t *testing.T) {
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		root, err := ipam.NewPrefix("10.130.0.0/16", tenantid)
+		require.Nil(t, err)
+		site, err := ipam.AcquireChildPrefix(root.Cidr, 20, tenantid)
+		require.Nil(t, err)
+		other, err := ipam.AcquireChildPrefix(root.Cidr, 20, tenantid)
+		require.Nil(t, err)
+		rack1, err := ipam.AcquireChildPrefix(site.Cidr, 24, tenantid)
+		require.Nil(t, err)
+		rack2, err := ipam.AcquireChildPrefix(site.Cidr, 24, tenantid)
+		require.Nil(t, err)
+		for _, rack := range []*Prefix{rack1, rack2} {
+			_, err = ipam.AcquireIPs(rack.Cidr, 3, tenantid)
+			require.Nil(t, err)
+		}
+
+		cidrs := func(prefixes []Prefix) []string {
+			result := []string{}
+			for _, p := range prefixes {
+				result = append(result, p.Cidr)
+			}
+			return result
+		}
+		deleted, err := ipam.DeletePrefixRecursive(site.Cidr, tenantid, WithDryRun())
+		require.Nil(t, err)
+		require.Equal(t, []string{"10.130.0.0/24", "10.130.1.0/24", "10.130.0.0/20"}, cidrs(deleted))
+		require.Len(t, deleted[0].Ips, 3)
+		require.NotNil(t, ipam.PrefixFrom(rack1.Cidr, tenantid))
+		require.Len(t, ipam.PrefixFrom(root.Cidr, tenantid).availableChildPrefixes, 2)
+
+		deleted, err = ipam.DeletePrefixRecursive(site.Cidr, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, []string{"10.130.0.0/24", "10.130.1.0/24", "10.130.0.0/20"}, cidrs(deleted))
+		for _, cidr := range cidrs(deleted) {
+			require.Nil(t, ipam.PrefixFrom(cidr, tenantid))
+		}
+		require.Equal(t, map[string]bool{other.Cidr: false}, ipam.PrefixFrom(root.Cidr, tenantid).availableChildPrefixes)
+		findings, err := ipam.Check(tenantid)
+		require.Nil(t, err)
+		require.Empty(t, findings)
+
+		// the released child prefix can be acquired again
+		child, err := ipam.AcquireChildPrefix(root.Cidr, 20, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, site.Cidr, child.Cidr)
+
+		deleted, err = ipam.DeletePrefixRecursive(root.Cidr, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, []string{"10.130.0.0/20", "10.130.16.0/20", "10.130.0.0/16"}, cidrs(deleted))
+		prefixes, err := ipam.storage.ReadAllPrefixes(tenantid)
+		require.Nil(t, err)
+		require.Empty(t, prefixes)
+
+		_, err = ipam.DeletePrefixRecursive(root.Cidr, tenantid)
+		require.True(t, errors.Is(err, ErrNotFound))
+	})
+}
+
+func TestIpamer_DeletePrefixRecursiveWithoutMultiPrefixStorage(t *testing.T) {
+	ipam := &ipamer{storage: &singlePrefixStorage{Storage: NewMemory()}}
+	prefix, err := ipam.NewPrefix("10.131.0.0/24", tenantid)
+	require.Nil(t, err)
+
+	deleted, err := ipam.DeletePrefixRecursive(prefix.Cidr, tenantid, WithDryRun())
+	require.Nil(t, err)
+	require.Len(t, deleted, 1)
+
+	_, err = ipam.DeletePrefixRecursive(prefix.Cidr, tenantid)
+	require.True(t, errors.Is(err, ErrNotAtomic), "error must be ErrNotAtomic")
+	require.NotNil(t, ipam.PrefixFrom(prefix.Cidr, tenantid))
+}
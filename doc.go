@@ -1,7 +1,7 @@
 /*
 Package ipam is a ip address management library for ip's and prefixes (networks).
 
-It uses either memory or postgresql database to store the ip's and prefixes.
+It uses either memory, a bbolt or sqlite database file, redis or a postgresql database to store the ip's and prefixes.
 You can also bring you own Storage implementation as you need.
 
 Example usage:
@@ -16,18 +16,18 @@ Example usage:
 			// create a ipamer with in memory storage
 			ipam := goipam.New()
 
-			prefix, err := ipam.NewPrefix("192.168.0.0/24")
+			prefix, err := ipam.NewPrefix("192.168.0.0/24", "tenant")
 			if err != nil {
 				panic(err)
 			}
 
-			ip, err := ipam.AcquireIP(prefix)
+			ip, err := ipam.AcquireIP(prefix.Cidr, "tenant")
 			if err != nil {
 				panic(err)
 			}
 			fmt.Printf("got IP: %s", ip.IP)
 
-			err = ipam.ReleaseIP(ip)
+			_, err = ipam.ReleaseIP(ip, "tenant")
 			if err != nil {
 				panic(err)
 			}
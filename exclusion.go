@@ -0,0 +1,233 @@
+package ipam
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// WithExclusionOverride allows AcquireSpecificIP to acquire an ip inside an exclusion range.
+func WithExclusionOverride() AcquireOption {
+	return func(o *acquireOptions) {
+		o.overrideExclusions = true
+	}
+}
+
+func (i *ipamer) AddExclusionRange(prefixCidr, first, last string, tenantid string) (*Prefix, error) {
+	return i.AddExclusionRangeContext(context.Background(), prefixCidr, first, last, tenantid)
+}
+
+func (i *ipamer) AddExclusionRangeContext(ctx context.Context, prefixCidr, first, last string, tenantid string) (*Prefix, error) {
+	var prefix *Prefix
+	return prefix, retryOnOptimisticLock(ctx, func() error {
+		var err error
+		prefix, err = i.updateExclusionRange(ctx, prefixCidr, first, last, tenantid, true)
+		return err
+	})
+}
+
+func (i *ipamer) RemoveExclusionRange(prefixCidr, first, last string, tenantid string) (*Prefix, error) {
+	return i.RemoveExclusionRangeContext(context.Background(), prefixCidr, first, last, tenantid)
+}
+
+func (i *ipamer) RemoveExclusionRangeContext(ctx context.Context, prefixCidr, first, last string, tenantid string) (*Prefix, error) {
+	var prefix *Prefix
+	return prefix, retryOnOptimisticLock(ctx, func() error {
+		var err error
+		prefix, err = i.updateExclusionRange(ctx, prefixCidr, first, last, tenantid, false)
+		return err
+	})
+}
+
+func (i *ipamer) ExclusionRanges(prefixCidr string, tenantid string) ([]string, error) {
+	return i.ExclusionRangesContext(context.Background(), prefixCidr, tenantid)
+}
+
+func (i *ipamer) ExclusionRangesContext(ctx context.Context, prefixCidr string, tenantid string) ([]string, error) {
+	prefix, err := i.readPrefix(ctx, prefixCidr, tenantid)
+	if err != nil {
+		return nil, err
+	}
+	if prefix == nil {
+		return nil, fmt.Errorf("%w: unable to find prefix for cidr:%s", ErrNotFound, prefixCidr)
+	}
+	return prefix.ExclusionRanges(), nil
+}
+
+// updateExclusionRange adds the range from first to last to the exclusion ranges of the prefix
+// or removes it from them and persists the prefix.
+func (i *ipamer) updateExclusionRange(ctx context.Context, prefixCidr, first, last string, tenantid string, add bool) (*Prefix, error) {
+	prefix, err := i.readPrefix(ctx, prefixCidr, tenantid)
+	if err != nil {
+		return nil, err
+	}
+	if prefix == nil {
+		return nil, fmt.Errorf("%w: unable to find prefix for cidr:%s", ErrNotFound, prefixCidr)
+	}
+	ipnet, err := prefix.IPNet()
+	if err != nil {
+		return nil, err
+	}
+	r, err := parseExclusionRange(ipnet, first, last)
+	if err != nil {
+		return nil, err
+	}
+	if add {
+		prefix.exclusions = addRange(prefix.exclusions, r)
+		if prefix.freeRanges != nil {
+			prefix.freeRanges = subtractRange(prefix.freeRanges, r)
+		}
+	} else {
+		prefix.exclusions = subtractRange(prefix.exclusions, r)
+		// addresses of the removed range become free unless they are acquired or reserved
+		err = prefix.rebuildFreeRanges()
+		if err != nil {
+			return nil, err
+		}
+	}
+	updated, err := i.contextStorage().UpdatePrefixContext(ctx, *prefix, tenantid)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to update exclusion ranges of prefix:%s", prefixCidr)
+	}
+	return &updated, nil
+}
+
+// parseExclusionRange returns the range from first to last inclusive, both must be contained in ipnet.
+func parseExclusionRange(ipnet *net.IPNet, first, last string) (ipRange, error) {
+	var bounds []*big.Int
+	for _, s := range []string{first, last} {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return ipRange{}, fmt.Errorf("given ip:%s in not valid", s)
+		}
+		if !ipnet.Contains(ip) {
+			return ipRange{}, fmt.Errorf("given ip:%s is not in %s", s, ipnet)
+		}
+		i, err := ipStringToInt(ip.String())
+		if err != nil {
+			return ipRange{}, err
+		}
+		bounds = append(bounds, i)
+	}
+	if bounds[0].Cmp(bounds[1]) > 0 {
+		return ipRange{}, fmt.Errorf("first ip:%s of range is behind last ip:%s", first, last)
+	}
+	return ipRange{start: bounds[0], end: bounds[1].Add(bounds[1], big.NewInt(1))}, nil
+}
+
+// addRange returns the union of the ordered, non overlapping ranges and r.
+func addRange(ranges []ipRange, r ipRange) []ipRange {
+	result := make([]ipRange, 0, len(ranges)+1)
+	merged := ipRange{start: new(big.Int).Set(r.start), end: new(big.Int).Set(r.end)}
+	for _, existing := range ranges {
+		switch {
+		case existing.end.Cmp(merged.start) < 0:
+			result = append(result, existing)
+		case existing.start.Cmp(merged.end) > 0:
+			result = append(result, existing)
+		default:
+			// overlapping or adjacent
+			if existing.start.Cmp(merged.start) < 0 {
+				merged.start.Set(existing.start)
+			}
+			if existing.end.Cmp(merged.end) > 0 {
+				merged.end.Set(existing.end)
+			}
+		}
+	}
+	result = append(result, merged)
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].start.Cmp(result[j].start) < 0
+	})
+	return result
+}
+
+// subtractRange returns the ordered ranges without the addresses of r.
+func subtractRange(ranges []ipRange, r ipRange) []ipRange {
+	result := make([]ipRange, 0, len(ranges)+1)
+	for _, existing := range ranges {
+		if existing.end.Cmp(r.start) <= 0 || existing.start.Cmp(r.end) >= 0 {
+			result = append(result, existing)
+			continue
+		}
+		if existing.start.Cmp(r.start) < 0 {
+			result = append(result, ipRange{start: existing.start, end: new(big.Int).Set(r.start)})
+		}
+		if existing.end.Cmp(r.end) > 0 {
+			result = append(result, ipRange{start: new(big.Int).Set(r.end), end: existing.end})
+		}
+	}
+	return result
+}
+
+// excluded returns true if ip is inside an exclusion range of the prefix.
+func (p *Prefix) excluded(ip *big.Int) bool {
+	i := sort.Search(len(p.exclusions), func(i int) bool {
+		return p.exclusions[i].end.Cmp(ip) > 0
+	})
+	return i < len(p.exclusions) && p.exclusions[i].start.Cmp(ip) <= 0
+}
+
+// ExclusionRanges returns the ranges of the prefix which are excluded from acquiring ips as first-last.
+func (p *Prefix) ExclusionRanges() []string {
+	ipnet, err := p.IPNet()
+	if err != nil {
+		return nil
+	}
+	_, bits := ipnet.Mask.Size()
+	result := make([]string, 0, len(p.exclusions))
+	for _, r := range p.exclusions {
+		result = append(result, r.format(bits))
+	}
+	return result
+}
+
+// parseExclusionRanges deserializes exclusion ranges formatted with ExclusionRanges.
+func parseExclusionRanges(ranges []string) ([]ipRange, error) {
+	var result []ipRange
+	for _, s := range ranges {
+		r, err := parseIPRange(s)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, r)
+	}
+	return result, nil
+}
+
+// excludedips returns the number of ips inside the exclusion ranges of the prefix which are neither acquired,
+// reserved nor quarantined, those are counted as such. Overlapping exclusion ranges are counted once.
+func (p *Prefix) excludedips() *big.Int {
+	var union []ipRange
+	for _, r := range p.exclusions {
+		union = addRange(union, r)
+	}
+	count := new(big.Int)
+	for _, r := range union {
+		count.Add(count, new(big.Int).Sub(r.end, r.start))
+	}
+	counted := make(map[string]bool)
+	for _, ips := range []map[string]bool{p.Ips, p.reserved, p.quarantinedIPs()} {
+		for ip := range ips {
+			if counted[ip] {
+				continue
+			}
+			counted[ip] = true
+			i, err := ipStringToInt(ip)
+			if err != nil {
+				continue
+			}
+			k := sort.Search(len(union), func(k int) bool {
+				return union[k].end.Cmp(i) > 0
+			})
+			if k < len(union) && union[k].start.Cmp(i) <= 0 {
+				count.Sub(count, big.NewInt(1))
+			}
+		}
+	}
+	return count
+}
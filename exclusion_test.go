@@ -0,0 +1,140 @@
+package ipam
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIpamer_ExclusionRanges(t *testing.T) {
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		p, err := ipam.NewPrefix("10.30.0.0/24", tenantid)
+		require.Nil(t, err)
+
+		p, err = ipam.AddExclusionRange(p.Cidr, "10.30.0.1", "10.30.0.20", tenantid)
+		require.Nil(t, err)
+		require.Equal(t, []string{"10.30.0.1-10.30.0.20"}, p.ExclusionRanges())
+		require.Equal(t, uint64(20), p.Usage().ExcludedIPs)
+
+		// overlapping and adjacent ranges are merged
+		_, err = ipam.AddExclusionRange(p.Cidr, "10.30.0.15", "10.30.0.25", tenantid)
+		require.Nil(t, err)
+		_, err = ipam.AddExclusionRange(p.Cidr, "10.30.0.26", "10.30.0.26", tenantid)
+		require.Nil(t, err)
+		_, err = ipam.AddExclusionRange(p.Cidr, "10.30.0.100", "10.30.0.110", tenantid)
+		require.Nil(t, err)
+		ranges, err := ipam.ExclusionRanges(p.Cidr, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, []string{"10.30.0.1-10.30.0.26", "10.30.0.100-10.30.0.110"}, ranges)
+
+		ip, err := ipam.AcquireIP(p.Cidr, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, "10.30.0.27", ip.IP.String())
+
+		// removing a part splits the range
+		p, err = ipam.RemoveExclusionRange(p.Cidr, "10.30.0.10", "10.30.0.12", tenantid)
+		require.Nil(t, err)
+		require.Equal(t, []string{"10.30.0.1-10.30.0.9", "10.30.0.13-10.30.0.26", "10.30.0.100-10.30.0.110"}, p.ExclusionRanges())
+		ip, err = ipam.AcquireIP(p.Cidr, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, "10.30.0.10", ip.IP.String())
+
+		_, err = ipam.ExclusionRanges("10.31.0.0/24", tenantid)
+		require.True(t, errors.Is(err, ErrNotFound))
+		_, err = ipam.AddExclusionRange(p.Cidr, "10.30.0.20", "10.30.0.10", tenantid)
+		require.EqualError(t, err, "first ip:10.30.0.20 of range is behind last ip:10.30.0.10")
+		_, err = ipam.AddExclusionRange(p.Cidr, "10.30.0.1", "10.30.1.1", tenantid)
+		require.EqualError(t, err, "given ip:10.30.1.1 is not in 10.30.0.0/24")
+	})
+}
+
+func TestIpamer_AcquireSpecificIPExcluded(t *testing.T) {
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		p, err := ipam.NewPrefix("10.32.0.0/29", tenantid)
+		require.Nil(t, err)
+		_, err = ipam.AddExclusionRange(p.Cidr, "10.32.0.1", "10.32.0.2", tenantid)
+		require.Nil(t, err)
+
+		_, err = ipam.AcquireSpecificIP(p.Cidr, "10.32.0.1", tenantid)
+		require.EqualError(t, err, "given ip:10.32.0.1 is excluded from 10.32.0.0/29")
+		ip, err := ipam.AcquireSpecificIP(p.Cidr, "10.32.0.1", tenantid, WithExclusionOverride())
+		require.Nil(t, err)
+		require.Equal(t, "10.32.0.1", ip.IP.String())
+		_, err = ipam.AcquireSpecificIP(p.Cidr, "10.32.0.1", tenantid, WithExclusionOverride())
+		require.True(t, errors.Is(err, ErrIPinUse))
+
+		// a released excluded ip is not acquired dynamically
+		_, err = ipam.ReleaseIP(ip, tenantid)
+		require.Nil(t, err)
+		for _, expected := range []string{"10.32.0.3", "10.32.0.4", "10.32.0.5", "10.32.0.6"} {
+			ip, err = ipam.AcquireIP(p.Cidr, tenantid)
+			require.Nil(t, err)
+			require.Equal(t, expected, ip.IP.String())
+		}
+		_, err = ipam.AcquireIP(p.Cidr, tenantid)
+		require.True(t, errors.Is(err, ErrNoIPAvailable))
+
+		// an acquired ip stays acquired when its range is excluded
+		_, err = ipam.AddExclusionRange(p.Cidr, "10.32.0.3", "10.32.0.3", tenantid)
+		require.Nil(t, err)
+		p = ipam.PrefixFrom(p.Cidr, tenantid)
+		require.Contains(t, p.Ips, "10.32.0.3")
+		err = ipam.ReleaseIPFromPrefix(p.Cidr, "10.32.0.3", tenantid)
+		require.Nil(t, err)
+		_, err = ipam.AcquireIP(p.Cidr, tenantid)
+		require.True(t, errors.Is(err, ErrNoIPAvailable))
+		_, err = ipam.RemoveExclusionRange(p.Cidr, "10.32.0.1", "10.32.0.3", tenantid)
+		require.Nil(t, err)
+		ip, err = ipam.AcquireIP(p.Cidr, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, "10.32.0.1", ip.IP.String())
+	})
+}
+
+func TestIpamer_ExclusionRangesWithoutFreeRanges(t *testing.T) {
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		p, err := ipam.NewPrefix("2001:db8:30::/64", tenantid)
+		require.Nil(t, err)
+		_, err = ipam.AddExclusionRange(p.Cidr, "2001:db8:30::1", "2001:db8:30::ff", tenantid)
+		require.Nil(t, err)
+
+		// the free ranges are calculated with the exclusion ranges
+		p = ipam.PrefixFrom(p.Cidr, tenantid)
+		p.freeRanges = nil
+		_, err = ipam.storage.UpdatePrefix(*p, tenantid)
+		require.Nil(t, err)
+		ip, err := ipam.AcquireIP(p.Cidr, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, "2001:db8:30::100", ip.IP.String())
+	})
+}
+
+func TestIpamer_ExcludedIPsUsage(t *testing.T) {
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		p, err := ipam.NewPrefix("10.33.0.0/24", tenantid)
+		require.Nil(t, err)
+
+		// the reserved network address is not counted as excluded
+		p, err = ipam.AddExclusionRange(p.Cidr, "10.33.0.0", "10.33.0.9", tenantid)
+		require.Nil(t, err)
+		usage := p.Usage()
+		require.Equal(t, uint64(9), usage.ExcludedIPs)
+		require.Equal(t, uint64(2), usage.AcquiredIPs)
+
+		// neither an excluded ip which is acquired
+		_, err = ipam.AcquireSpecificIP(p.Cidr, "10.33.0.5", tenantid, WithExclusionOverride())
+		require.Nil(t, err)
+		usage = ipam.PrefixFrom(p.Cidr, tenantid).Usage()
+		require.Equal(t, uint64(8), usage.ExcludedIPs)
+		require.Equal(t, uint64(3), usage.AcquiredIPs)
+		require.Equal(t, uint64(256), usage.AvailableIPs)
+	})
+}
+
+func TestPrefix_ExcludedIPsOverlapping(t *testing.T) {
+	exclusions, err := parseExclusionRanges([]string{"10.34.0.1-10.34.0.20", "10.34.0.10-10.34.0.30"})
+	require.Nil(t, err)
+	p := Prefix{Cidr: "10.34.0.0/24", Ips: map[string]bool{"10.34.0.30": true}, exclusions: exclusions}
+	require.Equal(t, uint64(29), p.Usage().ExcludedIPs)
+}
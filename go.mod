@@ -1,15 +1,18 @@
 module github.com/chrholme/go-ipam
 
-go 1.14
+go 1.16
 
 require (
+	github.com/alicebob/miniredis/v2 v2.30.0
 	github.com/avast/retry-go v2.6.0+incompatible
+	github.com/go-redis/redis v6.15.9+incompatible
 	github.com/jmoiron/sqlx v1.2.0
 	github.com/lib/pq v1.7.0
 	// sqlite v2.x is a unfortunate release
-	github.com/mattn/go-sqlite3 v1.14.0 // indirect
+	github.com/mattn/go-sqlite3 v1.14.16
 	github.com/pkg/errors v0.9.1
 	github.com/stretchr/testify v1.6.1
 	github.com/testcontainers/testcontainers-go v0.7.0
+	go.etcd.io/bbolt v1.3.5
 	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9 // indirect
 )
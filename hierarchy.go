@@ -0,0 +1,240 @@
+package ipam
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// PrefixHierarchyReader can be implemented by a Storage to read the children, descendants and ancestors of a prefix
+// without reading all prefixes of the tenant. It is used by ChildPrefixes, DescendantPrefixes and AncestorPrefixes.
+type PrefixHierarchyReader interface {
+	ReadChildPrefixes(ctx context.Context, cidr string, tenantid string) ([]Prefix, error)
+	ReadDescendantPrefixes(ctx context.Context, cidr string, tenantid string) ([]Prefix, error)
+	ReadAncestorPrefixes(ctx context.Context, cidr string, tenantid string) ([]Prefix, error)
+}
+
+// PrefixNode is a Prefix in the prefix tree of a tenant with its usage and its child prefixes.
+type PrefixNode struct {
+	Prefix   Prefix
+	Usage    Usage
+	Children []PrefixNode
+}
+
+func (i *ipamer) ChildPrefixes(cidr string, tenantid string) ([]Prefix, error) {
+	return i.ChildPrefixesContext(context.Background(), cidr, tenantid)
+}
+
+func (i *ipamer) ChildPrefixesContext(ctx context.Context, cidr string, tenantid string) ([]Prefix, error) {
+	prefix, err := i.readPrefix(ctx, cidr, tenantid)
+	if err != nil {
+		return nil, err
+	}
+	if prefix == nil {
+		return nil, fmt.Errorf("%w: unable to find prefix for cidr:%s", ErrNotFound, cidr)
+	}
+	var prefixes []Prefix
+	if reader, ok := i.storage.(PrefixHierarchyReader); ok {
+		prefixes, err = reader.ReadChildPrefixes(ctx, cidr, tenantid)
+	} else {
+		prefixes, err = i.readHierarchy(ctx, cidr, tenantid, hierarchy.childrenOf)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read child prefixes:%v", err)
+	}
+	sortPrefixesByAddress(prefixes)
+	return prefixes, nil
+}
+
+func (i *ipamer) DescendantPrefixes(cidr string, tenantid string) ([]Prefix, error) {
+	return i.DescendantPrefixesContext(context.Background(), cidr, tenantid)
+}
+
+func (i *ipamer) DescendantPrefixesContext(ctx context.Context, cidr string, tenantid string) ([]Prefix, error) {
+	prefix, err := i.readPrefix(ctx, cidr, tenantid)
+	if err != nil {
+		return nil, err
+	}
+	if prefix == nil {
+		return nil, fmt.Errorf("%w: unable to find prefix for cidr:%s", ErrNotFound, cidr)
+	}
+	var prefixes []Prefix
+	if reader, ok := i.storage.(PrefixHierarchyReader); ok {
+		prefixes, err = reader.ReadDescendantPrefixes(ctx, cidr, tenantid)
+	} else {
+		prefixes, err = i.readHierarchy(ctx, cidr, tenantid, hierarchy.descendants)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read descendant prefixes:%v", err)
+	}
+	sortPrefixesByAddress(prefixes)
+	return prefixes, nil
+}
+
+func (i *ipamer) AncestorPrefixes(cidr string, tenantid string) ([]Prefix, error) {
+	return i.AncestorPrefixesContext(context.Background(), cidr, tenantid)
+}
+
+func (i *ipamer) AncestorPrefixesContext(ctx context.Context, cidr string, tenantid string) ([]Prefix, error) {
+	prefix, err := i.readPrefix(ctx, cidr, tenantid)
+	if err != nil {
+		return nil, err
+	}
+	if prefix == nil {
+		return nil, fmt.Errorf("%w: unable to find prefix for cidr:%s", ErrNotFound, cidr)
+	}
+	var prefixes []Prefix
+	if reader, ok := i.storage.(PrefixHierarchyReader); ok {
+		prefixes, err = reader.ReadAncestorPrefixes(ctx, cidr, tenantid)
+	} else {
+		prefixes, err = i.contextStorage().ReadAllPrefixesContext(ctx, tenantid)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read ancestor prefixes:%v", err)
+	}
+
+	// walk up from the prefix, a cycle of parents ends the walk
+	byCidr := make(map[string]Prefix, len(prefixes))
+	for _, p := range prefixes {
+		byCidr[p.Cidr] = p
+	}
+	result := []Prefix{}
+	visited := map[string]bool{cidr: true}
+	for parent, ok := byCidr[prefix.ParentCidr]; ok && !visited[parent.Cidr]; parent, ok = byCidr[parent.ParentCidr] {
+		visited[parent.Cidr] = true
+		result = append(result, parent)
+	}
+	return result, nil
+}
+
+func (i *ipamer) PrefixTree(tenantid string) ([]PrefixNode, error) {
+	return i.PrefixTreeContext(context.Background(), tenantid)
+}
+
+func (i *ipamer) PrefixTreeContext(ctx context.Context, tenantid string) ([]PrefixNode, error) {
+	prefixes, err := i.contextStorage().ReadAllPrefixesContext(ctx, tenantid)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read prefixes:%v", err)
+	}
+	h := newHierarchy(prefixes)
+	visited := make(map[string]bool)
+	var node func(p Prefix) PrefixNode
+	node = func(p Prefix) PrefixNode {
+		visited[p.Cidr] = true
+		n := PrefixNode{Prefix: p, Usage: p.Usage(), Children: []PrefixNode{}}
+		for _, child := range h.children[p.Cidr] {
+			if !visited[child.Cidr] {
+				n.Children = append(n.Children, node(child))
+			}
+		}
+		return n
+	}
+	// prefixes whose parent does not exist are roots as well
+	var roots []Prefix
+	for _, p := range prefixes {
+		if _, ok := h.prefixes[p.ParentCidr]; !ok {
+			roots = append(roots, p)
+		}
+	}
+	sortPrefixesByAddress(roots)
+	tree := []PrefixNode{}
+	for _, root := range roots {
+		tree = append(tree, node(root))
+	}
+	// prefixes in a cycle of parents are not reachable from a root, the first of a cycle by address becomes its root
+	sortPrefixesByAddress(prefixes)
+	for _, p := range prefixes {
+		if !visited[p.Cidr] {
+			tree = append(tree, node(p))
+		}
+	}
+	return tree, nil
+}
+
+// hierarchy are the prefixes of a tenant by cidr and their children ordered by address by the cidr of their parent.
+type hierarchy struct {
+	prefixes map[string]Prefix
+	children map[string][]Prefix
+}
+
+func newHierarchy(prefixes []Prefix) hierarchy {
+	h := hierarchy{
+		prefixes: make(map[string]Prefix, len(prefixes)),
+		children: make(map[string][]Prefix),
+	}
+	for _, p := range prefixes {
+		h.prefixes[p.Cidr] = p
+		if p.ParentCidr != "" {
+			h.children[p.ParentCidr] = append(h.children[p.ParentCidr], p)
+		}
+	}
+	for _, children := range h.children {
+		sortPrefixesByAddress(children)
+	}
+	return h
+}
+
+// childrenOf returns the children of the prefix.
+func (h hierarchy) childrenOf(cidr string) []Prefix {
+	return h.children[cidr]
+}
+
+// descendants returns the children of the prefix, their children and so on.
+func (h hierarchy) descendants(cidr string) []Prefix {
+	result := []Prefix{}
+	visited := map[string]bool{cidr: true}
+	queue := []string{cidr}
+	for len(queue) > 0 {
+		for _, child := range h.children[queue[0]] {
+			if !visited[child.Cidr] {
+				visited[child.Cidr] = true
+				result = append(result, child)
+				queue = append(queue, child.Cidr)
+			}
+		}
+		queue = queue[1:]
+	}
+	return result
+}
+
+// readHierarchy reads all prefixes of the tenant and selects the ones related to the prefix with the given cidr.
+func (i *ipamer) readHierarchy(ctx context.Context, cidr string, tenantid string, related func(h hierarchy, cidr string) []Prefix) ([]Prefix, error) {
+	prefixes, err := i.contextStorage().ReadAllPrefixesContext(ctx, tenantid)
+	if err != nil {
+		return nil, err
+	}
+	return related(newHierarchy(prefixes), cidr), nil
+}
+
+// sortPrefixesByAddress orders the prefixes by their first address, a prefix before the longer prefixes it contains.
+// Prefixes whose cidr can not be parsed are ordered last by their cidr.
+func sortPrefixesByAddress(prefixes []Prefix) {
+	type key struct {
+		ip   []byte
+		ones int
+	}
+	keys := make(map[string]*key, len(prefixes))
+	for _, p := range prefixes {
+		_, ipnet, err := net.ParseCIDR(p.Cidr)
+		if err != nil {
+			continue
+		}
+		ones, _ := ipnet.Mask.Size()
+		keys[p.Cidr] = &key{ip: ipnet.IP.To16(), ones: ones}
+	}
+	sort.SliceStable(prefixes, func(i, j int) bool {
+		a, b := keys[prefixes[i].Cidr], keys[prefixes[j].Cidr]
+		switch {
+		case a == nil && b == nil:
+			return prefixes[i].Cidr < prefixes[j].Cidr
+		case a == nil || b == nil:
+			return b == nil
+		}
+		if c := bytes.Compare(a.ip, b.ip); c != 0 {
+			return c < 0
+		}
+		return a.ones < b.ones
+	})
+}
@@ -0,0 +1,144 @@
+package ipam
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func prefixCidrs(prefixes []Prefix) []string {
+	result := []string{}
+	for _, p := range prefixes {
+		result = append(result, p.Cidr)
+	}
+	return result
+}
+
+func newHierarchyForTest(t *testing.T, ipam *ipamer) {
+	root, err := ipam.NewPrefix("10.140.0.0/16", tenantid)
+	require.Nil(t, err)
+	for n := 0; n < 2; n++ {
+		site, err := ipam.AcquireChildPrefix(root.Cidr, 20, tenantid)
+		require.Nil(t, err)
+		for m := 0; m < 2; m++ {
+			_, err = ipam.AcquireChildPrefix(site.Cidr, 24, tenantid)
+			require.Nil(t, err)
+		}
+	}
+	_, err = ipam.AcquireIPs("10.140.17.0/24", 10, tenantid)
+	require.Nil(t, err)
+	_, err = ipam.NewPrefix("10.0.0.0/24", tenantid)
+	require.Nil(t, err)
+}
+
+func TestIpamer_PrefixHierarchy(t *testing.T) {
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		newHierarchyForTest(t, ipam)
+
+		children, err := ipam.ChildPrefixes("10.140.0.0/16", tenantid)
+		require.Nil(t, err)
+		require.Equal(t, []string{"10.140.0.0/20", "10.140.16.0/20"}, prefixCidrs(children))
+		children, err = ipam.ChildPrefixes("10.140.17.0/24", tenantid)
+		require.Nil(t, err)
+		require.Empty(t, children)
+
+		descendants, err := ipam.DescendantPrefixes("10.140.0.0/16", tenantid)
+		require.Nil(t, err)
+		require.Equal(t, []string{"10.140.0.0/20", "10.140.0.0/24", "10.140.1.0/24", "10.140.16.0/20", "10.140.16.0/24", "10.140.17.0/24"}, prefixCidrs(descendants))
+		require.Len(t, descendants[5].Ips, 10)
+
+		ancestors, err := ipam.AncestorPrefixes("10.140.17.0/24", tenantid)
+		require.Nil(t, err)
+		require.Equal(t, []string{"10.140.16.0/20", "10.140.0.0/16"}, prefixCidrs(ancestors))
+		ancestors, err = ipam.AncestorPrefixes("10.140.0.0/16", tenantid)
+		require.Nil(t, err)
+		require.Empty(t, ancestors)
+
+		for _, query := range []func(string, string) ([]Prefix, error){ipam.ChildPrefixes, ipam.DescendantPrefixes, ipam.AncestorPrefixes} {
+			_, err = query("10.141.0.0/16", tenantid)
+			require.True(t, errors.Is(err, ErrNotFound))
+		}
+	})
+}
+
+func TestIpamer_PrefixTree(t *testing.T) {
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		newHierarchyForTest(t, ipam)
+
+		tree, err := ipam.PrefixTree(tenantid)
+		require.Nil(t, err)
+		require.Len(t, tree, 2)
+		require.Equal(t, "10.0.0.0/24", tree[0].Prefix.Cidr)
+		require.Empty(t, tree[0].Children)
+		root := tree[1]
+		require.Equal(t, "10.140.0.0/16", root.Prefix.Cidr)
+		require.Equal(t, uint64(2), root.Usage.AcquiredPrefixes)
+		require.Len(t, root.Children, 2)
+		site := root.Children[1]
+		require.Equal(t, "10.140.16.0/20", site.Prefix.Cidr)
+		require.Equal(t, []string{"10.140.16.0/24", "10.140.17.0/24"}, []string{site.Children[0].Prefix.Cidr, site.Children[1].Prefix.Cidr})
+		// the acquired ips include the network and broadcast address
+		require.Equal(t, uint64(12), site.Children[1].Usage.AcquiredIPs)
+
+		// prefixes in a cycle of parents are not dropped
+		p, err := ipam.storage.ReadPrefix("10.140.0.0/16", tenantid)
+		require.Nil(t, err)
+		p.ParentCidr = "10.140.17.0/24"
+		_, err = ipam.storage.UpdatePrefix(p, tenantid)
+		require.Nil(t, err)
+		tree, err = ipam.PrefixTree(tenantid)
+		require.Nil(t, err)
+		require.Len(t, tree, 2)
+		require.Equal(t, "10.0.0.0/24", tree[0].Prefix.Cidr)
+		require.Equal(t, "10.140.0.0/16", tree[1].Prefix.Cidr)
+		require.Len(t, tree[1].Children, 2)
+	})
+}
+
+func Test_sql_ReadPrefixHierarchy(t *testing.T) {
+	ctx := context.Background()
+	testWithSQLBackends(t, func(t *testing.T, db *sql) {
+		ipam := &ipamer{storage: db}
+		newHierarchyForTest(t, ipam)
+
+		children, err := db.ReadChildPrefixes(ctx, "10.140.16.0/20", tenantid)
+		require.Nil(t, err)
+		require.ElementsMatch(t, []string{"10.140.16.0/24", "10.140.17.0/24"}, prefixCidrs(children))
+		if db.dialect == dialectSQLite {
+			var plan []struct {
+				ID      int    `db:"id"`
+				Parent  int    `db:"parent"`
+				NotUsed int    `db:"notused"`
+				Detail  string `db:"detail"`
+			}
+			err = db.db.Select(&plan, "EXPLAIN QUERY PLAN SELECT prefix FROM prefixes WHERE tenantid=$1 AND parent_cidr=$2", tenantid, "10.140.16.0/20")
+			require.Nil(t, err)
+			require.NotEmpty(t, plan)
+			require.Contains(t, plan[0].Detail, "parent_prefix_idx")
+		}
+		descendants, err := db.ReadDescendantPrefixes(ctx, "10.140.0.0/16", tenantid)
+		require.Nil(t, err)
+		require.Len(t, descendants, 6)
+		ancestors, err := db.ReadAncestorPrefixes(ctx, "10.140.17.0/24", tenantid)
+		require.Nil(t, err)
+		require.ElementsMatch(t, []string{"10.140.16.0/20", "10.140.0.0/16"}, prefixCidrs(ancestors))
+		descendants, err = db.ReadDescendantPrefixes(ctx, "10.140.0.0/16", "other")
+		require.Nil(t, err)
+		require.Empty(t, descendants)
+
+		// a cycle of parents ends the recursion
+		p, err := db.ReadPrefix("10.140.0.0/16", tenantid)
+		require.Nil(t, err)
+		p.ParentCidr = "10.140.17.0/24"
+		_, err = db.UpdatePrefix(p, tenantid)
+		require.Nil(t, err)
+		descendants, err = db.ReadDescendantPrefixes(ctx, "10.140.0.0/16", tenantid)
+		require.Nil(t, err)
+		require.Len(t, descendants, 7)
+		ancestors, err = ipam.AncestorPrefixes("10.140.17.0/24", tenantid)
+		require.Nil(t, err)
+		require.Equal(t, []string{"10.140.16.0/20", "10.140.0.0/16"}, prefixCidrs(ancestors))
+	})
+}
@@ -1,45 +1,17 @@
 package ipam
 
 import (
-	"fmt"
 	"math/big"
 	"net"
+	"time"
 )
 
 // IP is a single ipaddress.
 type IP struct {
 	IP           net.IP
 	ParentPrefix string
-}
-
-func (i *IP) or(ip IP) IP {
-	var result []byte
-	for index, part := range i.IP {
-		result = append(result, ip.IP[index]|part)
-	}
-
-	return IP{
-		IP: result,
-	}
-}
-
-func (i *IP) not() IP {
-	var result []byte
-	for _, part := range i.IP {
-		result = append(result, ^part)
-	}
-	return IP{
-		IP: result,
-	}
-}
-
-func inc(ip net.IP) {
-	for j := len(ip) - 1; j >= 0; j-- {
-		ip[j]++
-		if ip[j] > 0 {
-			break
-		}
-	}
+	Metadata     IPMetadata
+	Expires      time.Time // the expiry of the lease, zero if the ip is not leased
 }
 
 func ipToInt(ip net.IP) (*big.Int, int) {
@@ -63,15 +35,3 @@ func intToIP(ipInt *big.Int, bits int) net.IP {
 	}
 	return net.IP(ret)
 }
-
-func insertNumIntoIP(ip net.IP, num int, prefixLen int) (*net.IP, error) {
-	ipInt, totalBits := ipToInt(ip)
-	if ipInt == nil {
-		return nil, fmt.Errorf("unable to convert ip %s to int", ip)
-	}
-	bigNum := big.NewInt(int64(num))
-	bigNum.Lsh(bigNum, uint(totalBits-prefixLen))
-	ipInt.Or(ipInt, bigNum)
-	result := intToIP(ipInt, totalBits)
-	return &result, nil
-}
@@ -1,47 +1,213 @@
 package ipam
 
+import (
+	"context"
+	"time"
+)
+
 // Ipamer can be used to do IPAM stuff.
 type Ipamer interface {
 	// NewPrefix create a new Prefix from a string notation.
-	NewPrefix(cidr string, tenantid string) (*Prefix, error)
+	// The allocation strategy of the Prefix can be set with WithPrefixAllocationStrategy,
+	// the reserved ips with WithReservedIPs.
+	NewPrefix(cidr string, tenantid string, opts ...PrefixOption) (*Prefix, error)
+	// NewPrefixContext is like NewPrefix but uses the given context for storage operations.
+	NewPrefixContext(ctx context.Context, cidr string, tenantid string, opts ...PrefixOption) (*Prefix, error)
 	// DeletePrefix delete a Prefix from a string notation.
 	// If the Prefix is not found an NotFoundError is returned.
 	DeletePrefix(cidr string, tenantid string) (*Prefix, error)
+	// DeletePrefixContext is like DeletePrefix but uses the given context for storage operations.
+	DeletePrefixContext(ctx context.Context, cidr string, tenantid string) (*Prefix, error)
+	// DeletePrefixRecursive deletes a Prefix with its IPs and all its child prefixes bottom-up and releases it from
+	// its parent Prefix, all in one atomic storage operation. The deleted Prefixes are returned bottom-up,
+	// with WithDryRun they are only returned. If the Prefix is not found an NotFoundError is returned.
+	// A Storage which does not implement MultiPrefixStorage is refused with ErrNotAtomic.
+	DeletePrefixRecursive(cidr string, tenantid string, opts ...DeleteOption) ([]Prefix, error)
+	// DeletePrefixRecursiveContext is like DeletePrefixRecursive but uses the given context for storage operations,
+	// retries on concurrent modification stop when the context is done.
+	DeletePrefixRecursiveContext(ctx context.Context, cidr string, tenantid string, opts ...DeleteOption) ([]Prefix, error)
 	// AcquireChildPrefix will return a Prefix with a smaller length from the given Prefix.
-	AcquireChildPrefix(parentCidr string, length int, tenantid string) (*Prefix, error)
+	// Child prefixes of different lengths can be acquired from one Prefix, each is aligned to its length.
+	// Which free child prefix is returned depends on the allocation strategy of the Prefix.
+	// The child is stored together with its parent, a Storage which does not implement MultiPrefixStorage
+	// is refused with ErrNotAtomic.
+	AcquireChildPrefix(parentCidr string, length int, tenantid string, opts ...AcquireOption) (*Prefix, error)
+	// AcquireChildPrefixContext is like AcquireChildPrefix but uses the given context for storage operations,
+	// retries on concurrent modification stop when the context is done.
+	AcquireChildPrefixContext(ctx context.Context, parentCidr string, length int, tenantid string, opts ...AcquireOption) (*Prefix, error)
 	// ReleaseChildPrefix will mark this child Prefix as available again.
+	// Like AcquireChildPrefix it returns ErrNotAtomic on a Storage which does not implement MultiPrefixStorage.
 	ReleaseChildPrefix(child *Prefix, tenantid string) error
+	// ReleaseChildPrefixContext is like ReleaseChildPrefix but uses the given context for storage operations,
+	// retries on concurrent modification stop when the context is done.
+	ReleaseChildPrefixContext(ctx context.Context, child *Prefix, tenantid string) error
 	// PrefixFrom will return a known Prefix.
 	PrefixFrom(cidr string, tenantid string) *Prefix
+	// PrefixFromContext is like PrefixFrom but uses the given context for storage operations.
+	PrefixFromContext(ctx context.Context, cidr string, tenantid string) *Prefix
 	// AcquireSpecificIP will acquire given IP and mark this IP as used, if already in use, return nil.
 	// If specificIP is empty, the next free IP is returned.
 	// If there is no free IP an NoIPAvailableError is returned.
-	AcquireSpecificIP(prefixCidr, specificIP string, tenantid string) (*IP, error)
-	// AcquireIP will return the next unused IP from this Prefix.
-	AcquireIP(prefixCidr string, tenantid string) (*IP, error)
+	// An IP inside an exclusion range can only be acquired with WithExclusionOverride.
+	// Metadata like the owner of the IP can be stored with WithMetadata, WithLease acquires the IP for a limited time.
+	AcquireSpecificIP(prefixCidr, specificIP string, tenantid string, opts ...AcquireOption) (*IP, error)
+	// AcquireSpecificIPContext is like AcquireSpecificIP but uses the given context for storage operations,
+	// retries on concurrent modification stop when the context is done.
+	AcquireSpecificIPContext(ctx context.Context, prefixCidr, specificIP string, tenantid string, opts ...AcquireOption) (*IP, error)
+	// AcquireIP will return the next unused IP from this Prefix according to its allocation strategy.
+	// The Hash allocation strategy requires a key given with WithKey.
+	// With WithStickyKey the IP previously bound to the key is returned again if it is free.
+	// Metadata like the owner of the IP can be stored with WithMetadata, WithLease acquires the IP for a limited time.
+	AcquireIP(prefixCidr string, tenantid string, opts ...AcquireOption) (*IP, error)
+	// AcquireIPContext is like AcquireIP but uses the given context for storage operations,
+	// retries on concurrent modification stop when the context is done.
+	AcquireIPContext(ctx context.Context, prefixCidr string, tenantid string, opts ...AcquireOption) (*IP, error)
+	// AcquireIPs acquires n IPs from this Prefix according to its allocation strategy with a single update of the Prefix.
+	// Either all n IPs are acquired or none, if there are less free IPs an NoIPAvailableError is returned.
+	AcquireIPs(prefixCidr string, n int, tenantid string, opts ...AcquireOption) ([]IP, error)
+	// AcquireIPsContext is like AcquireIPs but uses the given context for storage operations,
+	// retries on concurrent modification stop when the context is done.
+	AcquireIPsContext(ctx context.Context, prefixCidr string, n int, tenantid string, opts ...AcquireOption) ([]IP, error)
+	// AcquireContiguousIPs is like AcquireIPs but the n IPs have consecutive addresses.
+	AcquireContiguousIPs(prefixCidr string, n int, tenantid string, opts ...AcquireOption) ([]IP, error)
+	// AcquireContiguousIPsContext is like AcquireContiguousIPs but uses the given context for storage operations,
+	// retries on concurrent modification stop when the context is done.
+	AcquireContiguousIPsContext(ctx context.Context, prefixCidr string, n int, tenantid string, opts ...AcquireOption) ([]IP, error)
+	// ReleaseIPs releases the given IPs of the Prefix with a single update and returns the updated Prefix.
+	// Either all IPs are released or none, if one of them is not found an NotFoundError is returned.
+	ReleaseIPs(prefixCidr string, ips []string, tenantid string) (*Prefix, error)
+	// ReleaseIPsContext is like ReleaseIPs but uses the given context for storage operations,
+	// retries on concurrent modification stop when the context is done.
+	ReleaseIPsContext(ctx context.Context, prefixCidr string, ips []string, tenantid string) (*Prefix, error)
 	// ReleaseIP will release the given IP for later usage and returns the updated Prefix.
 	// If the IP is not found an NotFoundError is returned.
 	ReleaseIP(ip *IP, tenantid string) (*Prefix, error)
+	// ReleaseIPContext is like ReleaseIP but uses the given context for storage operations,
+	// retries on concurrent modification stop when the context is done.
+	ReleaseIPContext(ctx context.Context, ip *IP, tenantid string) (*Prefix, error)
 	// ReleaseIPFromPrefix will release the given IP for later usage.
 	// If the Prefix or the IP is not found an NotFoundError is returned.
 	ReleaseIPFromPrefix(prefixCidr, ip string, tenantid string) error
+	// ReleaseIPFromPrefixContext is like ReleaseIPFromPrefix but uses the given context for storage operations,
+	// retries on concurrent modification stop when the context is done.
+	ReleaseIPFromPrefixContext(ctx context.Context, prefixCidr, ip string, tenantid string) error
+	// IPFrom returns the acquired IP of the Prefix with its metadata.
+	// If the Prefix or the IP is not found an NotFoundError is returned.
+	IPFrom(prefixCidr, ip string, tenantid string) (*IP, error)
+	// IPFromContext is like IPFrom but uses the given context for storage operations.
+	IPFromContext(ctx context.Context, prefixCidr, ip string, tenantid string) (*IP, error)
+	// IPsByOwner returns all acquired IPs of the tenant with the given owner in their metadata,
+	// ordered by Prefix and IP.
+	IPsByOwner(owner string, tenantid string) ([]IP, error)
+	// IPsByOwnerContext is like IPsByOwner but uses the given context for storage operations.
+	IPsByOwnerContext(ctx context.Context, owner string, tenantid string) ([]IP, error)
+	// AddExclusionRange excludes the IPs from first to last inclusive of the Prefix from AcquireIP.
+	// IPs which are already acquired stay acquired.
+	AddExclusionRange(prefixCidr, first, last string, tenantid string) (*Prefix, error)
+	// AddExclusionRangeContext is like AddExclusionRange but uses the given context for storage operations,
+	// retries on concurrent modification stop when the context is done.
+	AddExclusionRangeContext(ctx context.Context, prefixCidr, first, last string, tenantid string) (*Prefix, error)
+	// RemoveExclusionRange makes the IPs from first to last inclusive of the Prefix available for AcquireIP again.
+	RemoveExclusionRange(prefixCidr, first, last string, tenantid string) (*Prefix, error)
+	// RemoveExclusionRangeContext is like RemoveExclusionRange but uses the given context for storage operations,
+	// retries on concurrent modification stop when the context is done.
+	RemoveExclusionRangeContext(ctx context.Context, prefixCidr, first, last string, tenantid string) (*Prefix, error)
+	// ExclusionRanges returns the exclusion ranges of the Prefix as first-last ordered by address.
+	// If the Prefix is not found an NotFoundError is returned.
+	ExclusionRanges(prefixCidr string, tenantid string) ([]string, error)
+	// ExclusionRangesContext is like ExclusionRanges but uses the given context for storage operations.
+	ExclusionRangesContext(ctx context.Context, prefixCidr string, tenantid string) ([]string, error)
+	// UpdatePrefixMetadata replaces the description and the labels of the Prefix.
+	// If the Prefix is not found an NotFoundError is returned.
+	UpdatePrefixMetadata(cidr, description string, labels map[string]string, tenantid string) (*Prefix, error)
+	// UpdatePrefixMetadataContext is like UpdatePrefixMetadata but uses the given context for storage operations,
+	// retries on concurrent modification stop when the context is done.
+	UpdatePrefixMetadataContext(ctx context.Context, cidr, description string, labels map[string]string, tenantid string) (*Prefix, error)
+	// PrefixesByLabelSelector returns the Prefixes of the tenant whose labels match the selector, ordered by Cidr.
+	// The selector is a comma separated list of requirements which all must match,
+	// each is one of key=value, key==value, key!=value, key or !key, e.g. "site=fra1,role=mgmt".
+	PrefixesByLabelSelector(selector string, tenantid string) ([]Prefix, error)
+	// PrefixesByLabelSelectorContext is like PrefixesByLabelSelector but uses the given context for storage operations.
+	PrefixesByLabelSelectorContext(ctx context.Context, selector string, tenantid string) ([]Prefix, error)
+	// RenewLease extends the lease of an IP acquired with WithLease to the given duration from now.
+	// If the Prefix or the IP is not found or the lease has expired an NotFoundError is returned.
+	RenewLease(prefixCidr, ip string, ttl time.Duration, tenantid string) (*IP, error)
+	// RenewLeaseContext is like RenewLease but uses the given context for storage operations,
+	// retries on concurrent modification stop when the context is done.
+	RenewLeaseContext(ctx context.Context, prefixCidr, ip string, ttl time.Duration, tenantid string) (*IP, error)
+	// ReleaseExpiredLeases releases all IPs of the tenant whose lease has expired and returns them,
+	// ordered by Prefix and IP.
+	ReleaseExpiredLeases(tenantid string) ([]IP, error)
+	// ReleaseExpiredLeasesContext is like ReleaseExpiredLeases but uses the given context for storage operations.
+	ReleaseExpiredLeasesContext(ctx context.Context, tenantid string) ([]IP, error)
+	// RunLeaseReaper releases the expired leases of the tenant every interval until the context is done,
+	// it blocks and is meant to be run in its own goroutine. Errors are passed to onError which may be nil.
+	RunLeaseReaper(ctx context.Context, interval time.Duration, tenantid string, onError func(error))
+	// Tx calls fn with a Ipamer whose modifications are staged and applied together once fn returns nil.
+	// If fn returns an error nothing is applied. The modifications are applied atomically by a MultiPrefixStorage,
+	// on other storages only a single modified Prefix can be applied and ErrNotAtomic is returned for more.
+	// If a modified Prefix was changed concurrently fn is called again, it must not have side effects besides the given Ipamer.
+	Tx(fn func(tx Ipamer) error) error
+	// TxContext is like Tx but uses the given context for storage operations,
+	// retries on concurrent modification stop when the context is done.
+	TxContext(ctx context.Context, fn func(tx Ipamer) error) error
+	// Check validates the stored prefixes of the tenant and returns the inconsistencies found, ordered by Prefix.
+	// It validates the links between parent and child prefixes, the overlap of sibling prefixes,
+	// that the ips are contained in their Prefix and that no reserved ip is acquired.
+	// With WithRepair the repairable findings are repaired.
+	Check(tenantid string, opts ...CheckOption) ([]Finding, error)
+	// CheckContext is like Check but uses the given context for storage operations,
+	// retries on concurrent modification stop when the context is done.
+	CheckContext(ctx context.Context, tenantid string, opts ...CheckOption) ([]Finding, error)
+	// ChildPrefixes returns the Prefixes whose parent is the given Prefix, ordered by address.
+	// If the Prefix is not found an NotFoundError is returned.
+	ChildPrefixes(cidr string, tenantid string) ([]Prefix, error)
+	// ChildPrefixesContext is like ChildPrefixes but uses the given context for storage operations.
+	ChildPrefixesContext(ctx context.Context, cidr string, tenantid string) ([]Prefix, error)
+	// DescendantPrefixes returns the children of the given Prefix, their children and so on, ordered by address.
+	// If the Prefix is not found an NotFoundError is returned.
+	DescendantPrefixes(cidr string, tenantid string) ([]Prefix, error)
+	// DescendantPrefixesContext is like DescendantPrefixes but uses the given context for storage operations.
+	DescendantPrefixesContext(ctx context.Context, cidr string, tenantid string) ([]Prefix, error)
+	// AncestorPrefixes returns the parent of the given Prefix, its parent and so on up to the root.
+	// If the Prefix is not found an NotFoundError is returned.
+	AncestorPrefixes(cidr string, tenantid string) ([]Prefix, error)
+	// AncestorPrefixesContext is like AncestorPrefixes but uses the given context for storage operations.
+	AncestorPrefixesContext(ctx context.Context, cidr string, tenantid string) ([]Prefix, error)
+	// PrefixTree returns the Prefixes of the tenant as trees of child prefixes with the usage of every Prefix.
+	// The roots are the Prefixes without an existing parent, roots and children are ordered by address.
+	// Prefixes in a cycle of parents follow these roots, the first Prefix of a cycle by address is the root of its tree.
+	PrefixTree(tenantid string) ([]PrefixNode, error)
+	// PrefixTreeContext is like PrefixTree but uses the given context for storage operations.
+	PrefixTreeContext(ctx context.Context, tenantid string) ([]PrefixNode, error)
 	// PrefixesOverlapping will check if one ore more prefix of newPrefixes is overlapping
 	// with one of existingPrefixes
 	PrefixesOverlapping(existingPrefixes []string, newPrefixes []string) error
 }
 
 type ipamer struct {
-	storage Storage
+	storage  Storage
+	strategy AllocationStrategy
+	clock    func() time.Time // returns the current time, time.Now if nil
 }
 
 // New returns a Ipamer with in memory storage for networks, prefixes and ips.
-//func New() Ipamer {
-//	storage := NewMemory()
-//	return &ipamer{storage: storage}
-//}
+func New(opts ...Option) Ipamer {
+	storage := NewMemory()
+	return NewWithStorage(storage, opts...)
+}
 
 // NewWithStorage allows you to create a Ipamer instance with your Storage implementation.
 // The Storage interface must be implemented.
-func NewWithStorage(storage Storage) Ipamer {
-	return &ipamer{storage: storage}
+func NewWithStorage(storage Storage, opts ...Option) Ipamer {
+	i := &ipamer{storage: storage}
+	for _, opt := range opts {
+		opt(i)
+	}
+	return i
+}
+
+// contextStorage returns the context aware operations of the storage.
+func (i *ipamer) contextStorage() ContextStorage {
+	return storageWithContext(i.storage)
 }
@@ -1,17 +1,18 @@
 package ipam
 
-/*
+import "fmt"
+
 func ExampleIpamer_NewPrefix() {
 	ipamer := New()
-	prefix, err := ipamer.NewPrefix("192.168.0.0/24")
+	prefix, err := ipamer.NewPrefix("192.168.0.0/24", tenantid)
 	if err != nil {
 		panic(err)
 	}
-	ip1, err := ipamer.AcquireIP(prefix.Cidr)
+	ip1, err := ipamer.AcquireIP(prefix.Cidr, tenantid)
 	if err != nil {
 		panic(err)
 	}
-	ip2, err := ipamer.AcquireIP(prefix.Cidr)
+	ip2, err := ipamer.AcquireIP(prefix.Cidr, tenantid)
 	if err != nil {
 		panic(err)
 	}
@@ -28,18 +29,17 @@ func ExampleIpamer_NewPrefix() {
 	// 192.168.0.2
 	// 192.168.0.0/24
 
-	_, err = ipamer.ReleaseIP(ip2)
+	_, err = ipamer.ReleaseIP(ip2, tenantid)
 	if err != nil {
 		panic(err)
 	}
 
-	_, err = ipamer.ReleaseIP(ip1)
+	_, err = ipamer.ReleaseIP(ip1, tenantid)
 	if err != nil {
 		panic(err)
 	}
-	_, err = ipamer.DeletePrefix(prefix.Cidr)
+	_, err = ipamer.DeletePrefix(prefix.Cidr, tenantid)
 	if err != nil {
 		panic(err)
 	}
-
-}*/
+}
@@ -0,0 +1,210 @@
+package ipam
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+)
+
+// ipRange is the range of addresses from start inclusive to end exclusive.
+type ipRange struct {
+	start *big.Int
+	end   *big.Int
+}
+
+// format returns the range as "first-last" with ips of the given bit length.
+func (r ipRange) format(bits int) string {
+	last := new(big.Int).Sub(r.end, big.NewInt(1))
+	return intToIP(r.start, bits).String() + "-" + intToIP(last, bits).String()
+}
+
+// parseIPRange parses a range formatted with format.
+func parseIPRange(s string) (ipRange, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return ipRange{}, fmt.Errorf("invalid ip range:%s", s)
+	}
+	first, err := ipStringToInt(parts[0])
+	if err != nil {
+		return ipRange{}, err
+	}
+	last, err := ipStringToInt(parts[1])
+	if err != nil {
+		return ipRange{}, err
+	}
+	return ipRange{start: first, end: last.Add(last, big.NewInt(1))}, nil
+}
+
+// ipStringToInt converts an ipv4 or ipv6 address to its integer value.
+func ipStringToInt(s string) (*big.Int, error) {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip:%s", s)
+	}
+	if v4 := ip.To4(); v4 != nil && !strings.Contains(s, ":") {
+		ip = v4
+	}
+	i, _ := ipToInt(ip)
+	return i, nil
+}
+
+func copyRanges(ranges []ipRange) []ipRange {
+	if ranges == nil {
+		return nil
+	}
+	result := make([]ipRange, len(ranges))
+	for i, r := range ranges {
+		result[i] = ipRange{start: new(big.Int).Set(r.start), end: new(big.Int).Set(r.end)}
+	}
+	return result
+}
+
+// formatFreeRanges serializes the free ranges of the prefix, nil if they are not known.
+func (p *Prefix) formatFreeRanges() []string {
+	if p.freeRanges == nil {
+		return nil
+	}
+	ipnet, err := p.IPNet()
+	if err != nil {
+		return nil
+	}
+	_, bits := ipnet.Mask.Size()
+	result := make([]string, 0, len(p.freeRanges))
+	for _, r := range p.freeRanges {
+		result = append(result, r.format(bits))
+	}
+	return result
+}
+
+// parseFreeRanges deserializes free ranges, nil if they are not given or invalid,
+// in which case they are calculated from the ips of the prefix when needed.
+func parseFreeRanges(ranges []string) []ipRange {
+	if ranges == nil {
+		return nil
+	}
+	result := make([]ipRange, 0, len(ranges))
+	for _, s := range ranges {
+		r, err := parseIPRange(s)
+		if err != nil {
+			return nil
+		}
+		result = append(result, r)
+	}
+	return result
+}
+
+// rebuildFreeRanges calculates the free ranges from the ips of the prefix.
+func (p *Prefix) rebuildFreeRanges() error {
+	ipnet, err := p.IPNet()
+	if err != nil {
+		return err
+	}
+	start, bits := ipToInt(ipnet.IP)
+	ones, _ := ipnet.Mask.Size()
+	end := new(big.Int).Add(start, blockSize(bits, ones))
+
+	used := make([]*big.Int, 0, len(p.Ips)+len(p.reserved)+len(p.quarantined))
+	for _, ips := range []map[string]bool{p.Ips, p.reserved, p.quarantinedIPs()} {
+		for ip := range ips {
+			i, err := ipStringToInt(ip)
+			if err != nil {
+				return err
+			}
+			if i.Cmp(start) < 0 || i.Cmp(end) >= 0 {
+				continue
+			}
+			used = append(used, i)
+		}
+	}
+	sort.Slice(used, func(i, j int) bool {
+		return used[i].Cmp(used[j]) < 0
+	})
+
+	ranges := []ipRange{}
+	next := start
+	for _, u := range used {
+		if u.Cmp(next) > 0 {
+			ranges = append(ranges, ipRange{start: next, end: u})
+		}
+		if u.Cmp(next) >= 0 {
+			next = new(big.Int).Add(u, big.NewInt(1))
+		}
+	}
+	if next.Cmp(end) < 0 {
+		ranges = append(ranges, ipRange{start: next, end: end})
+	}
+	for _, r := range p.exclusions {
+		ranges = subtractRange(ranges, r)
+	}
+	p.freeRanges = ranges
+	return nil
+}
+
+// freeRangeIndex returns the index of the free range which contains ip, -1 if ip is not free.
+func (p *Prefix) freeRangeIndex(ip *big.Int) int {
+	i := p.freeRangeIndexFrom(ip)
+	if i < len(p.freeRanges) && p.freeRanges[i].start.Cmp(ip) <= 0 {
+		return i
+	}
+	return -1
+}
+
+// freeRangeIndexFrom returns the index of the first free range which ends behind ip,
+// len(p.freeRanges) if there is none.
+func (p *Prefix) freeRangeIndexFrom(ip *big.Int) int {
+	return sort.Search(len(p.freeRanges), func(i int) bool {
+		return p.freeRanges[i].end.Cmp(ip) > 0
+	})
+}
+
+// takeFree removes ip from the free ranges, returns false if it was not free.
+func (p *Prefix) takeFree(ip *big.Int) bool {
+	i := p.freeRangeIndex(ip)
+	if i < 0 {
+		return false
+	}
+	r := p.freeRanges[i]
+	next := new(big.Int).Add(ip, big.NewInt(1))
+	var replacement []ipRange
+	if r.start.Cmp(ip) < 0 {
+		replacement = append(replacement, ipRange{start: r.start, end: new(big.Int).Set(ip)})
+	}
+	if next.Cmp(r.end) < 0 {
+		replacement = append(replacement, ipRange{start: next, end: r.end})
+	}
+	ranges := make([]ipRange, 0, len(p.freeRanges)+1)
+	ranges = append(ranges, p.freeRanges[:i]...)
+	ranges = append(ranges, replacement...)
+	ranges = append(ranges, p.freeRanges[i+1:]...)
+	p.freeRanges = ranges
+	return true
+}
+
+// addFree inserts ip into the free ranges and merges adjacent ranges.
+func (p *Prefix) addFree(ip *big.Int) {
+	if p.freeRangeIndex(ip) >= 0 {
+		return
+	}
+	next := new(big.Int).Add(ip, big.NewInt(1))
+	// index of the first range behind ip
+	i := sort.Search(len(p.freeRanges), func(i int) bool {
+		return p.freeRanges[i].start.Cmp(ip) > 0
+	})
+	mergePrev := i > 0 && p.freeRanges[i-1].end.Cmp(ip) == 0
+	mergeNext := i < len(p.freeRanges) && p.freeRanges[i].start.Cmp(next) == 0
+	switch {
+	case mergePrev && mergeNext:
+		p.freeRanges[i-1].end = p.freeRanges[i].end
+		p.freeRanges = append(p.freeRanges[:i], p.freeRanges[i+1:]...)
+	case mergePrev:
+		p.freeRanges[i-1].end = next
+	case mergeNext:
+		p.freeRanges[i].start = new(big.Int).Set(ip)
+	default:
+		p.freeRanges = append(p.freeRanges, ipRange{})
+		copy(p.freeRanges[i+1:], p.freeRanges[i:])
+		p.freeRanges[i] = ipRange{start: new(big.Int).Set(ip), end: next}
+	}
+}
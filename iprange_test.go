@@ -0,0 +1,159 @@
+package ipam
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func formatRanges(t *testing.T, p *Prefix) []string {
+	// the sql storages do not store the free ranges, they are calculated from the ips
+	if p.stored != nil && p.freeRanges == nil {
+		require.Nil(t, p.rebuildFreeRanges())
+	}
+	require.NotNil(t, p.freeRanges)
+	return p.formatFreeRanges()
+}
+
+func TestPrefix_rebuildFreeRanges(t *testing.T) {
+	p := Prefix{
+		Cidr: "10.0.0.0/24",
+		Ips:  map[string]bool{"10.0.0.0": true, "10.0.0.1": true, "10.0.0.7": true, "10.0.0.255": true},
+	}
+	require.Nil(t, p.rebuildFreeRanges())
+	require.Equal(t, []string{"10.0.0.2-10.0.0.6", "10.0.0.8-10.0.0.254"}, formatRanges(t, &p))
+
+	p = Prefix{
+		Cidr: "10.0.0.0/31",
+		Ips:  map[string]bool{"10.0.0.0": true, "10.0.0.1": true},
+	}
+	require.Nil(t, p.rebuildFreeRanges())
+	require.Equal(t, []string{}, formatRanges(t, &p))
+
+	p = Prefix{
+		Cidr: "2001:db8::/64",
+		Ips:  map[string]bool{"2001:db8::": true},
+	}
+	require.Nil(t, p.rebuildFreeRanges())
+	require.Equal(t, []string{"2001:db8::1-2001:db8::ffff:ffff:ffff:ffff"}, formatRanges(t, &p))
+}
+
+func TestPrefix_takeAndAddFree(t *testing.T) {
+	p := Prefix{
+		Cidr: "10.0.0.0/28",
+		Ips:  map[string]bool{"10.0.0.0": true, "10.0.0.15": true},
+	}
+	require.Nil(t, p.rebuildFreeRanges())
+
+	take := func(s string) {
+		i, err := ipStringToInt(s)
+		require.Nil(t, err)
+		require.True(t, p.takeFree(i), "%s must be free", s)
+	}
+	take("10.0.0.5")
+	take("10.0.0.1")
+	take("10.0.0.14")
+	require.Equal(t, []string{"10.0.0.2-10.0.0.4", "10.0.0.6-10.0.0.13"}, formatRanges(t, &p))
+
+	used, err := ipStringToInt("10.0.0.5")
+	require.Nil(t, err)
+	require.False(t, p.takeFree(used))
+
+	// merges with both neighbours
+	p.addFree(used)
+	require.Equal(t, []string{"10.0.0.2-10.0.0.13"}, formatRanges(t, &p))
+	// merges with the following range
+	first, err := ipStringToInt("10.0.0.1")
+	require.Nil(t, err)
+	p.addFree(first)
+	require.Equal(t, []string{"10.0.0.1-10.0.0.13"}, formatRanges(t, &p))
+	// merges with the preceding range
+	last, err := ipStringToInt("10.0.0.14")
+	require.Nil(t, err)
+	p.addFree(last)
+	require.Equal(t, []string{"10.0.0.1-10.0.0.14"}, formatRanges(t, &p))
+	// adding a free ip does nothing
+	p.addFree(last)
+	require.Equal(t, []string{"10.0.0.1-10.0.0.14"}, formatRanges(t, &p))
+	// without neighbours
+	network, err := ipStringToInt("10.0.0.15")
+	require.Nil(t, err)
+	require.True(t, p.takeFree(first))
+	require.True(t, p.takeFree(last))
+	p.addFree(network)
+	require.Equal(t, []string{"10.0.0.2-10.0.0.13", "10.0.0.15-10.0.0.15"}, formatRanges(t, &p))
+
+	// serialization round trip
+	require.Equal(t, p.freeRanges, parseFreeRanges(p.formatFreeRanges()))
+	require.Nil(t, parseFreeRanges(nil))
+	require.Nil(t, parseFreeRanges([]string{"10.0.0.1"}))
+}
+
+func TestIpamer_AcquireIPLargePrefix(t *testing.T) {
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		p, err := ipam.NewPrefix("2001:db8:1::/64", tenantid)
+		require.Nil(t, err)
+		ip, err := ipam.AcquireIP(p.Cidr, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, "2001:db8:1::1", ip.IP.String())
+		ip, err = ipam.AcquireSpecificIP(p.Cidr, "2001:db8:1::ffff:0:1", tenantid)
+		require.Nil(t, err)
+		require.Equal(t, "2001:db8:1::ffff:0:1", ip.IP.String())
+		_, err = ipam.AcquireSpecificIP(p.Cidr, "2001:DB8:1::FFFF:0:1", tenantid)
+		require.True(t, errors.Is(err, ErrIPinUse))
+
+		p = ipam.PrefixFrom(p.Cidr, tenantid)
+		require.Equal(t, []string{"2001:db8:1::2-2001:db8:1::ffff:0:0", "2001:db8:1::ffff:0:2-2001:db8:1:0:ffff:ffff:ffff:ffff"}, formatRanges(t, p))
+		// 2^64 ips do not fit into the usage
+		require.Equal(t, uint64(math.MaxUint64), p.Usage().AvailableIPs)
+	})
+}
+
+func TestIpamer_AcquireIPModifiedIps(t *testing.T) {
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		p, err := ipam.NewPrefix("10.9.0.0/29", tenantid)
+		require.Nil(t, err)
+
+		// ips added and removed without the ipamer
+		p.Ips["10.9.0.1"] = true
+		p.Ips["10.9.0.3"] = true
+		_, err = ipam.storage.UpdatePrefix(*p, tenantid)
+		require.Nil(t, err)
+
+		ip, err := ipam.AcquireIP(p.Cidr, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, "10.9.0.2", ip.IP.String())
+		_, err = ipam.AcquireSpecificIP(p.Cidr, "10.9.0.3", tenantid)
+		require.True(t, errors.Is(err, ErrIPinUse))
+
+		p = ipam.PrefixFrom(p.Cidr, tenantid)
+		delete(p.Ips, "10.9.0.1")
+		_, err = ipam.storage.UpdatePrefix(*p, tenantid)
+		require.Nil(t, err)
+		ip, err = ipam.AcquireSpecificIP(p.Cidr, "10.9.0.1", tenantid)
+		require.Nil(t, err)
+		require.Equal(t, "10.9.0.1", ip.IP.String())
+	})
+}
+
+// legacy prefixes were stored without free ranges
+func TestIpamer_AcquireIPWithoutFreeRanges(t *testing.T) {
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		p, err := ipam.NewPrefix("10.9.1.0/29", tenantid)
+		require.Nil(t, err)
+		p.Ips["10.9.1.1"] = true
+		p.freeRanges = nil
+		_, err = ipam.storage.UpdatePrefix(*p, tenantid)
+		require.Nil(t, err)
+
+		err = ipam.ReleaseIPFromPrefix(p.Cidr, "10.9.1.1", tenantid)
+		require.Nil(t, err)
+		ip, err := ipam.AcquireIP(p.Cidr, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, "10.9.1.1", ip.IP.String())
+		p = ipam.PrefixFrom(p.Cidr, tenantid)
+		require.Equal(t, []string{"10.9.1.2-10.9.1.6"}, formatRanges(t, p))
+	})
+}
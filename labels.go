@@ -0,0 +1,206 @@
+package ipam
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// labelKey and labelValue restrict labels to characters which do not conflict with the label selector syntax.
+var (
+	labelKey   = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9._/-]*[A-Za-z0-9])?$`)
+	labelValue = regexp.MustCompile(`^([A-Za-z0-9]([A-Za-z0-9._/-]*[A-Za-z0-9])?)?$`)
+)
+
+// PrefixLabelReader can be implemented by a Storage to read the prefixes which have all of the given labels
+// without reading all prefixes of the tenant. It is used by PrefixesByLabelSelector.
+type PrefixLabelReader interface {
+	ReadPrefixesWithLabels(ctx context.Context, labels map[string]string, tenantid string) ([]Prefix, error)
+}
+
+// WithPrefixDescription sets the description of the prefix.
+func WithPrefixDescription(description string) PrefixOption {
+	return func(p *Prefix) error {
+		p.Description = description
+		return nil
+	}
+}
+
+// WithPrefixLabels sets the labels of the prefix.
+func WithPrefixLabels(labels map[string]string) PrefixOption {
+	return func(p *Prefix) error {
+		err := validateLabels(labels)
+		if err != nil {
+			return err
+		}
+		p.Labels = copyLabels(labels)
+		return nil
+	}
+}
+
+func validateLabels(labels map[string]string) error {
+	for k, v := range labels {
+		if !labelKey.MatchString(k) {
+			return fmt.Errorf("invalid label key:%q", k)
+		}
+		if !labelValue.MatchString(v) {
+			return fmt.Errorf("invalid value of label %s:%q", k, v)
+		}
+	}
+	return nil
+}
+
+func (i *ipamer) UpdatePrefixMetadata(cidr, description string, labels map[string]string, tenantid string) (*Prefix, error) {
+	return i.UpdatePrefixMetadataContext(context.Background(), cidr, description, labels, tenantid)
+}
+
+func (i *ipamer) UpdatePrefixMetadataContext(ctx context.Context, cidr, description string, labels map[string]string, tenantid string) (*Prefix, error) {
+	err := validateLabels(labels)
+	if err != nil {
+		return nil, err
+	}
+	var prefix *Prefix
+	return prefix, retryOnOptimisticLock(ctx, func() error {
+		p, err := i.readPrefix(ctx, cidr, tenantid)
+		if err != nil {
+			return err
+		}
+		if p == nil {
+			return fmt.Errorf("%w: unable to find prefix for cidr:%s", ErrNotFound, cidr)
+		}
+		p.Description = description
+		p.Labels = copyLabels(labels)
+		updated, err := i.contextStorage().UpdatePrefixContext(ctx, *p, tenantid)
+		if err != nil {
+			return errors.Wrapf(err, "unable to update metadata of prefix:%s", cidr)
+		}
+		prefix = &updated
+		return nil
+	})
+}
+
+func (i *ipamer) PrefixesByLabelSelector(selector string, tenantid string) ([]Prefix, error) {
+	return i.PrefixesByLabelSelectorContext(context.Background(), selector, tenantid)
+}
+
+func (i *ipamer) PrefixesByLabelSelectorContext(ctx context.Context, selector string, tenantid string) ([]Prefix, error) {
+	s, err := parseLabelSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	var prefixes []Prefix
+	reader, ok := i.storage.(PrefixLabelReader)
+	if ok && len(s.equalities()) > 0 {
+		prefixes, err = reader.ReadPrefixesWithLabels(ctx, s.equalities(), tenantid)
+	} else {
+		prefixes, err = i.contextStorage().ReadAllPrefixesContext(ctx, tenantid)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read prefixes:%v", err)
+	}
+	result := []Prefix{}
+	for _, p := range prefixes {
+		if s.matches(p.Labels) {
+			result = append(result, p)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Cidr < result[j].Cidr
+	})
+	return result, nil
+}
+
+type labelOperator int
+
+const (
+	labelEquals labelOperator = iota
+	labelNotEquals
+	labelExists
+	labelNotExists
+)
+
+type labelRequirement struct {
+	key      string
+	operator labelOperator
+	value    string
+}
+
+// labelSelector selects labels which fulfill all of its requirements.
+type labelSelector []labelRequirement
+
+// parseLabelSelector parses a comma separated list of requirements,
+// each is one of key=value, key==value, key!=value, key or !key.
+// An empty selector selects everything.
+func parseLabelSelector(selector string) (labelSelector, error) {
+	var result labelSelector
+	if strings.TrimSpace(selector) == "" {
+		return result, nil
+	}
+	for _, term := range strings.Split(selector, ",") {
+		term = strings.TrimSpace(term)
+		var r labelRequirement
+		switch {
+		case strings.Contains(term, "!="):
+			parts := strings.SplitN(term, "!=", 2)
+			r = labelRequirement{key: parts[0], operator: labelNotEquals, value: parts[1]}
+		case strings.Contains(term, "=="):
+			parts := strings.SplitN(term, "==", 2)
+			r = labelRequirement{key: parts[0], operator: labelEquals, value: parts[1]}
+		case strings.Contains(term, "="):
+			parts := strings.SplitN(term, "=", 2)
+			r = labelRequirement{key: parts[0], operator: labelEquals, value: parts[1]}
+		case strings.HasPrefix(term, "!"):
+			r = labelRequirement{key: strings.TrimPrefix(term, "!"), operator: labelNotExists}
+		default:
+			r = labelRequirement{key: term, operator: labelExists}
+		}
+		r.key = strings.TrimSpace(r.key)
+		r.value = strings.TrimSpace(r.value)
+		if !labelKey.MatchString(r.key) || !labelValue.MatchString(r.value) {
+			return nil, fmt.Errorf("invalid label selector:%q", selector)
+		}
+		result = append(result, r)
+	}
+	return result, nil
+}
+
+// matches returns true if the labels fulfill all requirements of the selector.
+func (s labelSelector) matches(labels map[string]string) bool {
+	for _, r := range s {
+		value, ok := labels[r.key]
+		switch r.operator {
+		case labelEquals:
+			if !ok || value != r.value {
+				return false
+			}
+		case labelNotEquals:
+			if ok && value == r.value {
+				return false
+			}
+		case labelExists:
+			if !ok {
+				return false
+			}
+		case labelNotExists:
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// equalities returns the labels which must be equal to fulfill the selector.
+func (s labelSelector) equalities() map[string]string {
+	result := make(map[string]string)
+	for _, r := range s {
+		if r.operator == labelEquals {
+			result[r.key] = r.value
+		}
+	}
+	return result
+}
@@ -0,0 +1,108 @@
+package ipam
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIpamer_PrefixesByLabelSelector(t *testing.T) {
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		_, err := ipam.NewPrefix("10.50.0.0/24", tenantid, WithPrefixDescription("fra1 management"), WithPrefixLabels(map[string]string{"site": "fra1", "role": "mgmt"}))
+		require.Nil(t, err)
+		_, err = ipam.NewPrefix("10.50.1.0/24", tenantid, WithPrefixLabels(map[string]string{"site": "fra1", "role": "storage"}))
+		require.Nil(t, err)
+		_, err = ipam.NewPrefix("10.50.2.0/24", tenantid, WithPrefixLabels(map[string]string{"site": "ams1", "role": "mgmt", "legacy": ""}))
+		require.Nil(t, err)
+		_, err = ipam.NewPrefix("10.50.3.0/24", tenantid)
+		require.Nil(t, err)
+
+		p := ipam.PrefixFrom("10.50.0.0/24", tenantid)
+		require.Equal(t, "fra1 management", p.Description)
+		require.Equal(t, map[string]string{"site": "fra1", "role": "mgmt"}, p.Labels)
+
+		tests := []struct {
+			selector string
+			want     []string
+		}{
+			{selector: "site=fra1,role=mgmt", want: []string{"10.50.0.0/24"}},
+			{selector: "site==fra1", want: []string{"10.50.0.0/24", "10.50.1.0/24"}},
+			{selector: "role=mgmt", want: []string{"10.50.0.0/24", "10.50.2.0/24"}},
+			{selector: "site!=fra1", want: []string{"10.50.2.0/24", "10.50.3.0/24"}},
+			{selector: "site, !legacy", want: []string{"10.50.0.0/24", "10.50.1.0/24"}},
+			{selector: "legacy=", want: []string{"10.50.2.0/24"}},
+			{selector: "site=fra1,role!=mgmt", want: []string{"10.50.1.0/24"}},
+			{selector: "site=nyc1", want: []string{}},
+			{selector: "", want: []string{"10.50.0.0/24", "10.50.1.0/24", "10.50.2.0/24", "10.50.3.0/24"}},
+		}
+		for _, tt := range tests {
+			prefixes, err := ipam.PrefixesByLabelSelector(tt.selector, tenantid)
+			require.Nil(t, err, tt.selector)
+			cidrs := []string{}
+			for _, p := range prefixes {
+				cidrs = append(cidrs, p.Cidr)
+			}
+			require.Equal(t, tt.want, cidrs, tt.selector)
+		}
+
+		_, err = ipam.PrefixesByLabelSelector("site=fra1,=mgmt", tenantid)
+		require.EqualError(t, err, `invalid label selector:"site=fra1,=mgmt"`)
+	})
+}
+
+func TestIpamer_UpdatePrefixMetadata(t *testing.T) {
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		p, err := ipam.NewPrefix("10.51.0.0/24", tenantid, WithPrefixLabels(map[string]string{"site": "fra1"}))
+		require.Nil(t, err)
+		ip, err := ipam.AcquireIP(p.Cidr, tenantid)
+		require.Nil(t, err)
+
+		p, err = ipam.UpdatePrefixMetadata(p.Cidr, "moved", map[string]string{"site": "ams1"}, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, "moved", p.Description)
+
+		p = ipam.PrefixFrom(p.Cidr, tenantid)
+		require.Equal(t, "moved", p.Description)
+		require.Equal(t, map[string]string{"site": "ams1"}, p.Labels)
+		require.Equal(t, map[string]bool{ip.IP.String(): true}, p.Ips)
+
+		prefixes, err := ipam.PrefixesByLabelSelector("site=fra1", tenantid)
+		require.Nil(t, err)
+		require.Empty(t, prefixes)
+		prefixes, err = ipam.PrefixesByLabelSelector("site=ams1", tenantid)
+		require.Nil(t, err)
+		require.Len(t, prefixes, 1)
+		require.Equal(t, map[string]bool{ip.IP.String(): true}, prefixes[0].Ips)
+
+		_, err = ipam.UpdatePrefixMetadata(p.Cidr, "", map[string]string{"site": "a b"}, tenantid)
+		require.EqualError(t, err, `invalid value of label site:"a b"`)
+		_, err = ipam.UpdatePrefixMetadata("10.52.0.0/24", "", nil, tenantid)
+		require.True(t, errors.Is(err, ErrNotFound))
+	})
+}
+
+func Test_sql_ReadPrefixesWithLabels(t *testing.T) {
+	ctx := context.Background()
+	testWithSQLBackends(t, func(t *testing.T, db *sql) {
+		ipam := &ipamer{}
+		p, err := ipam.newPrefix("10.53.0.0/24", WithPrefixLabels(map[string]string{"site": "fra1", "role": "mgmt"}))
+		require.Nil(t, err)
+		_, err = db.CreatePrefix(*p, tenantid)
+		require.Nil(t, err)
+		p, err = ipam.newPrefix("10.53.1.0/24", WithPrefixLabels(map[string]string{"site": "fra1"}))
+		require.Nil(t, err)
+		_, err = db.CreatePrefix(*p, tenantid)
+		require.Nil(t, err)
+
+		prefixes, err := db.ReadPrefixesWithLabels(ctx, map[string]string{"site": "fra1", "role": "mgmt"}, tenantid)
+		require.Nil(t, err)
+		require.Len(t, prefixes, 1)
+		require.Equal(t, "10.53.0.0/24", prefixes[0].Cidr)
+
+		prefixes, err = db.ReadPrefixesWithLabels(ctx, map[string]string{"site": "fra1"}, "other")
+		require.Nil(t, err)
+		require.Empty(t, prefixes)
+	})
+}
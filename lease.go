@@ -0,0 +1,186 @@
+package ipam
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// WithLease acquires the ip for the given duration, the lease can be extended with RenewLease.
+// After the lease expired the ip is released by ReleaseExpiredLeases or on the next acquisition from the prefix.
+func WithLease(ttl time.Duration) AcquireOption {
+	return func(o *acquireOptions) {
+		o.lease = ttl
+	}
+}
+
+// now returns the current time, it can be replaced in tests.
+func (i *ipamer) now() time.Time {
+	if i.clock != nil {
+		return i.clock()
+	}
+	return time.Now()
+}
+
+// leaseExpiry returns the expiry of a lease with the given duration,
+// it is truncated to microseconds which is the precision of timestamps in postgres.
+func leaseExpiry(now time.Time, ttl time.Duration) (time.Time, error) {
+	if ttl <= 0 {
+		return time.Time{}, fmt.Errorf("lease duration:%s must be positive", ttl)
+	}
+	return now.Add(ttl).UTC().Truncate(time.Microsecond), nil
+}
+
+// setLease stores the expiry of the leased ip.
+func (p *Prefix) setLease(ip string, expires time.Time) {
+	if p.leases == nil {
+		p.leases = make(map[string]time.Time)
+	}
+	p.leases[ip] = expires
+}
+
+// expireLeases releases the ips whose lease expired before now and returns them.
+func (p *Prefix) expireLeases(now time.Time) ([]IP, error) {
+	var expired []IP
+	for ip, expires := range p.leases {
+		if expires.After(now) {
+			continue
+		}
+		if _, ok := p.Ips[ip]; ok {
+			expired = append(expired, p.ip(ip))
+		}
+		err := p.release(ip, now)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return expired, nil
+}
+
+func (i *ipamer) RenewLease(prefixCidr, ip string, ttl time.Duration, tenantid string) (*IP, error) {
+	return i.RenewLeaseContext(context.Background(), prefixCidr, ip, ttl, tenantid)
+}
+
+func (i *ipamer) RenewLeaseContext(ctx context.Context, prefixCidr, ip string, ttl time.Duration, tenantid string) (*IP, error) {
+	var result *IP
+	return result, retryOnOptimisticLock(ctx, func() error {
+		var err error
+		result, err = i.renewLeaseInternal(ctx, prefixCidr, ip, ttl, tenantid)
+		return err
+	})
+}
+
+func (i *ipamer) renewLeaseInternal(ctx context.Context, prefixCidr, ip string, ttl time.Duration, tenantid string) (*IP, error) {
+	now := i.now()
+	expires, err := leaseExpiry(now, ttl)
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := i.readPrefix(ctx, prefixCidr, tenantid)
+	if err != nil {
+		return nil, err
+	}
+	if prefix == nil {
+		return nil, fmt.Errorf("%w: unable to find prefix for cidr:%s", ErrNotFound, prefixCidr)
+	}
+	if _, ok := prefix.Ips[ip]; !ok {
+		return nil, fmt.Errorf("%w: ip:%s is not allocated in prefix:%s", ErrNotFound, ip, prefixCidr)
+	}
+	current, ok := prefix.leases[ip]
+	if !ok {
+		return nil, fmt.Errorf("ip:%s of prefix:%s is not leased", ip, prefixCidr)
+	}
+	if !current.After(now) {
+		return nil, fmt.Errorf("%w: lease of ip:%s in prefix:%s has expired", ErrNotFound, ip, prefixCidr)
+	}
+	prefix.setLease(ip, expires)
+	_, err = i.contextStorage().UpdatePrefixContext(ctx, *prefix, tenantid)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to renew lease of ip:%s", ip)
+	}
+	result := prefix.ip(ip)
+	return &result, nil
+}
+
+func (i *ipamer) ReleaseExpiredLeases(tenantid string) ([]IP, error) {
+	return i.ReleaseExpiredLeasesContext(context.Background(), tenantid)
+}
+
+func (i *ipamer) ReleaseExpiredLeasesContext(ctx context.Context, tenantid string) ([]IP, error) {
+	prefixes, err := i.contextStorage().ReadAllPrefixesContext(ctx, tenantid)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read prefixes:%v", err)
+	}
+	now := i.now()
+	result := []IP{}
+	for _, p := range prefixes {
+		expired, err := p.DeepCopy().expireLeases(now)
+		if err != nil {
+			return nil, err
+		}
+		if len(expired) == 0 {
+			continue
+		}
+		err = retryOnOptimisticLock(ctx, func() error {
+			expired, err = i.releaseExpiredLeasesInternal(ctx, p.Cidr, now, tenantid)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, expired...)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].ParentPrefix != result[j].ParentPrefix {
+			return result[i].ParentPrefix < result[j].ParentPrefix
+		}
+		a, _ := ipToInt(result[i].IP)
+		b, _ := ipToInt(result[j].IP)
+		return a.Cmp(b) < 0
+	})
+	return result, nil
+}
+
+func (i *ipamer) releaseExpiredLeasesInternal(ctx context.Context, prefixCidr string, now time.Time, tenantid string) ([]IP, error) {
+	prefix, err := i.readPrefix(ctx, prefixCidr, tenantid)
+	if err != nil {
+		return nil, err
+	}
+	if prefix == nil {
+		// the prefix was deleted in the meantime
+		return nil, nil
+	}
+	expired, err := prefix.expireLeases(now)
+	if err != nil {
+		return nil, err
+	}
+	if len(expired) == 0 {
+		return nil, nil
+	}
+	_, err = i.contextStorage().UpdatePrefixContext(ctx, *prefix, tenantid)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to release expired leases of prefix:%s", prefixCidr)
+	}
+	return expired, nil
+}
+
+// RunLeaseReaper calls ReleaseExpiredLeases for the tenant every interval until the context is done.
+// Errors are passed to onError which may be nil.
+func (i *ipamer) RunLeaseReaper(ctx context.Context, interval time.Duration, tenantid string, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, err := i.ReleaseExpiredLeasesContext(ctx, tenantid)
+			if err != nil && onError != nil && ctx.Err() == nil {
+				onError(err)
+			}
+		}
+	}
+}
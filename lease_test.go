@@ -0,0 +1,143 @@
+package ipam
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIpamer_AcquireIPWithLease(t *testing.T) {
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+		ipam.clock = func() time.Time { return now }
+
+		p, err := ipam.NewPrefix("10.60.0.0/30", tenantid, WithReservedIPs())
+		require.Nil(t, err)
+		ip1, err := ipam.AcquireIP(p.Cidr, tenantid, WithLease(time.Minute))
+		require.Nil(t, err)
+		require.Equal(t, now.Add(time.Minute), ip1.Expires)
+		ip2, err := ipam.AcquireSpecificIP(p.Cidr, "10.60.0.2", tenantid, WithLease(time.Hour), WithMetadata(IPMetadata{Owner: "runner-1"}))
+		require.Nil(t, err)
+		ip3, err := ipam.AcquireIP(p.Cidr, tenantid)
+		require.Nil(t, err)
+		require.True(t, ip3.Expires.IsZero())
+
+		ip, err := ipam.IPFrom(p.Cidr, ip2.IP.String(), tenantid)
+		require.Nil(t, err)
+		require.Equal(t, now.Add(time.Hour), ip.Expires)
+
+		now = now.Add(30 * time.Second)
+		ip, err = ipam.RenewLease(p.Cidr, ip1.IP.String(), 2*time.Minute, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, now.Add(2*time.Minute), ip.Expires)
+		_, err = ipam.RenewLease(p.Cidr, ip3.IP.String(), time.Minute, tenantid)
+		require.EqualError(t, err, "ip:10.60.0.1 of prefix:10.60.0.0/30 is not leased")
+
+		// the renewed lease outlives the original one
+		now = now.Add(time.Minute)
+		ip, err = ipam.IPFrom(p.Cidr, ip1.IP.String(), tenantid)
+		require.Nil(t, err)
+		require.Equal(t, ip1.IP.String(), ip.IP.String())
+
+		// the expired lease is released lazily on the next acquisition
+		now = now.Add(2 * time.Minute)
+		_, err = ipam.RenewLease(p.Cidr, ip1.IP.String(), time.Minute, tenantid)
+		require.True(t, errors.Is(err, ErrNotFound))
+		ip, err = ipam.AcquireIP(p.Cidr, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, ip1.IP.String(), ip.IP.String())
+		require.True(t, ip.Expires.IsZero())
+		ip, err = ipam.AcquireIP(p.Cidr, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, "10.60.0.3", ip.IP.String())
+
+		// a released lease is gone
+		err = ipam.ReleaseIPFromPrefix(p.Cidr, ip2.IP.String(), tenantid)
+		require.Nil(t, err)
+		ip, err = ipam.AcquireSpecificIP(p.Cidr, ip2.IP.String(), tenantid)
+		require.Nil(t, err)
+		require.True(t, ip.Expires.IsZero())
+		require.Empty(t, ipam.PrefixFrom(p.Cidr, tenantid).leases)
+
+		_, err = ipam.AcquireIP(p.Cidr, tenantid, WithLease(-time.Second))
+		require.EqualError(t, err, "lease duration:-1s must be positive")
+	})
+}
+
+func TestIpamer_ReleaseExpiredLeases(t *testing.T) {
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+		ipam.clock = func() time.Time { return now }
+
+		p1, err := ipam.NewPrefix("10.61.0.0/24", tenantid)
+		require.Nil(t, err)
+		p2, err := ipam.NewPrefix("10.62.0.0/24", tenantid)
+		require.Nil(t, err)
+		for _, cidr := range []string{p2.Cidr, p1.Cidr} {
+			_, err = ipam.AcquireIP(cidr, tenantid, WithLease(time.Minute))
+			require.Nil(t, err)
+			_, err = ipam.AcquireIP(cidr, tenantid, WithLease(time.Hour))
+			require.Nil(t, err)
+			_, err = ipam.AcquireIP(cidr, tenantid)
+			require.Nil(t, err)
+		}
+
+		released, err := ipam.ReleaseExpiredLeases(tenantid)
+		require.Nil(t, err)
+		require.Empty(t, released)
+
+		now = now.Add(10 * time.Minute)
+		released, err = ipam.ReleaseExpiredLeases(tenantid)
+		require.Nil(t, err)
+		require.Len(t, released, 2)
+		require.Equal(t, "10.61.0.1", released[0].IP.String())
+		require.Equal(t, p1.Cidr, released[0].ParentPrefix)
+		require.Equal(t, "10.62.0.1", released[1].IP.String())
+		require.Equal(t, map[string]bool{"10.61.0.2": true, "10.61.0.3": true}, ipam.PrefixFrom(p1.Cidr, tenantid).Ips)
+
+		now = now.Add(time.Hour)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			ipam.RunLeaseReaper(ctx, time.Millisecond, tenantid, func(err error) {
+				t.Errorf("unexpected error:%v", err)
+			})
+			close(done)
+		}()
+		require.Eventually(t, func() bool {
+			return len(ipam.PrefixFrom(p2.Cidr, tenantid).Ips) == 1
+		}, 5*time.Second, 5*time.Millisecond)
+		cancel()
+		<-done
+		require.Equal(t, map[string]bool{"10.61.0.3": true}, ipam.PrefixFrom(p1.Cidr, tenantid).Ips)
+	})
+}
+
+func Test_sql_Leases(t *testing.T) {
+	testWithSQLBackends(t, func(t *testing.T, db *sql) {
+		expires := time.Date(2020, 1, 1, 12, 0, 0, 123456000, time.UTC)
+		ipam := &ipamer{}
+		p, err := ipam.newPrefix("10.63.0.0/24")
+		require.Nil(t, err)
+		created, err := db.CreatePrefix(*p, tenantid)
+		require.Nil(t, err)
+		created.Ips["10.63.0.1"] = true
+		created.setLease("10.63.0.1", expires)
+		_, err = db.UpdatePrefix(created, tenantid)
+		require.Nil(t, err)
+
+		read, err := db.ReadPrefix(p.Cidr, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, map[string]time.Time{"10.63.0.1": expires}, read.leases)
+
+		read.setLease("10.63.0.1", expires.Add(time.Hour))
+		_, err = db.UpdatePrefix(read, tenantid)
+		require.Nil(t, err)
+		read, err = db.ReadPrefix(p.Cidr, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, map[string]time.Time{"10.63.0.1": expires.Add(time.Hour)}, read.leases)
+	})
+}
@@ -1,6 +1,7 @@
 package ipam
 
 import (
+	"context"
 	"fmt"
 	"sync"
 
@@ -8,68 +9,118 @@ import (
 )
 
 type memory struct {
-	prefixes map[string]Prefix
+	prefixes map[string]map[string]Prefix // prefixes by tenantid and cidr
 	lock     sync.RWMutex
 }
 
 // NewMemory create a memory storage for ipam
 func NewMemory() *memory {
-	prefixes := make(map[string]Prefix)
+	prefixes := make(map[string]map[string]Prefix)
 	return &memory{
 		prefixes: prefixes,
 		lock:     sync.RWMutex{},
 	}
 }
 
-func (m *memory) CreatePrefix(prefix Prefix) (Prefix, error) {
+func (m *memory) CreatePrefix(prefix Prefix, tenantid string) (Prefix, error) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	_, ok := m.prefixes[prefix.Cidr]
+	tenantPrefixes, ok := m.prefixes[tenantid]
+	if !ok {
+		tenantPrefixes = make(map[string]Prefix)
+		m.prefixes[tenantid] = tenantPrefixes
+	}
+	_, ok = tenantPrefixes[prefix.Cidr]
 	if ok {
 		return Prefix{}, fmt.Errorf("prefix already created:%v", prefix)
 	}
-	m.prefixes[prefix.Cidr] = *prefix.DeepCopy()
+	prefix.version = int64(0)
+	tenantPrefixes[prefix.Cidr] = *prefix.DeepCopy()
 	return prefix, nil
 }
-func (m *memory) ReadPrefix(prefix string) (Prefix, error) {
+func (m *memory) ReadPrefix(prefix string, tenantid string) (Prefix, error) {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 
-	result, ok := m.prefixes[prefix]
+	result, ok := m.prefixes[tenantid][prefix]
 	if !ok {
 		return Prefix{}, errors.Errorf("Prefix %s not found", prefix)
 	}
 	return *result.DeepCopy(), nil
 }
-func (m *memory) ReadAllPrefixes() ([]Prefix, error) {
+func (m *memory) ReadAllPrefixes(tenantid string) ([]Prefix, error) {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 
-	ps := make([]Prefix, 0, len(m.prefixes))
-	for _, v := range m.prefixes {
+	tenantPrefixes := m.prefixes[tenantid]
+	ps := make([]Prefix, 0, len(tenantPrefixes))
+	for _, v := range tenantPrefixes {
 		ps = append(ps, *v.DeepCopy())
 	}
 	return ps, nil
 }
-func (m *memory) UpdatePrefix(prefix Prefix) (Prefix, error) {
+
+// UpdatePrefix tries to update the prefix.
+// Returns OptimisticLockError if it does not succeed due to a concurrent update.
+func (m *memory) UpdatePrefix(prefix Prefix, tenantid string) (Prefix, error) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
 	if prefix.Cidr == "" {
 		return Prefix{}, fmt.Errorf("prefix not present:%v", prefix)
 	}
-	_, ok := m.prefixes[prefix.Cidr]
+	oldPrefix, ok := m.prefixes[tenantid][prefix.Cidr]
 	if !ok {
 		return Prefix{}, fmt.Errorf("prefix not found:%s", prefix.Cidr)
 	}
-	m.prefixes[prefix.Cidr] = *prefix.DeepCopy()
+	if oldPrefix.version != prefix.version {
+		return Prefix{}, newOptimisticLockError(fmt.Sprintf("prefix %s has version %d, expected %d", prefix.Cidr, oldPrefix.version, prefix.version))
+	}
+	prefix.version = oldPrefix.version + 1
+	m.prefixes[tenantid][prefix.Cidr] = *prefix.DeepCopy()
 	return prefix, nil
 }
-func (m *memory) DeletePrefix(prefix Prefix) (Prefix, error) {
+func (m *memory) DeletePrefix(prefix Prefix, tenantid string) (Prefix, error) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	delete(m.prefixes, prefix.Cidr)
+	delete(m.prefixes[tenantid], prefix.Cidr)
 	return *prefix.DeepCopy(), nil
 }
+
+// ApplyChanges applies the changes of a transaction under a single lock.
+func (m *memory) ApplyChanges(_ context.Context, changes []PrefixChange) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, c := range changes {
+		var stored *Prefix
+		if existing, ok := m.prefixes[c.Tenantid][c.Prefix.Cidr]; ok {
+			stored = &existing
+		}
+		err := c.Conflict(stored)
+		if err != nil {
+			return err
+		}
+	}
+	for _, c := range changes {
+		tenantPrefixes, ok := m.prefixes[c.Tenantid]
+		if !ok {
+			tenantPrefixes = make(map[string]Prefix)
+			m.prefixes[c.Tenantid] = tenantPrefixes
+		}
+		prefix := *c.Prefix.DeepCopy()
+		switch c.Op {
+		case ChangeCreate:
+			prefix.version = int64(0)
+			tenantPrefixes[prefix.Cidr] = prefix
+		case ChangeUpdate:
+			prefix.version++
+			tenantPrefixes[prefix.Cidr] = prefix
+		case ChangeDelete:
+			delete(tenantPrefixes, prefix.Cidr)
+		}
+	}
+	return nil
+}
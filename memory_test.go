@@ -1,10 +1,12 @@
 package ipam
 
-/*
 import (
 	"fmt"
+	"strings"
+	"sync"
 	"testing"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -12,70 +14,107 @@ func Test_ReadPrefix(t *testing.T) {
 	m := NewMemory()
 
 	// Prefix
-	p, err := m.ReadPrefix("12.0.0.0/8")
+	p, err := m.ReadPrefix("12.0.0.0/8", tenantid)
 	require.NotNil(t, err)
 	require.Equal(t, "Prefix 12.0.0.0/8 not found", err.Error())
 	require.Empty(t, p)
 
 	prefix := Prefix{Cidr: "12.0.0.0/16"}
-	p, err = m.CreatePrefix(prefix)
+	p, err = m.CreatePrefix(prefix, tenantid)
 	require.Nil(t, err)
 	require.NotNil(t, p)
 
-	p, err = m.ReadPrefix("12.0.0.0/16")
+	p, err = m.ReadPrefix("12.0.0.0/16", tenantid)
 	require.Nil(t, err)
 	require.NotNil(t, p)
 	require.Equal(t, "12.0.0.0/16", p.Cidr)
+
+	// Prefix of other tenant
+	p, err = m.ReadPrefix("12.0.0.0/16", "othertenant")
+	require.NotNil(t, err)
+	require.Equal(t, "Prefix 12.0.0.0/16 not found", err.Error())
+	require.Empty(t, p)
 }
 
 func Test_UpdatePrefix(t *testing.T) {
 	m := NewMemory()
 
 	prefix := Prefix{}
-	p, err := m.UpdatePrefix(prefix)
+	p, err := m.UpdatePrefix(prefix, tenantid)
 	require.NotNil(t, err)
 	require.Empty(t, p)
-	require.Equal(t, "prefix not present:{  map[] 0 map[] 0}", err.Error())
+	require.True(t, strings.HasPrefix(err.Error(), "prefix not present:"), err.Error())
 
 	prefix.Cidr = "1.2.3.4/24"
-	p, err = m.UpdatePrefix(prefix)
+	p, err = m.UpdatePrefix(prefix, tenantid)
 	require.NotNil(t, err)
 	require.Empty(t, p)
 	require.Equal(t, "prefix not found:1.2.3.4/24", err.Error())
 }
 
+func Test_UpdatePrefix_OptimisticLock(t *testing.T) {
+	m := NewMemory()
+
+	prefix := Prefix{Cidr: "13.0.0.0/16"}
+	_, err := m.CreatePrefix(prefix, tenantid)
+	require.Nil(t, err)
+
+	p1, err := m.ReadPrefix(prefix.Cidr, tenantid)
+	require.Nil(t, err)
+	p2, err := m.ReadPrefix(prefix.Cidr, tenantid)
+	require.Nil(t, err)
+
+	p1.ParentCidr = "13.0.0.0/8"
+	_, err = m.UpdatePrefix(p1, tenantid)
+	require.Nil(t, err)
+
+	// p2 was read before p1 was updated
+	p2.ParentCidr = "13.0.0.0/12"
+	_, err = m.UpdatePrefix(p2, tenantid)
+	require.NotNil(t, err)
+	_, isOptimisticLock := errors.Cause(err).(OptimisticLockError)
+	require.True(t, isOptimisticLock, "error must be of type OptimisticLockError")
+
+	p, err := m.ReadPrefix(prefix.Cidr, tenantid)
+	require.Nil(t, err)
+	require.Equal(t, "13.0.0.0/8", p.ParentCidr)
+}
+
 // ensure that locks on memory storage work
 func Test_UpdatePrefix_Concurrent(t *testing.T) {
 	m := NewMemory()
 
+	var wg sync.WaitGroup
 	for i := 0; i < 50000; i++ {
-
+		wg.Add(1)
 		go func(run int) {
+			defer wg.Done()
 			prefix := Prefix{}
 			cidr := calcPrefix24(run) + "/24"
 			prefix.Cidr = cidr
 
-			p, err := m.CreatePrefix(prefix)
+			p, err := m.CreatePrefix(prefix, tenantid)
 			require.Nil(t, err)
 			require.NotNil(t, p)
 
-			p, err = m.ReadPrefix(cidr)
+			p, err = m.ReadPrefix(cidr, tenantid)
 			require.Nil(t, err)
 			require.NotNil(t, p)
 
-			p, err = m.UpdatePrefix(p)
+			p, err = m.UpdatePrefix(p, tenantid)
 			require.Nil(t, err)
 			require.NotNil(t, p)
 
-			p, err = m.ReadPrefix(cidr)
+			p, err = m.ReadPrefix(cidr, tenantid)
 			require.Nil(t, err)
 			require.NotNil(t, p)
 
-			p, err = m.DeletePrefix(p)
+			p, err = m.DeletePrefix(p, tenantid)
 			require.Nil(t, err)
 			require.NotNil(t, p)
 		}(i)
 	}
+	wg.Wait()
 }
 
 // calcs distinct /24 prefix for given test run
@@ -86,5 +125,3 @@ func calcPrefix24(run int) string {
 
 	return fmt.Sprintf("%d.%d.%d.0", i1, i2, i3)
 }
- */
-
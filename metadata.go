@@ -0,0 +1,196 @@
+package ipam
+
+import (
+	"context"
+	dbsql "database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// IPMetadata describes who uses an acquired ip.
+type IPMetadata struct {
+	Owner       string            `json:",omitempty"` // the id of the owner, e.g. a machine or a network interface
+	Hostname    string            `json:",omitempty"`
+	MAC         string            `json:",omitempty"`
+	Description string            `json:",omitempty"`
+	Labels      map[string]string `json:",omitempty"` // free-form labels
+}
+
+// IPOwnerReader can be implemented by a Storage to read the acquired ips of an owner
+// without reading all prefixes of the tenant. It is used by IPsByOwner.
+type IPOwnerReader interface {
+	ReadIPsByOwner(ctx context.Context, owner string, tenantid string) ([]IP, error)
+}
+
+// WithMetadata stores the given metadata with the acquired ip.
+func WithMetadata(metadata IPMetadata) AcquireOption {
+	return func(o *acquireOptions) {
+		o.metadata = metadata
+	}
+}
+
+func (m IPMetadata) empty() bool {
+	return m.Owner == "" && m.Hostname == "" && m.MAC == "" && m.Description == "" && len(m.Labels) == 0
+}
+
+// normalize validates the metadata and returns it with the MAC in its canonical form.
+func (m IPMetadata) normalize() (IPMetadata, error) {
+	if m.MAC != "" {
+		mac, err := net.ParseMAC(m.MAC)
+		if err != nil {
+			return IPMetadata{}, fmt.Errorf("given mac:%s is not valid", m.MAC)
+		}
+		m.MAC = mac.String()
+	}
+	if len(m.Labels) == 0 {
+		m.Labels = nil
+	}
+	m.Labels = copyLabels(m.Labels)
+	return m, nil
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	if labels == nil {
+		return nil
+	}
+	result := make(map[string]string, len(labels))
+	for k, v := range labels {
+		result[k] = v
+	}
+	return result
+}
+
+func copyMetadata(m map[string]IPMetadata) map[string]IPMetadata {
+	if m == nil {
+		return nil
+	}
+	result := make(map[string]IPMetadata, len(m))
+	for ip, metadata := range m {
+		metadata.Labels = copyLabels(metadata.Labels)
+		result[ip] = metadata
+	}
+	return result
+}
+
+// setMetadata stores the metadata of the ip, empty metadata removes it.
+func (p *Prefix) setMetadata(ip string, metadata IPMetadata) {
+	if metadata.empty() {
+		delete(p.metadata, ip)
+		return
+	}
+	if p.metadata == nil {
+		p.metadata = make(map[string]IPMetadata)
+	}
+	p.metadata[ip] = metadata
+}
+
+// ip returns the acquired ip with its metadata and the expiry of its lease.
+func (p *Prefix) ip(ip string) IP {
+	metadata := p.metadata[ip]
+	metadata.Labels = copyLabels(metadata.Labels)
+	return IP{
+		IP:           net.ParseIP(ip),
+		ParentPrefix: p.Cidr,
+		Metadata:     metadata,
+		Expires:      p.leases[ip],
+	}
+}
+
+func (i *ipamer) IPFrom(prefixCidr, ip string, tenantid string) (*IP, error) {
+	return i.IPFromContext(context.Background(), prefixCidr, ip, tenantid)
+}
+
+func (i *ipamer) IPFromContext(ctx context.Context, prefixCidr, ip string, tenantid string) (*IP, error) {
+	prefix, err := i.readPrefix(ctx, prefixCidr, tenantid)
+	if err != nil {
+		return nil, err
+	}
+	if prefix == nil {
+		return nil, fmt.Errorf("%w: unable to find prefix for cidr:%s", ErrNotFound, prefixCidr)
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil, fmt.Errorf("given ip:%s in not valid", ip)
+	}
+	if _, ok := prefix.Ips[parsed.String()]; !ok {
+		return nil, fmt.Errorf("%w: ip:%s is not allocated in prefix:%s", ErrNotFound, ip, prefixCidr)
+	}
+	result := prefix.ip(parsed.String())
+	return &result, nil
+}
+
+// scanIPsByOwner reads all prefixes of the tenant and selects the acquired ips with the given owner.
+func (i *ipamer) scanIPsByOwner(ctx context.Context, owner string, tenantid string) ([]IP, error) {
+	prefixes, err := i.contextStorage().ReadAllPrefixesContext(ctx, tenantid)
+	if err != nil {
+		return nil, err
+	}
+	result := []IP{}
+	for _, p := range prefixes {
+		for ip, metadata := range p.metadata {
+			if metadata.Owner != owner {
+				continue
+			}
+			if _, ok := p.Ips[ip]; ok {
+				result = append(result, p.ip(ip))
+			}
+		}
+	}
+	return result, nil
+}
+
+func (i *ipamer) IPsByOwner(owner string, tenantid string) ([]IP, error) {
+	return i.IPsByOwnerContext(context.Background(), owner, tenantid)
+}
+
+func (i *ipamer) IPsByOwnerContext(ctx context.Context, owner string, tenantid string) ([]IP, error) {
+	if owner == "" {
+		return nil, fmt.Errorf("owner must not be empty")
+	}
+	var result []IP
+	var err error
+	if reader, ok := i.storage.(IPOwnerReader); ok {
+		result, err = reader.ReadIPsByOwner(ctx, owner, tenantid)
+	} else {
+		result, err = i.scanIPsByOwner(ctx, owner, tenantid)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read ips:%v", err)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].ParentPrefix != result[j].ParentPrefix {
+			return result[i].ParentPrefix < result[j].ParentPrefix
+		}
+		a, _ := ipToInt(result[i].IP)
+		b, _ := ipToInt(result[j].IP)
+		return a.Cmp(b) < 0
+	})
+	return result, nil
+}
+
+// marshalMetadata returns the json stored in the metadata column of the ips table, nil if there is no metadata.
+func marshalMetadata(metadata IPMetadata) (interface{}, error) {
+	if metadata.empty() {
+		return nil, nil
+	}
+	m, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal ip metadata:%v", err)
+	}
+	return string(m), nil
+}
+
+// unmarshalMetadata parses the metadata column of the ips table.
+func unmarshalMetadata(value dbsql.NullString) (IPMetadata, error) {
+	var metadata IPMetadata
+	if !value.Valid {
+		return metadata, nil
+	}
+	err := json.Unmarshal([]byte(value.String), &metadata)
+	if err != nil {
+		return IPMetadata{}, fmt.Errorf("unable to unmarshal ip metadata:%v", err)
+	}
+	return metadata, nil
+}
@@ -0,0 +1,123 @@
+package ipam
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIpamer_AcquireIPWithMetadata(t *testing.T) {
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		p1, err := ipam.NewPrefix("10.40.0.0/24", tenantid)
+		require.Nil(t, err)
+		p2, err := ipam.NewPrefix("10.41.0.0/24", tenantid)
+		require.Nil(t, err)
+
+		metadata := IPMetadata{
+			Owner:       "machine-1",
+			Hostname:    "node1.example.com",
+			MAC:         "AA-BB-CC-DD-EE-FF",
+			Description: "primary nic",
+			Labels:      map[string]string{"rack": "r1"},
+		}
+		ip1, err := ipam.AcquireIP(p1.Cidr, tenantid, WithMetadata(metadata))
+		require.Nil(t, err)
+		require.Equal(t, "aa:bb:cc:dd:ee:ff", ip1.Metadata.MAC)
+		ip2, err := ipam.AcquireSpecificIP(p2.Cidr, "10.41.0.10", tenantid, WithMetadata(IPMetadata{Owner: "machine-1"}))
+		require.Nil(t, err)
+		ip3, err := ipam.AcquireIP(p1.Cidr, tenantid, WithMetadata(IPMetadata{Owner: "machine-2"}))
+		require.Nil(t, err)
+		_, err = ipam.AcquireIP(p1.Cidr, tenantid)
+		require.Nil(t, err)
+
+		ip, err := ipam.IPFrom(p1.Cidr, ip1.IP.String(), tenantid)
+		require.Nil(t, err)
+		require.Equal(t, IPMetadata{
+			Owner:       "machine-1",
+			Hostname:    "node1.example.com",
+			MAC:         "aa:bb:cc:dd:ee:ff",
+			Description: "primary nic",
+			Labels:      map[string]string{"rack": "r1"},
+		}, ip.Metadata)
+		require.Equal(t, p1.Cidr, ip.ParentPrefix)
+
+		ips, err := ipam.IPsByOwner("machine-1", tenantid)
+		require.Nil(t, err)
+		require.Len(t, ips, 2)
+		require.Equal(t, ip1.IP.String(), ips[0].IP.String())
+		require.Equal(t, ip2.IP.String(), ips[1].IP.String())
+		require.Equal(t, p2.Cidr, ips[1].ParentPrefix)
+
+		// the metadata is removed with the ip
+		_, err = ipam.ReleaseIP(ip3, tenantid)
+		require.Nil(t, err)
+		ips, err = ipam.IPsByOwner("machine-2", tenantid)
+		require.Nil(t, err)
+		require.Empty(t, ips)
+		_, err = ipam.IPFrom(p1.Cidr, ip3.IP.String(), tenantid)
+		require.True(t, errors.Is(err, ErrNotFound))
+		ip, err = ipam.AcquireSpecificIP(p1.Cidr, ip3.IP.String(), tenantid)
+		require.Nil(t, err)
+		require.Equal(t, IPMetadata{}, ip.Metadata)
+		ip, err = ipam.IPFrom(p1.Cidr, ip3.IP.String(), tenantid)
+		require.Nil(t, err)
+		require.Equal(t, IPMetadata{}, ip.Metadata)
+	})
+}
+
+func TestIpamer_AcquireIPInvalidMetadata(t *testing.T) {
+	ipam := New()
+	p, err := ipam.NewPrefix("10.42.0.0/24", tenantid)
+	require.Nil(t, err)
+	_, err = ipam.AcquireIP(p.Cidr, tenantid, WithMetadata(IPMetadata{MAC: "no-mac"}))
+	require.EqualError(t, err, "given mac:no-mac is not valid")
+	_, err = ipam.IPsByOwner("", tenantid)
+	require.EqualError(t, err, "owner must not be empty")
+	_, err = ipam.IPFrom("10.43.0.0/24", "10.43.0.1", tenantid)
+	require.True(t, errors.Is(err, ErrNotFound))
+}
+
+func Test_sql_IPMetadata(t *testing.T) {
+	testWithSQLBackends(t, func(t *testing.T, db *sql) {
+		ipam := NewWithStorage(db)
+		p, err := ipam.NewPrefix("10.44.0.0/24", tenantid)
+		require.Nil(t, err)
+		_, err = ipam.AcquireIP(p.Cidr, tenantid, WithMetadata(IPMetadata{Owner: "machine-1"}))
+		require.Nil(t, err)
+		_, err = ipam.AcquireIP(p.Cidr, tenantid)
+		require.Nil(t, err)
+
+		// the metadata is stored with the ip and not in the prefix json
+		var metadata []string
+		err = db.db.Select(&metadata, "SELECT COALESCE(metadata, '') FROM ips WHERE tenantid=$1 AND prefix=$2 ORDER BY ip", tenantid, p.Cidr)
+		require.Nil(t, err)
+		require.Len(t, metadata, 2)
+		require.Contains(t, metadata[0], "machine-1")
+		require.Equal(t, "", metadata[1])
+		var record string
+		err = db.db.Get(&record, "SELECT prefix FROM prefixes WHERE cidr=$1 AND tenantid=$2", p.Cidr, tenantid)
+		require.Nil(t, err)
+		require.NotContains(t, record, "machine-1")
+
+		// the ips of an owner are read with the owner index
+		ips, err := db.ReadIPsByOwner(context.Background(), "machine-1", tenantid)
+		require.Nil(t, err)
+		require.Len(t, ips, 1)
+		require.Equal(t, "10.44.0.1", ips[0].IP.String())
+		require.Equal(t, p.Cidr, ips[0].ParentPrefix)
+		if db.dialect == dialectSQLite {
+			var plan []struct {
+				ID      int    `db:"id"`
+				Parent  int    `db:"parent"`
+				NotUsed int    `db:"notused"`
+				Detail  string `db:"detail"`
+			}
+			err = db.db.Select(&plan, "EXPLAIN QUERY PLAN SELECT ip FROM ips WHERE tenantid=$1 AND owner=$2", tenantid, "machine-1")
+			require.Nil(t, err)
+			require.NotEmpty(t, plan)
+			require.Contains(t, plan[0].Detail, "ip_owner_idx")
+		}
+	})
+}
@@ -0,0 +1,314 @@
+package ipam
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ErrSchemaTooNew is returned if the database schema was migrated by a newer version of this library.
+var ErrSchemaTooNew SchemaTooNewError
+
+// SchemaTooNewError is raised if the schema version of the database is higher than the latest known migration.
+type SchemaTooNewError struct {
+}
+
+func (o SchemaTooNewError) Error() string {
+	return "SchemaTooNew"
+}
+
+// migration migrates the sql schema forward to its version.
+// schema contains the statements for every dialect, migrate is run afterwards if set.
+// Table names are given as placeholders like {prefixes}, index names are prefixed with {table_prefix}.
+type migration struct {
+	version     int
+	description string
+	schema      map[dialect]string
+	migrate     func(ctx context.Context, s *sql, tx *sqlx.Tx) error
+}
+
+const schemaMigrationsTable = `
+CREATE TABLE IF NOT EXISTS {schema_migrations} (
+	version integer NOT NULL,
+	description text NOT NULL,
+	PRIMARY KEY (version)
+);
+`
+
+// migrations must be ordered by version, released migrations must never be changed.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "create prefixes table",
+		schema: map[dialect]string{
+			dialectPostgres: `
+CREATE TABLE IF NOT EXISTS {prefixes} (
+	cidr   text NOT NULL,
+	tenantid text NOT NULL,
+	prefix JSONB,
+	PRIMARY KEY (cidr,tenantid)
+);
+
+CREATE INDEX IF NOT EXISTS {table_prefix}prefix_idx ON {prefixes} USING GIN(prefix);
+CREATE INDEX IF NOT EXISTS {table_prefix}tenant_prefix_idx ON {prefixes} (tenantid);
+`,
+			dialectSQLite: `
+CREATE TABLE IF NOT EXISTS {prefixes} (
+	cidr   text NOT NULL,
+	tenantid text NOT NULL,
+	prefix text CHECK (json_valid(prefix)),
+	PRIMARY KEY (cidr,tenantid)
+);
+
+CREATE INDEX IF NOT EXISTS {table_prefix}tenant_prefix_idx ON {prefixes} (tenantid);
+`,
+		},
+	},
+	{
+		version:     2,
+		description: "store ips and child prefixes in their own tables",
+		schema: map[dialect]string{
+			dialectPostgres: allocationTables,
+			dialectSQLite:   allocationTables,
+		},
+		migrate: func(ctx context.Context, s *sql, tx *sqlx.Tx) error {
+			return s.migrateAllocations(ctx, tx)
+		},
+	},
+	{
+		version:     3,
+		description: "store metadata of ips",
+		schema: map[dialect]string{
+			dialectPostgres: `ALTER TABLE {ips} ADD COLUMN metadata JSONB;`,
+			dialectSQLite:   `ALTER TABLE {ips} ADD COLUMN metadata text CHECK (metadata IS NULL OR json_valid(metadata));`,
+		},
+	},
+	{
+		version:     4,
+		description: "store the expiry of leased ips",
+		schema: map[dialect]string{
+			dialectPostgres: `ALTER TABLE {ips} ADD COLUMN expires TIMESTAMPTZ;`,
+			dialectSQLite:   `ALTER TABLE {ips} ADD COLUMN expires TIMESTAMP;`,
+		},
+	},
+	{
+		version:     5,
+		description: "store the parent of prefixes in their own column",
+		schema: map[dialect]string{
+			dialectPostgres: `ALTER TABLE {prefixes} ADD COLUMN parent_cidr text;`,
+			dialectSQLite:   `ALTER TABLE {prefixes} ADD COLUMN parent_cidr text;`,
+		},
+	},
+	{
+		// the column is filled in its own migration, cockroachdb can not write a column added in the same transaction
+		version:     6,
+		description: "index the parent of prefixes",
+		schema: map[dialect]string{
+			dialectPostgres: parentIndex,
+			dialectSQLite:   parentIndex,
+		},
+		migrate: func(ctx context.Context, s *sql, tx *sqlx.Tx) error {
+			return s.migrateParentCidrs(ctx, tx)
+		},
+	},
+	{
+		version:     7,
+		description: "store sticky keys in their own table and calculate free ranges from the ips",
+		schema: map[dialect]string{
+			dialectPostgres: bindingsTable,
+			dialectSQLite:   bindingsTable,
+		},
+		migrate: func(ctx context.Context, s *sql, tx *sqlx.Tx) error {
+			return s.migrateBindings(ctx, tx)
+		},
+	},
+	{
+		version:     8,
+		description: "store the owner of ips in their own column",
+		schema: map[dialect]string{
+			dialectPostgres: `ALTER TABLE {ips} ADD COLUMN owner text;`,
+			dialectSQLite:   `ALTER TABLE {ips} ADD COLUMN owner text;`,
+		},
+	},
+	{
+		version:     9,
+		description: "index the owner of ips",
+		schema: map[dialect]string{
+			dialectPostgres: ownerIndex,
+			dialectSQLite:   ownerIndex,
+		},
+		migrate: func(ctx context.Context, s *sql, tx *sqlx.Tx) error {
+			return s.migrateOwners(ctx, tx)
+		},
+	},
+	{
+		version:     10,
+		description: "store the free ranges of prefixes in their own table",
+		schema: map[dialect]string{
+			dialectPostgres: freeRangesTable,
+			dialectSQLite:   freeRangesTable,
+		},
+		migrate: func(ctx context.Context, s *sql, tx *sqlx.Tx) error {
+			return s.migrateFreeRanges(ctx, tx)
+		},
+	},
+}
+
+const allocationTables = `
+CREATE TABLE IF NOT EXISTS {ips} (
+	tenantid text NOT NULL,
+	prefix text NOT NULL,
+	ip text NOT NULL,
+	state text NOT NULL,
+	PRIMARY KEY (tenantid,prefix,ip)
+);
+
+CREATE TABLE IF NOT EXISTS {child_prefixes} (
+	tenantid text NOT NULL,
+	parent text NOT NULL,
+	cidr text NOT NULL,
+	available boolean NOT NULL,
+	PRIMARY KEY (tenantid,parent,cidr)
+);
+`
+
+const parentIndex = `CREATE INDEX IF NOT EXISTS {table_prefix}parent_prefix_idx ON {prefixes} (tenantid, parent_cidr);`
+
+const bindingsTable = `
+CREATE TABLE IF NOT EXISTS {bindings} (
+	tenantid text NOT NULL,
+	prefix text NOT NULL,
+	sticky_key text NOT NULL,
+	ip text NOT NULL,
+	PRIMARY KEY (tenantid,prefix,sticky_key)
+);
+`
+
+const ownerIndex = `CREATE INDEX IF NOT EXISTS {table_prefix}ip_owner_idx ON {ips} (tenantid, owner);`
+
+// freeRangesTable stores the free ranges of the prefixes, the expires index finds the ips
+// whose lease or quarantine ended without reading all ips of a prefix.
+const freeRangesTable = `
+CREATE TABLE IF NOT EXISTS {free_ranges} (
+	tenantid text NOT NULL,
+	prefix text NOT NULL,
+	first_ip text NOT NULL,
+	last_ip text NOT NULL,
+	PRIMARY KEY (tenantid,prefix,first_ip)
+);
+
+CREATE INDEX IF NOT EXISTS {table_prefix}ip_expires_idx ON {ips} (tenantid,prefix,expires);
+`
+
+// latestSchemaVersion is the schema version this library works with.
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// SchemaVersion returns the version of the latest migration applied to the database, 0 if none was applied.
+func (s *sql) SchemaVersion(ctx context.Context) (int, error) {
+	if s.schema != "" {
+		_, err := s.db.ExecContext(ctx, "CREATE SCHEMA IF NOT EXISTS "+s.schema)
+		if err != nil {
+			return 0, fmt.Errorf("unable to create schema %s:%v", s.schema, err)
+		}
+	}
+	_, err := s.db.ExecContext(ctx, s.q(schemaMigrationsTable))
+	if err != nil {
+		return 0, fmt.Errorf("unable to create schema_migrations table:%v", err)
+	}
+	var version int
+	err = s.db.GetContext(ctx, &version, s.q("SELECT COALESCE(MAX(version), 0) FROM {schema_migrations}"))
+	if err != nil {
+		return 0, fmt.Errorf("unable to read schema version:%v", err)
+	}
+	return version, nil
+}
+
+// Migrate applies all migrations which are not applied to the database yet, each in its own transaction.
+// It returns ErrSchemaTooNew if the database was migrated by a newer version of this library.
+// Migrate is called by the constructors of the sql storages and is safe to run concurrently.
+func (s *sql) Migrate(ctx context.Context) error {
+	return s.migrateTo(ctx, latestSchemaVersion())
+}
+
+// migrateTo applies the migrations up to the given version which are not applied to the database yet.
+func (s *sql) migrateTo(ctx context.Context, target int) error {
+	version, err := s.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if version > latestSchemaVersion() {
+		return fmt.Errorf("%w: database schema version:%d, latest supported version:%d", ErrSchemaTooNew, version, latestSchemaVersion())
+	}
+	// the row of version 0 is locked by the migrators to serialize them
+	_, err = s.db.ExecContext(ctx, s.q("INSERT INTO {schema_migrations} (version, description) VALUES (0, 'lock') ON CONFLICT DO NOTHING"))
+	if err != nil {
+		return fmt.Errorf("unable to create migration lock:%v", err)
+	}
+	for _, m := range migrations {
+		if m.version <= version || m.version > target {
+			continue
+		}
+		err = s.applyMigration(ctx, m)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyMigration applies the migration in one transaction unless it was applied concurrently.
+// The schema statements run before the data is migrated and the migration is recorded last,
+// cockroachdb refuses schema changes which follow a write in the same transaction.
+func (s *sql) applyMigration(ctx context.Context, m migration) error {
+	err := s.applyMigrationTx(ctx, m)
+	if err != nil {
+		version, verr := s.SchemaVersion(ctx)
+		if verr == nil && version >= m.version {
+			// applied by another instance whose transaction conflicted with this one
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *sql) applyMigrationTx(ctx context.Context, m migration) error {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("unable to start transaction:%v", err)
+	}
+	// sqlite serializes the transactions of the database by itself
+	if s.dialect == dialectPostgres {
+		_, err = tx.ExecContext(ctx, s.q("SELECT version FROM {schema_migrations} WHERE version=0 FOR UPDATE"))
+		if err != nil {
+			return rollback(tx, fmt.Errorf("unable to lock migrations:%v", err))
+		}
+	}
+	var version int
+	err = tx.GetContext(ctx, &version, s.q("SELECT COALESCE(MAX(version), 0) FROM {schema_migrations}"))
+	if err != nil {
+		return rollback(tx, fmt.Errorf("unable to read schema version:%v", err))
+	}
+	if version >= m.version {
+		// applied by another instance while this one waited for the lock
+		return rollback(tx, nil)
+	}
+	_, err = tx.ExecContext(ctx, s.q(m.schema[s.dialect]))
+	if err != nil {
+		return rollback(tx, fmt.Errorf("unable to apply migration %d (%s):%v", m.version, m.description, err))
+	}
+	if m.migrate != nil {
+		err = m.migrate(ctx, s, tx)
+		if err != nil {
+			return rollback(tx, fmt.Errorf("unable to apply migration %d (%s):%v", m.version, m.description, err))
+		}
+	}
+	_, err = tx.ExecContext(ctx, s.q("INSERT INTO {schema_migrations} (version, description) VALUES ($1, $2)"), m.version, m.description)
+	if err != nil {
+		return rollback(tx, fmt.Errorf("unable to record migration %d:%v", m.version, err))
+	}
+	return tx.Commit()
+}
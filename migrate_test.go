@@ -0,0 +1,194 @@
+package ipam
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/require"
+)
+
+func newSQLitePathForTest(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "go-ipam")
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	return filepath.Join(dir, "ipam.db")
+}
+
+func Test_sql_Migrate(t *testing.T) {
+	ctx := context.Background()
+	testWithSQLBackends(t, func(t *testing.T, db *sql) {
+		version, err := db.SchemaVersion(ctx)
+		require.Nil(t, err)
+		require.Equal(t, latestSchemaVersion(), version)
+
+		// migrating an up to date database does nothing
+		err = db.Migrate(ctx)
+		require.Nil(t, err)
+		version, err = db.SchemaVersion(ctx)
+		require.Nil(t, err)
+		require.Equal(t, latestSchemaVersion(), version)
+	})
+}
+
+func Test_sql_MigrateForward(t *testing.T) {
+	ctx := context.Background()
+	testWithSQLBackends(t, func(t *testing.T, db *sql) {
+		for version := 1; version < latestSchemaVersion(); version++ {
+			tablePrefix := fmt.Sprintf("forward%d_", version)
+			dropTablesForTest(t, db, tablePrefix)
+			s, err := newUnmigratedSQL(db.db, db.dialect, newSQLOptions([]SQLOption{WithTablePrefix(tablePrefix)}))
+			require.Nil(t, err)
+
+			// a prefix as stored at schema version 1 with its ips and sticky keys inside the json
+			err = s.migrateTo(ctx, 1)
+			require.Nil(t, err)
+			pj := `{"Cidr":"18.0.0.0/24","ParentCidr":"18.0.0.0/16","AvailableChildPrefixes":{},"ChildPrefixLength":0,"IPs":{"18.0.0.0":true,"18.0.0.1":true,"18.0.0.255":true},"Bindings":{"web":"18.0.0.1"},"Version":2}`
+			_, err = s.db.Exec(s.q("INSERT INTO {prefixes} (cidr, prefix, tenantid) VALUES ($1, $2, $3)"), "18.0.0.0/24", pj, tenantid)
+			require.Nil(t, err)
+
+			err = s.migrateTo(ctx, version)
+			require.Nil(t, err)
+			current, err := s.SchemaVersion(ctx)
+			require.Nil(t, err)
+			require.Equal(t, version, current)
+			owned := version >= 3 && version < 9
+			if owned {
+				// the metadata of an ip as stored before the owner had its own column
+				_, err = s.db.Exec(s.q("UPDATE {ips} SET metadata=$1 WHERE tenantid=$2 AND ip=$3"), `{"Owner":"machine-18"}`, tenantid, "18.0.0.1")
+				require.Nil(t, err)
+			}
+
+			err = s.Migrate(ctx)
+			require.Nil(t, err, "migrate from version %d", version)
+			p, err := s.ReadPrefix("18.0.0.0/24", tenantid)
+			require.Nil(t, err)
+			// the network and broadcast address stored as ips by earlier versions are reserved
+			require.Equal(t, map[string]bool{"18.0.0.1": true}, p.Ips)
+			require.Equal(t, map[string]string{"web": "18.0.0.1"}, p.bindings)
+			require.Equal(t, int64(2), p.version)
+			children, err := s.ReadChildPrefixes(ctx, "18.0.0.0/16", tenantid)
+			require.Nil(t, err)
+			require.Equal(t, []string{"18.0.0.0/24"}, prefixCidrs(children))
+			var parent string
+			err = s.db.Get(&parent, s.q("SELECT parent_cidr FROM {prefixes} WHERE cidr=$1 AND tenantid=$2"), "18.0.0.0/24", tenantid)
+			require.Nil(t, err)
+			require.Equal(t, "18.0.0.0/16", parent)
+			if owned {
+				ips, err := s.ReadIPsByOwner(ctx, "machine-18", tenantid)
+				require.Nil(t, err)
+				require.Len(t, ips, 1, "migrate from version %d", version)
+				require.Equal(t, "18.0.0.1", ips[0].IP.String())
+			}
+
+			ip, err := NewWithStorage(s).AcquireIP("18.0.0.0/24", tenantid)
+			require.Nil(t, err)
+			require.Equal(t, "18.0.0.2", ip.IP.String())
+		}
+	})
+}
+
+// dropTablesForTest drops the tables with the given prefix, the tables of the other tests are kept.
+func dropTablesForTest(t *testing.T, db *sql, tablePrefix string) {
+	for _, table := range []string{"prefixes", "ips", "child_prefixes", "bindings", "free_ranges", "schema_migrations"} {
+		_, err := db.db.Exec("DROP TABLE IF EXISTS " + tablePrefix + table)
+		require.Nil(t, err)
+	}
+}
+
+func Test_sql_Migrate_SchemaTooNew(t *testing.T) {
+	path := newSQLitePathForTest(t)
+	s, err := NewSQLiteStorage(path)
+	require.Nil(t, err)
+	_, err = s.db.Exec("INSERT INTO schema_migrations (version, description) VALUES ($1, $2)", latestSchemaVersion()+1, "from the future")
+	require.Nil(t, err)
+	require.Nil(t, s.db.Close())
+
+	_, err = NewSQLiteStorage(path)
+	require.NotNil(t, err)
+	require.True(t, errors.Is(err, ErrSchemaTooNew), "error must be of type SchemaTooNewError")
+}
+
+func Test_sql_Migrate_FromUnversionedSchema(t *testing.T) {
+	path := newSQLitePathForTest(t)
+
+	// database as created by versions without schema migrations
+	db, err := sqlx.Connect("sqlite3", path)
+	require.Nil(t, err)
+	_, err = db.Exec(`
+CREATE TABLE IF NOT EXISTS prefixes (
+	cidr   text NOT NULL,
+	tenantid text NOT NULL,
+	prefix text CHECK (json_valid(prefix)),
+	PRIMARY KEY (cidr,tenantid)
+);`)
+	require.Nil(t, err)
+	prefix := Prefix{
+		Cidr: "16.0.0.0/24",
+		Ips:  map[string]bool{"16.0.0.0": true, "16.0.0.1": true, "16.0.0.255": true},
+	}
+	pj, err := json.Marshal(prefix.toPrefixJSON())
+	require.Nil(t, err)
+	_, err = db.Exec("INSERT INTO prefixes (cidr, prefix, tenantid) VALUES ($1, $2, $3)", prefix.Cidr, string(pj), tenantid)
+	require.Nil(t, err)
+	require.Nil(t, db.Close())
+
+	s, err := NewSQLiteStorage(path)
+	require.Nil(t, err)
+	defer s.db.Close()
+
+	ctx := context.Background()
+	version, err := s.SchemaVersion(ctx)
+	require.Nil(t, err)
+	require.Equal(t, latestSchemaVersion(), version)
+
+	p, err := s.ReadPrefix(prefix.Cidr, tenantid)
+	require.Nil(t, err)
+	require.Equal(t, prefix.Ips, p.Ips)
+
+	ipam := NewWithStorage(s)
+	ip, err := ipam.AcquireIP(prefix.Cidr, tenantid)
+	require.Nil(t, err)
+	require.Equal(t, "16.0.0.2", ip.IP.String())
+}
+
+func Test_sql_TablePrefix(t *testing.T) {
+	path := newSQLitePathForTest(t)
+
+	a, err := NewSQLiteStorage(path, WithTablePrefix("a_"))
+	require.Nil(t, err)
+	defer a.db.Close()
+	b, err := NewSQLiteStorage(path, WithTablePrefix("b_"))
+	require.Nil(t, err)
+	defer b.db.Close()
+
+	p, err := NewWithStorage(a).NewPrefix("17.0.0.0/24", tenantid)
+	require.Nil(t, err)
+	_, err = NewWithStorage(a).AcquireIP(p.Cidr, tenantid)
+	require.Nil(t, err)
+
+	ps, err := b.ReadAllPrefixes(tenantid)
+	require.Nil(t, err)
+	require.Empty(t, ps)
+	ps, err = a.ReadAllPrefixes(tenantid)
+	require.Nil(t, err)
+	require.Len(t, ps, 1)
+
+	var count int
+	err = a.db.Get(&count, "SELECT count(*) FROM a_ips")
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+
+	_, err = NewSQLiteStorage(path, WithTablePrefix("a;DROP TABLE a_prefixes;"))
+	require.NotNil(t, err)
+	_, err = NewSQLiteStorage(path, WithSchema("ipam"))
+	require.NotNil(t, err)
+}
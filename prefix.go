@@ -1,10 +1,13 @@
 package ipam
 
 import (
+	"context"
 	"fmt"
 	"math"
+	"math/big"
 	"math/rand"
 	"net"
+	"sort"
 	"time"
 
 	"github.com/avast/retry-go"
@@ -22,12 +25,25 @@ var (
 
 // Prefix is a expression of a ip with length and forms a classless network.
 type Prefix struct {
-	Cidr                   string          // The Cidr of this prefix
-	ParentCidr             string          // if this prefix is a child this is a pointer back
-	availableChildPrefixes map[string]bool // available child prefixes of this prefix
-	childPrefixLength      int             // the length of the child prefixes
-	Ips                    map[string]bool // The ips contained in this prefix
-	version                int64           // version is used for optimistic locking
+	Cidr                   string                // The Cidr of this prefix
+	ParentCidr             string                // if this prefix is a child this is a pointer back
+	Description            string                // free-form description of this prefix
+	Labels                 map[string]string     // labels of this prefix which can be queried with a label selector
+	availableChildPrefixes map[string]bool       // child prefixes of this prefix, acquired ones are false
+	childPrefixLength      int                   // the length of the first acquired child prefix
+	Ips                    map[string]bool       // The ips contained in this prefix
+	version                int64                 // version is used for optimistic locking
+	freeRanges             []ipRange             // free ranges of ips ordered by address, nil if not calculated yet
+	allocationStrategy     AllocationStrategy    // the allocation strategy of this prefix, empty for the one of the Ipamer
+	cursor                 *big.Int              // the position behind the last acquisition for the RoundRobin strategy
+	reserved               map[string]bool       // reserved ips of this prefix, they are not contained in Ips
+	exclusions             []ipRange             // ranges excluded from acquiring ips ordered by address
+	metadata               map[string]IPMetadata // metadata of the acquired ips which have metadata
+	leases                 map[string]time.Time  // expiry of the leased ips
+	quarantine             time.Duration         // how long released ips stay quarantined, zero if they are free immediately
+	quarantined            map[string]time.Time  // end of the quarantine of released ips, they are not contained in Ips
+	bindings               map[string]string     // ips bound to sticky keys, they outlive the release of the ip
+	stored                 *storedRows           // the rows the prefix was read with from a sql storage, nil for other storages
 }
 
 // DeepCopy to a new Prefix
@@ -35,10 +51,23 @@ func (p Prefix) DeepCopy() *Prefix {
 	return &Prefix{
 		Cidr:                   p.Cidr,
 		ParentCidr:             p.ParentCidr,
+		Description:            p.Description,
+		Labels:                 copyLabels(p.Labels),
 		availableChildPrefixes: copyMap(p.availableChildPrefixes),
 		childPrefixLength:      p.childPrefixLength,
 		Ips:                    copyMap(p.Ips),
 		version:                p.version,
+		freeRanges:             copyRanges(p.freeRanges),
+		allocationStrategy:     p.allocationStrategy,
+		cursor:                 copyInt(p.cursor),
+		reserved:               copyMap(p.reserved),
+		exclusions:             copyRanges(p.exclusions),
+		metadata:               copyMetadata(p.metadata),
+		leases:                 copyTimes(p.leases),
+		quarantine:             p.quarantine,
+		quarantined:            copyTimes(p.quarantined),
+		bindings:               copyLabels(p.bindings),
+		stored:                 p.stored,
 	}
 }
 
@@ -51,19 +80,30 @@ func copyMap(m map[string]bool) map[string]bool {
 }
 
 // Usage of ips and child Prefixes of a Prefix
+// AcquiredIPs contains the ReservedIPs.
+// ExcludedIPs contains the ips of the exclusion ranges which are not counted as acquired, reserved or quarantined.
+// AvailablePrefixes contains the AcquiredPrefixes and the child Prefixes of the smallest acquired size
+// which can still be acquired, with child Prefixes of different lengths it changes with every acquisition.
 type Usage struct {
 	AvailableIPs      uint64
 	AcquiredIPs       uint64
+	ReservedIPs       uint64
+	ExcludedIPs       uint64
+	QuarantinedIPs    uint64
 	AvailablePrefixes uint64
 	AcquiredPrefixes  uint64
 }
 
-func (i *ipamer) NewPrefix(cidr string, tenantid string) (*Prefix, error) {
-	p, err := i.newPrefix(cidr)
+func (i *ipamer) NewPrefix(cidr string, tenantid string, opts ...PrefixOption) (*Prefix, error) {
+	return i.NewPrefixContext(context.Background(), cidr, tenantid, opts...)
+}
+
+func (i *ipamer) NewPrefixContext(ctx context.Context, cidr string, tenantid string, opts ...PrefixOption) (*Prefix, error) {
+	p, err := i.newPrefix(cidr, opts...)
 	if err != nil {
 		return nil, err
 	}
-	newPrefix, err := i.storage.CreatePrefix(*p, tenantid)
+	newPrefix, err := i.contextStorage().CreatePrefixContext(ctx, *p, tenantid)
 	if err != nil {
 		return nil, err
 	}
@@ -72,14 +112,21 @@ func (i *ipamer) NewPrefix(cidr string, tenantid string) (*Prefix, error) {
 }
 
 func (i *ipamer) DeletePrefix(cidr string, tenantid string) (*Prefix, error) {
-	p := i.PrefixFrom(cidr, tenantid)
+	return i.DeletePrefixContext(context.Background(), cidr, tenantid)
+}
+
+func (i *ipamer) DeletePrefixContext(ctx context.Context, cidr string, tenantid string) (*Prefix, error) {
+	p, err := i.readPrefix(ctx, cidr, tenantid)
+	if err != nil {
+		return nil, err
+	}
 	if p == nil {
 		return nil, fmt.Errorf("%w: delete prefix:%s", ErrNotFound, cidr)
 	}
-	if len(p.Ips) > 2 {
+	if len(p.Ips) > 0 {
 		return nil, fmt.Errorf("prefix %s has ips, delete prefix not possible", p.Cidr)
 	}
-	prefix, err := i.storage.DeletePrefix(*p, tenantid)
+	prefix, err := i.contextStorage().DeletePrefixContext(ctx, *p, tenantid)
 	if err != nil {
 		return nil, fmt.Errorf("delete prefix:%s %v", cidr, err)
 	}
@@ -87,166 +134,338 @@ func (i *ipamer) DeletePrefix(cidr string, tenantid string) (*Prefix, error) {
 	return &prefix, nil
 }
 
-func (i *ipamer) AcquireChildPrefix(parentCidr string, length int, tenantid string) (*Prefix, error) {
+func (i *ipamer) AcquireChildPrefix(parentCidr string, length int, tenantid string, opts ...AcquireOption) (*Prefix, error) {
+	return i.AcquireChildPrefixContext(context.Background(), parentCidr, length, tenantid, opts...)
+}
+
+func (i *ipamer) AcquireChildPrefixContext(ctx context.Context, parentCidr string, length int, tenantid string, opts ...AcquireOption) (*Prefix, error) {
+	o := newAcquireOptions(opts)
 	var prefix *Prefix
-	return prefix, retryOnOptimisticLock(func() error {
+	return prefix, retryOnOptimisticLock(ctx, func() error {
 		var err error
-		prefix, err = i.acquireChildPrefixInternal(parentCidr, length, tenantid)
+		prefix, err = i.acquireChildPrefixInternal(ctx, parentCidr, length, tenantid, o)
 		return err
 	})
 }
 
 // acquireChildPrefixInternal will return a Prefix with a smaller length from the given Prefix.
-// FIXME allow variable child prefix length
-func (i *ipamer) acquireChildPrefixInternal(parentCidr string, length int, tenantid string) (*Prefix, error) {
-	prefix := i.PrefixFrom(parentCidr, tenantid)
+// Child prefixes of different lengths can be acquired from the same Prefix.
+// The search for a free child prefix begins at the position given by the allocation strategy.
+func (i *ipamer) acquireChildPrefixInternal(ctx context.Context, parentCidr string, length int, tenantid string, o acquireOptions) (*Prefix, error) {
+	prefix, err := i.readPrefix(ctx, parentCidr, tenantid)
+	if err != nil {
+		return nil, err
+	}
 	if prefix == nil {
 		return nil, fmt.Errorf("unable to find prefix for cidr:%s", parentCidr)
 	}
-	if len(prefix.Ips) > 2 {
+	if len(prefix.Ips) > 0 {
 		return nil, fmt.Errorf("prefix %s has ips, acquire child prefix not possible", prefix.Cidr)
 	}
 	ipnet, err := prefix.IPNet()
 	if err != nil {
 		return nil, err
 	}
-	ones, size := ipnet.Mask.Size()
+	ones, _ := ipnet.Mask.Size()
 	if ones >= length {
 		return nil, fmt.Errorf("given length:%d is smaller or equal of prefix length:%d", length, ones)
 	}
 
-	// If this is the first call, create a pool of available child prefixes with given length upfront
+	// the first acquired child prefix marks this prefix as parent of child prefixes
 	if prefix.childPrefixLength == 0 {
-		ip := ipnet.IP
-		// FIXME use big.Int
-		// power of 2 :-(
-		// subnetCount := 1 << (uint(length - ones))
-		subnetCount := int(math.Pow(float64(2), float64(length-ones)))
-		for s := 0; s < subnetCount; s++ {
-			ipPart, err := insertNumIntoIP(ip, s, length)
-			if err != nil {
-				return nil, err
-			}
-			newIP := &net.IPNet{
-				IP:   *ipPart,
-				Mask: net.CIDRMask(length, size),
-			}
-			newCidr := newIP.String()
-			child, err := i.newPrefix(newCidr)
-			if err != nil {
-				return nil, err
-			}
-			prefix.availableChildPrefixes[child.Cidr] = true
-
-		}
 		prefix.childPrefixLength = length
 	}
-	if prefix.childPrefixLength != length {
-		return nil, fmt.Errorf("given length:%d is not equal to existing child prefix length:%d", length, prefix.childPrefixLength)
+	prefix.dropAvailableChildPrefixes()
+	start, bits := ipToInt(ipnet.IP)
+	end := new(big.Int).Add(start, blockSize(bits, ones))
+	from, err := i.searchStart(prefix, start, end, o)
+	if err != nil {
+		return nil, err
 	}
-
-	var child *Prefix
-	for c, available := range prefix.availableChildPrefixes {
-		if !available {
-			continue
-		}
-		child, err = i.newPrefix(c)
-		if err != nil {
-			continue
-		}
-		break
+	free, err := prefix.freeChildPrefix(ipnet, length, from)
+	if err != nil {
+		return nil, err
 	}
-	if child == nil {
+	if free == nil {
 		return nil, fmt.Errorf("no more child prefixes contained in prefix pool")
 	}
-
-	prefix.availableChildPrefixes[child.Cidr] = false
-
-	_, err = i.storage.UpdatePrefix(*prefix, tenantid)
+	if i.strategyOf(prefix) == RoundRobin {
+		freeStart, _ := ipToInt(free.IP)
+		prefix.advanceCursor(freeStart.Add(freeStart, blockSize(bits, length)), start, end)
+	}
+	child, err := i.newPrefix(free.String())
 	if err != nil {
-		return nil, errors.Wrapf(err, "unable to update parent prefix:%v", prefix)
+		return nil, err
 	}
-	child, err = i.NewPrefix(child.Cidr, tenantid)
+	existing, err := i.readPrefix(ctx, child.Cidr, tenantid)
 	if err != nil {
-		return nil, fmt.Errorf("unable to persist created child:%v", err)
+		return nil, err
+	}
+	if existing != nil {
+		if existing.ParentCidr == prefix.Cidr {
+			return i.adoptChildPrefix(ctx, prefix, existing, tenantid)
+		}
+		return nil, fmt.Errorf("child prefix:%s of prefix:%s already exists", child.Cidr, prefix.Cidr)
 	}
 	child.ParentCidr = prefix.Cidr
-	_, err = i.storage.UpdatePrefix(*child, tenantid)
+	prefix.availableChildPrefixes[child.Cidr] = false
+
+	// the child is created together with the update of the parent, neither is stored without the other
+	err = applyChanges(ctx, i.storage, []PrefixChange{
+		{Tenantid: tenantid, Prefix: *child, Op: ChangeCreate},
+		{Tenantid: tenantid, Prefix: *prefix, Op: ChangeUpdate},
+	})
 	if err != nil {
-		return nil, errors.Wrapf(err, "unable to update parent prefix:%v", child)
+		return nil, errors.Wrapf(err, "unable to persist child prefix:%s of prefix:%s", child.Cidr, prefix.Cidr)
 	}
 
 	return child, nil
 }
 
 func (i *ipamer) ReleaseChildPrefix(child *Prefix, tenantid string) error {
-	return retryOnOptimisticLock(func() error {
-		return i.releaseChildPrefixInternal(child, tenantid)
+	return i.ReleaseChildPrefixContext(context.Background(), child, tenantid)
+}
+
+func (i *ipamer) ReleaseChildPrefixContext(ctx context.Context, child *Prefix, tenantid string) error {
+	return retryOnOptimisticLock(ctx, func() error {
+		return i.releaseChildPrefixInternal(ctx, child, tenantid)
 	})
 }
 
 // releaseChildPrefixInternal will mark this child Prefix as available again.
-func (i *ipamer) releaseChildPrefixInternal(child *Prefix, tenantid string) error {
-	parent := i.PrefixFrom(child.ParentCidr,tenantid)
-
+func (i *ipamer) releaseChildPrefixInternal(ctx context.Context, child *Prefix, tenantid string) error {
+	parent, err := i.readPrefix(ctx, child.ParentCidr, tenantid)
+	if err != nil {
+		return err
+	}
 	if parent == nil {
 		return fmt.Errorf("prefix %s is no child prefix", child.Cidr)
 	}
-	if len(child.Ips) > 2 {
+	if len(child.Ips) > 0 {
 		return fmt.Errorf("prefix %s has ips, deletion not possible", child.Cidr)
 	}
 
-	parent.availableChildPrefixes[child.Cidr] = true
-	_, err := i.DeletePrefix(child.Cidr, tenantid)
+	available, ok := parent.availableChildPrefixes[child.Cidr]
+	if !ok || available {
+		return fmt.Errorf("prefix %s is not acquired from %s", child.Cidr, parent.Cidr)
+	}
+
+	stored, err := i.readPrefix(ctx, child.Cidr, tenantid)
 	if err != nil {
-		return fmt.Errorf("unable to release prefix %v:%v", child, err)
+		return err
+	}
+	if stored == nil {
+		return fmt.Errorf("%w: unable to release prefix %s", ErrNotFound, child.Cidr)
 	}
-	_, err = i.storage.UpdatePrefix(*parent, tenantid)
+	if len(stored.Ips) > 0 {
+		return fmt.Errorf("prefix %s has ips, deletion not possible", child.Cidr)
+	}
+
+	delete(parent.availableChildPrefixes, child.Cidr)
+	parent.dropAvailableChildPrefixes()
+	// the child is deleted together with the update of the parent, neither is stored without the other
+	err = applyChanges(ctx, i.storage, []PrefixChange{
+		{Tenantid: tenantid, Prefix: *parent, Op: ChangeUpdate},
+		{Tenantid: tenantid, Prefix: *stored, Op: ChangeDelete},
+	})
 	if err != nil {
-		return fmt.Errorf("unable to release prefix %v:%v", child, err)
+		return errors.Wrapf(err, "unable to release prefix %v", child)
 	}
 	return nil
 }
 
+// adoptChildPrefix handles a stored child prefix which points to the parent but is not marked as acquired by it.
+// It was either acquired concurrently after the parent was read or left over by an earlier version which stored
+// the child but not the parent. A child without ips and child prefixes is acquired again by marking it in the parent.
+func (i *ipamer) adoptChildPrefix(ctx context.Context, parent *Prefix, child *Prefix, tenantid string) (*Prefix, error) {
+	if len(child.Ips) == 0 && child.acquiredPrefixes() == 0 {
+		parent.availableChildPrefixes[child.Cidr] = false
+		err := applyChanges(ctx, i.storage, []PrefixChange{{Tenantid: tenantid, Prefix: *parent, Op: ChangeUpdate}})
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to adopt child prefix:%s of prefix:%s", child.Cidr, parent.Cidr)
+		}
+		return child, nil
+	}
+	current, err := i.readPrefix(ctx, parent.Cidr, tenantid)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil || current.version != parent.version {
+		return nil, newOptimisticLockError(fmt.Sprintf("child prefix:%s of prefix:%s was acquired concurrently", child.Cidr, parent.Cidr))
+	}
+	return nil, fmt.Errorf("child prefix:%s is in use but not marked as acquired by prefix:%s, Check can repair it", child.Cidr, parent.Cidr)
+}
+
+// freeChildPrefix returns the first child prefix with the given length inside ipnet at or after from
+// which does not overlap an acquired child prefix, the search wraps around at the end of ipnet.
+// It returns nil if there is none.
+// Only the gaps between the acquired child prefixes are inspected, so the costs depend
+// on the number of acquired child prefixes and not on the size of ipnet.
+func (p *Prefix) freeChildPrefix(ipnet *net.IPNet, length int, from *big.Int) (*net.IPNet, error) {
+	start, bits := ipToInt(ipnet.IP)
+	if start == nil {
+		return nil, fmt.Errorf("unable to convert ip %s to int", ipnet.IP)
+	}
+	ones, _ := ipnet.Mask.Size()
+	end := new(big.Int).Add(start, blockSize(bits, ones))
+	size := blockSize(bits, length)
+
+	acquired, err := p.acquiredChildRanges()
+	if err != nil {
+		return nil, err
+	}
+	candidate := firstFreeBlock(acquired, alignUp(from, size), size)
+	if candidate.Cmp(start) > 0 && new(big.Int).Add(candidate, size).Cmp(end) > 0 {
+		candidate = firstFreeBlock(acquired, start, size)
+	}
+	if new(big.Int).Add(candidate, size).Cmp(end) > 0 {
+		return nil, nil
+	}
+	return &net.IPNet{
+		IP:   intToIP(candidate, bits),
+		Mask: net.CIDRMask(length, bits),
+	}, nil
+}
+
+// firstFreeBlock returns the first block at or after from which is aligned to size and
+// does not overlap one of the acquired ranges, from must be aligned to size.
+func firstFreeBlock(acquired []ipRange, from, size *big.Int) *big.Int {
+	candidate := new(big.Int).Set(from)
+	candidateEnd := new(big.Int).Add(candidate, size)
+	for _, r := range acquired {
+		if r.end.Cmp(candidate) <= 0 {
+			continue
+		}
+		if candidateEnd.Cmp(r.start) <= 0 {
+			break
+		}
+		// next block aligned to size behind the acquired child prefix
+		candidate = alignUp(r.end, size)
+		candidateEnd.Add(candidate, size)
+	}
+	return candidate
+}
+
+// alignUp rounds i up to the next multiple of size.
+func alignUp(i, size *big.Int) *big.Int {
+	aligned := new(big.Int).Add(i, new(big.Int).Sub(size, big.NewInt(1)))
+	aligned.Div(aligned, size)
+	return aligned.Mul(aligned, size)
+}
+
+// acquiredChildRanges returns the address ranges of the acquired child prefixes ordered by start.
+func (p *Prefix) acquiredChildRanges() ([]ipRange, error) {
+	var ranges []ipRange
+	for c, available := range p.availableChildPrefixes {
+		if available {
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse child prefix:%s %v", c, err)
+		}
+		start, bits := ipToInt(n.IP)
+		ones, _ := n.Mask.Size()
+		ranges = append(ranges, ipRange{
+			start: start,
+			end:   new(big.Int).Add(start, blockSize(bits, ones)),
+		})
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].start.Cmp(ranges[j].start) < 0
+	})
+	return ranges, nil
+}
+
+// blockSize returns the number of addresses of a prefix with the given length.
+func blockSize(bits, length int) *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(bits-length))
+}
+
+// dropAvailableChildPrefixes removes the pool of available child prefixes which
+// earlier versions created upfront, only acquired child prefixes are stored.
+func (p *Prefix) dropAvailableChildPrefixes() {
+	for c, available := range p.availableChildPrefixes {
+		if available {
+			delete(p.availableChildPrefixes, c)
+		}
+	}
+}
+
 func (i *ipamer) PrefixFrom(cidr string, tenantid string) *Prefix {
-	prefix, err := i.storage.ReadPrefix(cidr, tenantid)
+	return i.PrefixFromContext(context.Background(), cidr, tenantid)
+}
+
+func (i *ipamer) PrefixFromContext(ctx context.Context, cidr string, tenantid string) *Prefix {
+	prefix, _ := i.readPrefix(ctx, cidr, tenantid)
+	return prefix
+}
+
+// readPrefix returns the stored Prefix, nil if it does not exist.
+// The storages do not distinguish a missing prefix from other read errors, both are treated as missing
+// unless the context is done, then its error is returned.
+func (i *ipamer) readPrefix(ctx context.Context, cidr string, tenantid string) (*Prefix, error) {
+	prefix, err := i.contextStorage().ReadPrefixContext(ctx, cidr, tenantid)
 	if err != nil {
-		return nil
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, nil
+	}
+	return &prefix, nil
+}
+
+// readPartialPrefix reads the prefix with only the given ips and the ones needed to acquire ips
+// if the storage implements PartialPrefixReader, otherwise the whole prefix is read.
+func (i *ipamer) readPartialPrefix(ctx context.Context, cidr string, tenantid string, ips []string, now time.Time) (*Prefix, error) {
+	reader, ok := i.storage.(PartialPrefixReader)
+	if !ok {
+		return i.readPrefix(ctx, cidr, tenantid)
 	}
-	return &prefix
+	prefix, err := reader.ReadPartialPrefix(ctx, cidr, tenantid, ips, now)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, nil
+	}
+	return &prefix, nil
 }
 
-func (i *ipamer) AcquireSpecificIP(prefixCidr, specificIP string, tenantid string) (*IP, error) {
+func (i *ipamer) AcquireSpecificIP(prefixCidr, specificIP string, tenantid string, opts ...AcquireOption) (*IP, error) {
+	return i.AcquireSpecificIPContext(context.Background(), prefixCidr, specificIP, tenantid, opts...)
+}
+
+func (i *ipamer) AcquireSpecificIPContext(ctx context.Context, prefixCidr, specificIP string, tenantid string, opts ...AcquireOption) (*IP, error) {
+	return i.acquireIP(ctx, prefixCidr, specificIP, tenantid, newAcquireOptions(opts))
+}
+
+func (i *ipamer) acquireIP(ctx context.Context, prefixCidr, specificIP string, tenantid string, o acquireOptions) (*IP, error) {
 	var ip *IP
-	return ip, retryOnOptimisticLock(func() error {
+	return ip, retryOnOptimisticLock(ctx, func() error {
 		var err error
-		ip, err = i.acquireSpecificIPInternal(prefixCidr, specificIP, tenantid)
+		ip, err = i.acquireSpecificIPInternal(ctx, prefixCidr, specificIP, tenantid, o, true)
 		return err
 	})
 }
 
 // acquireSpecificIPInternal will acquire given IP and mark this IP as used, if already in use, return nil.
-// If specificIP is empty, the next free IP is returned.
+// If specificIP is empty, the next free IP according to the allocation strategy is returned.
 // If there is no free IP an NoIPAvailableError is returned.
 // If the Prefix is not found an NotFoundError is returned.
-func (i *ipamer) acquireSpecificIPInternal(prefixCidr, specificIP string, tenantid string) (*IP, error) {
-	prefix := i.PrefixFrom(prefixCidr, tenantid)
-	if prefix == nil {
-		return nil, fmt.Errorf("%w: unable to find prefix for cidr:%s", ErrNotFound, prefixCidr)
-	}
-	if prefix.childPrefixLength > 0 {
-		return nil, fmt.Errorf("prefix %s has childprefixes, acquire ip not possible", prefix.Cidr)
+// With partial the prefix is read without all of its ips if the storage implements PartialPrefixReader.
+func (i *ipamer) acquireSpecificIPInternal(ctx context.Context, prefixCidr, specificIP string, tenantid string, o acquireOptions, partial bool) (*IP, error) {
+	var ips []string
+	if parsed := net.ParseIP(specificIP); parsed != nil {
+		ips = append(ips, parsed.String())
 	}
-	var acquired *IP
-	ipnet, err := prefix.IPNet()
-	if err != nil {
-		return nil, err
-	}
-	network, err := prefix.Network()
+	prefix, a, err := i.prepareIPAcquisition(ctx, prefixCidr, tenantid, o, partial, ips...)
 	if err != nil {
 		return nil, err
 	}
+	ipnet, start, end := a.ipnet, a.start, a.end
 
+	var specific, from, preferred *big.Int
 	if specificIP != "" {
 		specificIPnet := net.ParseIP(specificIP)
 		if specificIPnet == nil {
@@ -255,54 +474,217 @@ func (i *ipamer) acquireSpecificIPInternal(prefixCidr, specificIP string, tenant
 		if !ipnet.Contains(specificIPnet) {
 			return nil, fmt.Errorf("given ip:%s is not in %s", specificIP, prefixCidr)
 		}
+		specificIP = specificIPnet.String()
+		specific, err = ipStringToInt(specificIP)
+		if err != nil {
+			return nil, err
+		}
+		if prefix.excluded(specific) && !o.overrideExclusions {
+			return nil, fmt.Errorf("given ip:%s is excluded from %s", specificIP, prefixCidr)
+		}
+		if until, ok := prefix.quarantined[specificIP]; ok {
+			return nil, fmt.Errorf("%w: requested ip: %s, is quarantined until %s", ErrIPinUse, specificIP, until.Format(time.RFC3339))
+		}
+	} else {
+		var held string
+		held, preferred, err = prefix.stickyIP(o.stickyKey, ipnet)
+		if err != nil {
+			return nil, err
+		}
+		if held != "" {
+			ip := prefix.ip(held)
+			return &ip, nil
+		}
+		from, err = i.searchStart(prefix, start, end, o)
+		if err != nil {
+			return nil, err
+		}
 	}
-    var ipused bool
-	for ip := network.Mask(ipnet.Mask); ipnet.Contains(ip); inc(ip) {
-		_, ok := prefix.Ips[ip.String()]
-		if ok {
-			if specificIP == ip.String() {
-				ipused = true
-			}
-			continue
+	// the ip bound to the sticky key is acquired again if it is free
+	if preferred != nil && prefix.freeRangeIndex(preferred) >= 0 {
+		from = preferred
+	}
+
+	// the free ranges are checked against the ips, they are rebuilt once if the ips were modified directly
+	for rebuilt := false; ; rebuilt = true {
+		candidate := specific
+		if candidate == nil {
+			candidate = prefix.nextFree(from)
+		} else if prefix.freeRangeIndex(candidate) < 0 && !prefix.excluded(candidate) {
+			candidate = nil
 		}
-		if specificIP == "" || specificIP == ip.String() {
-			acquired = &IP{
-				IP:           ip,
-				ParentPrefix: prefix.Cidr,
+		if candidate != nil && !prefix.used(intToIP(candidate, a.bits).String()) {
+			// an excluded ip acquired with WithExclusionOverride is not contained in the free ranges
+			ip := prefix.acquire(candidate, a, o)
+			if specific == nil && from != preferred && i.strategyOf(prefix) == RoundRobin {
+				prefix.advanceCursor(new(big.Int).Add(candidate, big.NewInt(1)), start, end)
 			}
-			prefix.Ips[ip.String()] = true
-			_, err := i.storage.UpdatePrefix(*prefix, tenantid)
+			_, err := i.contextStorage().UpdatePrefixContext(ctx, *prefix, tenantid)
 			if err != nil {
 				return nil, errors.Wrapf(err, "unable to persist acquired ip:%v", prefix)
 			}
-			return acquired, nil
+			return &ip, nil
+		}
+		if prefix.partial() {
+			// the free ranges can not be checked against the ips which were not read
+			return i.acquireSpecificIPInternal(ctx, prefixCidr, specificIP, tenantid, o, false)
+		}
+		if rebuilt || !prefix.freeRangesStale(candidate, specificIP, ipnet) {
+			break
+		}
+		err = prefix.rebuildFreeRanges()
+		if err != nil {
+			return nil, err
 		}
 	}
-	if ipused {
+	if specificIP != "" {
 		return nil, fmt.Errorf("%w: requested ip: %s, already in use.", ErrIPinUse, specificIP )
 	}
-	return nil, fmt.Errorf("%w: no more ips in prefix: %s left, length of prefix.ips: %d", ErrNoIPAvailable, prefix.Cidr, len(prefix.Ips))
+	return nil, fmt.Errorf("%w: no more ips in prefix: %s left, length of prefix.ips: %d", ErrNoIPAvailable, prefix.Cidr, prefix.acquiredips())
+}
+
+// ipAcquisition holds the values which apply to all ips acquired from a prefix by one operation.
+type ipAcquisition struct {
+	ipnet    *net.IPNet
+	start    *big.Int // the first address of the prefix
+	end      *big.Int // the address behind the prefix
+	bits     int
+	metadata IPMetadata
+	expires  time.Time // the expiry of the lease, zero without lease
 }
 
-func (i *ipamer) AcquireIP(prefixCidr string, tenantid string) (*IP, error) {
-	return i.AcquireSpecificIP(prefixCidr, "", tenantid)
+// PartialPrefixReader can be implemented by a Storage which stores the free ranges of the prefixes to read a prefix
+// without all of its ips. It is used by AcquireIP and AcquireSpecificIP, whose cost then does not grow with the number
+// of acquired ips. ReadPartialPrefix reads the prefix with all ips which the acquisition needs: the given ones,
+// the ones bound to a sticky key and the ones whose lease or quarantine ended at now.
+// An update of such a prefix must write only the ips which were read and keep the free ranges as they are.
+type PartialPrefixReader interface {
+	ReadPartialPrefix(ctx context.Context, prefix string, tenantid string, ips []string, now time.Time) (Prefix, error)
+}
+
+// prepareIPAcquisition reads the prefix to acquire ips from, frees the ips of ended quarantines and
+// expired leases and calculates the free ranges if necessary.
+// With partial only the given ips and the ones needed to free them are read if the storage implements PartialPrefixReader.
+func (i *ipamer) prepareIPAcquisition(ctx context.Context, prefixCidr string, tenantid string, o acquireOptions, partial bool, ips ...string) (*Prefix, *ipAcquisition, error) {
+	now := i.now()
+	var prefix *Prefix
+	var err error
+	if partial {
+		prefix, err = i.readPartialPrefix(ctx, prefixCidr, tenantid, ips, now)
+	} else {
+		prefix, err = i.readPrefix(ctx, prefixCidr, tenantid)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if prefix == nil {
+		return nil, nil, fmt.Errorf("%w: unable to find prefix for cidr:%s", ErrNotFound, prefixCidr)
+	}
+	if prefix.childPrefixLength > 0 {
+		return nil, nil, fmt.Errorf("prefix %s has childprefixes, acquire ip not possible", prefix.Cidr)
+	}
+	ipnet, err := prefix.IPNet()
+	if err != nil {
+		return nil, nil, err
+	}
+	ones, bits := ipnet.Mask.Size()
+	start, _ := ipToInt(ipnet.IP)
+	a := &ipAcquisition{
+		ipnet: ipnet,
+		start: start,
+		end:   new(big.Int).Add(start, blockSize(bits, ones)),
+		bits:  bits,
+	}
+	a.metadata, err = o.metadata.normalize()
+	if err != nil {
+		return nil, nil, err
+	}
+	if o.lease != 0 {
+		a.expires, err = leaseExpiry(now, o.lease)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	// ips of ended quarantines and expired leases become free before a new ip is acquired
+	err = prefix.endQuarantine(now)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = prefix.expireLeases(now)
+	if err != nil {
+		return nil, nil, err
+	}
+	if prefix.freeRanges == nil {
+		err = prefix.rebuildFreeRanges()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return prefix, a, nil
+}
+
+// acquire marks the ip as acquired with the metadata, lease and sticky key of the acquisition.
+func (p *Prefix) acquire(candidate *big.Int, a *ipAcquisition, o acquireOptions) IP {
+	ip := intToIP(candidate, a.bits).String()
+	p.takeFree(candidate)
+	p.Ips[ip] = true
+	p.setMetadata(ip, a.metadata)
+	if !a.expires.IsZero() {
+		p.setLease(ip, a.expires)
+	}
+	p.bind(o.stickyKey, ip)
+	return p.ip(ip)
+}
+
+// freeRangesStale detects if the free ranges do not match the ips after acquiring the candidate failed.
+func (p *Prefix) freeRangesStale(candidate *big.Int, specificIP string, ipnet *net.IPNet) bool {
+	if candidate != nil {
+		// the candidate is free in the ranges but used in the ips
+		return true
+	}
+	if specificIP != "" {
+		return !p.used(specificIP)
+	}
+	ones, bits := ipnet.Mask.Size()
+	unavailable := p.excludedips()
+	unavailable.Add(unavailable, big.NewInt(int64(len(p.Ips)+len(p.reserved)+len(p.quarantined))))
+	return unavailable.Cmp(blockSize(bits, ones)) < 0
+}
+
+func (i *ipamer) AcquireIP(prefixCidr string, tenantid string, opts ...AcquireOption) (*IP, error) {
+	return i.AcquireIPContext(context.Background(), prefixCidr, tenantid, opts...)
+}
+
+func (i *ipamer) AcquireIPContext(ctx context.Context, prefixCidr string, tenantid string, opts ...AcquireOption) (*IP, error) {
+	return i.acquireIP(ctx, prefixCidr, "", tenantid, newAcquireOptions(opts))
 }
 
 func (i *ipamer) ReleaseIP(ip *IP, tenantid string) (*Prefix, error) {
-	err := i.ReleaseIPFromPrefix(ip.ParentPrefix, ip.IP.String(), tenantid)
-	prefix := i.PrefixFrom(ip.ParentPrefix, tenantid)
+	return i.ReleaseIPContext(context.Background(), ip, tenantid)
+}
+
+func (i *ipamer) ReleaseIPContext(ctx context.Context, ip *IP, tenantid string) (*Prefix, error) {
+	err := i.ReleaseIPFromPrefixContext(ctx, ip.ParentPrefix, ip.IP.String(), tenantid)
+	prefix := i.PrefixFromContext(ctx, ip.ParentPrefix, tenantid)
 	return prefix, err
 }
 
 func (i *ipamer) ReleaseIPFromPrefix(prefixCidr, ip string, tenantid string) error {
-	return retryOnOptimisticLock(func() error {
-		return i.releaseIPFromPrefixInternal(prefixCidr, ip, tenantid)
+	return i.ReleaseIPFromPrefixContext(context.Background(), prefixCidr, ip, tenantid)
+}
+
+func (i *ipamer) ReleaseIPFromPrefixContext(ctx context.Context, prefixCidr, ip string, tenantid string) error {
+	return retryOnOptimisticLock(ctx, func() error {
+		return i.releaseIPFromPrefixInternal(ctx, prefixCidr, ip, tenantid)
 	})
 }
 
 // releaseIPFromPrefixInternal will release the given IP for later usage.
-func (i *ipamer) releaseIPFromPrefixInternal(prefixCidr, ip string, tenantid string) error {
-	prefix := i.PrefixFrom(prefixCidr, tenantid)
+func (i *ipamer) releaseIPFromPrefixInternal(ctx context.Context, prefixCidr, ip string, tenantid string) error {
+	prefix, err := i.readPrefix(ctx, prefixCidr, tenantid)
+	if err != nil {
+		return err
+	}
 	if prefix == nil {
 		return fmt.Errorf("%w: unable to find prefix for cidr:%s", ErrNotFound, prefixCidr)
 	}
@@ -310,14 +692,38 @@ func (i *ipamer) releaseIPFromPrefixInternal(prefixCidr, ip string, tenantid str
 	if !ok {
 		return fmt.Errorf("%w: unable to release ip:%s because it is not allocated in prefix:%s", ErrNotFound, ip, prefixCidr)
 	}
-	delete(prefix.Ips, ip)
-	_, err := i.storage.UpdatePrefix(*prefix, tenantid)
+	err = prefix.release(ip, i.now())
+	if err != nil {
+		return err
+	}
+	_, err = i.contextStorage().UpdatePrefixContext(ctx, *prefix, tenantid)
 	if err != nil {
 		return fmt.Errorf("unable to release ip %v:%v", ip, err)
 	}
 	return nil
 }
 
+// release removes the ip with its metadata and lease and quarantines it if the prefix has a quarantine,
+// otherwise it becomes free again unless it is excluded.
+func (p *Prefix) release(ip string, now time.Time) error {
+	delete(p.Ips, ip)
+	delete(p.metadata, ip)
+	delete(p.leases, ip)
+	if p.quarantineIP(ip, now) {
+		return nil
+	}
+	if p.freeRanges != nil {
+		ipInt, err := ipStringToInt(ip)
+		if err != nil {
+			return err
+		}
+		if !p.excluded(ipInt) {
+			p.addFree(ipInt)
+		}
+	}
+	return nil
+}
+
 func (i *ipamer) PrefixesOverlapping(existingPrefixes []string, newPrefixes []string) error {
 	for _, ep := range existingPrefixes {
 		eip, eipnet, err := net.ParseCIDR(ep)
@@ -362,8 +768,9 @@ func (i *ipamer) getHostAddresses(prefix string, tenantid string) ([]string, err
 }
 
 // newPrefix create a new Prefix from a string notation.
-func (i *ipamer) newPrefix(cidr string) (*Prefix, error) {
-	_, _, err := net.ParseCIDR(cidr)
+// The default reservation applies if the options do not contain WithReservedIPs.
+func (i *ipamer) newPrefix(cidr string, opts ...PrefixOption) (*Prefix, error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
 	if err != nil {
 		return nil, fmt.Errorf("unable to parse cidr:%s %v", cidr, err)
 	}
@@ -372,37 +779,24 @@ func (i *ipamer) newPrefix(cidr string) (*Prefix, error) {
 		Ips:                    make(map[string]bool),
 		availableChildPrefixes: make(map[string]bool),
 	}
-
-	broadcast, err := p.broadcast()
-	if err != nil {
-		return nil, err
-	}
-	// First IP in the prefix and Broadcast is blocked.
-	network, err := p.Network()
-	if err != nil {
-		return nil, err
+	for _, opt := range opts {
+		err = opt(p)
+		if err != nil {
+			return nil, err
+		}
 	}
-	p.Ips[network.String()] = true
-	p.Ips[broadcast.IP.String()] = true
-
-	return p, nil
-}
-
-func (p *Prefix) broadcast() (*IP, error) {
-	ipnet, err := p.IPNet()
-	if err != nil {
-		return nil, err
+	if p.reserved == nil {
+		err = WithReservedIPs(defaultReservation(ipnet))(p)
+		if err != nil {
+			return nil, err
+		}
 	}
-	network, err := p.Network()
+	err = p.rebuildFreeRanges()
 	if err != nil {
 		return nil, err
 	}
-	mask := ipnet.Mask
-	n := IP{IP: network}
-	m := IP{IP: net.IP(mask)}
 
-	broadcast := n.or(m.not())
-	return &broadcast, nil
+	return p, nil
 }
 
 func (p *Prefix) String() string {
@@ -445,19 +839,68 @@ func (p *Prefix) availableips() uint64 {
 	}
 
 	ones, _ := ipnet.Mask.Size()
-	// FIXME use big.Int
-	count := uint64(math.Pow(float64(2), float64(bits-ones)))
-	return count
+	return saturatedUint64(blockSize(bits, ones))
 }
 
-// acquiredips return the number of ips acquired in this Prefix
+// acquiredips return the number of ips acquired or reserved in this Prefix
 func (p *Prefix) acquiredips() uint64 {
-	return uint64(len(p.Ips))
+	return uint64(len(p.Ips) + len(p.reserved))
 }
 
-// availablePrefixes return the amount of possible prefixes of this prefix if this is a parent prefix
+// availablePrefixes return the amount of child prefixes of this prefix if this is a parent prefix:
+// the acquired child prefixes and the child prefixes of the smallest size acquired so far
+// which still fit into the free address space. If all child prefixes have the same length
+// this is the amount of child prefixes of this length the prefix contains.
 func (p *Prefix) availablePrefixes() uint64 {
-	return uint64(len(p.availableChildPrefixes))
+	if p.childPrefixLength == 0 {
+		return 0
+	}
+	_, ipnet, err := net.ParseCIDR(p.Cidr)
+	if err != nil {
+		return 0
+	}
+	acquired, err := p.acquiredChildRanges()
+	if err != nil {
+		return 0
+	}
+	length := p.childPrefixLength
+	for c, available := range p.availableChildPrefixes {
+		if _, n, err := net.ParseCIDR(c); err == nil && !available {
+			if ones, _ := n.Mask.Size(); ones > length {
+				length = ones
+			}
+		}
+	}
+	start, bits := ipToInt(ipnet.IP)
+	ones, _ := ipnet.Mask.Size()
+	end := new(big.Int).Add(start, blockSize(bits, ones))
+	size := blockSize(bits, length)
+
+	// count the aligned blocks in the gaps between the acquired child prefixes
+	count := new(big.Int).SetUint64(p.acquiredPrefixes())
+	from := start
+	for _, r := range append(acquired, ipRange{start: end, end: end}) {
+		to := r.start
+		if to.Cmp(end) > 0 {
+			to = end
+		}
+		first := alignUp(from, size)
+		if to.Cmp(first) > 0 {
+			count.Add(count, new(big.Int).Div(new(big.Int).Sub(to, first), size))
+		}
+		if r.end.Cmp(from) > 0 {
+			from = r.end
+		}
+	}
+	return saturatedUint64(count)
+}
+
+// saturatedUint64 returns i as uint64, math.MaxUint64 if it does not fit.
+func saturatedUint64(i *big.Int) uint64 {
+	if !i.IsUint64() {
+		return math.MaxUint64
+	}
+	return i.Uint64()
 }
 
 // acquiredPrefixes return the amount of acquired prefixes of this prefix if this is a parent prefix
@@ -476,6 +919,9 @@ func (p *Prefix) Usage() Usage {
 	return Usage{
 		AvailableIPs:      p.availableips(),
 		AcquiredIPs:       p.acquiredips(),
+		ReservedIPs:       uint64(len(p.reserved)),
+		ExcludedIPs:       saturatedUint64(p.excludedips()),
+		QuarantinedIPs:    uint64(len(p.quarantined)),
 		AvailablePrefixes: p.availablePrefixes(),
 		AcquiredPrefixes:  p.acquiredPrefixes(),
 	}
@@ -508,20 +954,51 @@ func (o IPinUseError) Error() string {
 
 // retries the given function if the reported error is an OptimisticLockError
 // with ten attempts and jitter delay ~100ms
+// stops retrying as soon as the context is done
 // returns only error of last failed attempt
-func retryOnOptimisticLock(retryableFunc retry.RetryableFunc) error {
-
+func retryOnOptimisticLock(ctx context.Context, retryableFunc retry.RetryableFunc) error {
+	// the delay between the attempts is waited here instead of by retry.Do, which can not be interrupted
+	attempt := uint(0)
 	return retry.Do(
-		retryableFunc,
+		func() error {
+			if attempt > 0 {
+				err := sleep(ctx, JitterDelay(attempt-1, nil))
+				if err != nil {
+					return err
+				}
+			}
+			attempt++
+			err := ctx.Err()
+			if err != nil {
+				return err
+			}
+			return retryableFunc()
+		},
 		retry.RetryIf(func(err error) bool {
+			if ctx.Err() != nil {
+				return false
+			}
 			_, isOptimisticLock := errors.Cause(err).(OptimisticLockError)
 			return isOptimisticLock
 		}),
 		retry.Attempts(10),
-		retry.DelayType(JitterDelay),
+		retry.Delay(0),
+		retry.DelayType(retry.FixedDelay),
 		retry.LastErrorOnly(true))
 }
 
+// sleep waits for the given duration, it returns the error of the context if it is done before.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
 // jitter will add jitter to a time.Duration.
 func jitter(d time.Duration) time.Duration {
 	const jitter = 0.50
@@ -1,6 +1,8 @@
 package ipam
 
 import (
+	"fmt"
+	"math/big"
 	"testing"
 )
 
@@ -19,12 +21,23 @@ func benchmarkNewPrefix(ipam Ipamer, b *testing.B) {
 		}
 	}
 }
-/*
 func BenchmarkNewPrefixMemory(b *testing.B) {
 	ipam := New()
 	benchmarkNewPrefix(ipam, b)
 }
- */
+
+func BenchmarkNewPrefixSQLite(b *testing.B) {
+	storage, err := startSQLite()
+	if err != nil {
+		panic(err)
+	}
+	err = storage.cleanup()
+	if err != nil {
+		panic(err)
+	}
+	ipam := NewWithStorage(storage)
+	benchmarkNewPrefix(ipam, b)
+}
 
 func BenchmarkNewPrefixPostgres(b *testing.B) {
 	_, storage, err := startPostgres()
@@ -69,10 +82,24 @@ func benchmarkAcquireIP(ipam Ipamer, cidr string, b *testing.B) {
 	}
 }
 
-/*func BenchmarkAcquireIPMemory(b *testing.B) {
+func BenchmarkAcquireIPMemory(b *testing.B) {
 	ipam := New()
 	benchmarkAcquireIP(ipam, "11.0.0.0/24", b)
-}*/
+}
+
+func BenchmarkAcquireIPSQLite(b *testing.B) {
+	storage, err := startSQLite()
+	if err != nil {
+		panic(err)
+	}
+	err = storage.cleanup()
+	if err != nil {
+		panic(err)
+	}
+	ipam := NewWithStorage(storage)
+	benchmarkAcquireIP(ipam, "10.0.0.0/16", b)
+}
+
 func BenchmarkAcquireIPPostgres(b *testing.B) {
 	_, storage, err := startPostgres()
 	if err != nil {
@@ -92,10 +119,150 @@ func BenchmarkAcquireIPCockroach(b *testing.B) {
 	ipam := NewWithStorage(storage)
 	benchmarkAcquireIP(ipam, "10.0.0.0/16", b)
 }
-/*
+
+func BenchmarkAcquireIPMemoryIPv6(b *testing.B) {
+	ipam := New()
+	benchmarkAcquireIP(ipam, "2001:db8::/64", b)
+}
+
+// benchmarkAcquireIPNearlyFull acquires the last free ips of a prefix where all other ips are acquired.
+func benchmarkAcquireIPNearlyFull(ipam *ipamer, cidr string, free int, b *testing.B) {
+	p, err := ipam.NewPrefix(cidr, tenantid)
+	if err != nil {
+		panic(err)
+	}
+	ipnet, err := p.IPNet()
+	if err != nil {
+		panic(err)
+	}
+	start, bits := ipToInt(ipnet.IP)
+	ones, _ := ipnet.Mask.Size()
+	count := int(blockSize(bits, ones).Int64()) - free
+	for n := 0; n < count; n++ {
+		ip := intToIP(new(big.Int).Add(start, big.NewInt(int64(n))), bits)
+		p.Ips[ip.String()] = true
+	}
+	err = p.rebuildFreeRanges()
+	if err != nil {
+		panic(err)
+	}
+	_, err = ipam.storage.UpdatePrefix(*p, tenantid)
+	if err != nil {
+		panic(err)
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		ip, err := ipam.AcquireIP(p.Cidr, tenantid)
+		if err != nil {
+			panic(err)
+		}
+		_, err = ipam.ReleaseIP(ip, tenantid)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+func BenchmarkAcquireIPNearlyFullMemory(b *testing.B) {
+	ipam := New().(*ipamer)
+	benchmarkAcquireIPNearlyFull(ipam, "10.0.0.0/16", 2, b)
+}
+
+func BenchmarkAcquireIPNearlyFullSQLite(b *testing.B) {
+	storage, err := startSQLite()
+	if err != nil {
+		panic(err)
+	}
+	err = storage.cleanup()
+	if err != nil {
+		panic(err)
+	}
+	ipam := NewWithStorage(storage).(*ipamer)
+	benchmarkAcquireIPNearlyFull(ipam, "10.0.0.0/16", 2, b)
+}
+// benchmarkAcquireIPWithAcquired acquires ips from a prefix in which the given number of ips is acquired already,
+// with a sql storage the cost of an acquisition does not grow with the number of acquired ips.
+func benchmarkAcquireIPWithAcquired(ipam *ipamer, cidr string, acquired int, b *testing.B) {
+	p, err := ipam.NewPrefix(cidr, tenantid)
+	if err != nil {
+		panic(err)
+	}
+	ipnet, err := p.IPNet()
+	if err != nil {
+		panic(err)
+	}
+	start, bits := ipToInt(ipnet.IP)
+	for n := 1; n <= acquired; n++ {
+		ip := intToIP(new(big.Int).Add(start, big.NewInt(int64(n))), bits)
+		p.Ips[ip.String()] = true
+	}
+	_, err = ipam.storage.UpdatePrefix(*p, tenantid)
+	if err != nil {
+		panic(err)
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		ip, err := ipam.AcquireIP(p.Cidr, tenantid)
+		if err != nil {
+			panic(err)
+		}
+		if ip == nil {
+			panic("IP nil")
+		}
+	}
+	b.StopTimer()
+	_, err = ipam.storage.DeletePrefix(*p, tenantid)
+	if err != nil {
+		b.Fatalf("error deleting prefix:%v", err)
+	}
+}
+
+func BenchmarkAcquireIPWith100AcquiredSQLite(b *testing.B) {
+	storage, err := startSQLite()
+	if err != nil {
+		panic(err)
+	}
+	err = storage.cleanup()
+	if err != nil {
+		panic(err)
+	}
+	ipam := NewWithStorage(storage).(*ipamer)
+	benchmarkAcquireIPWithAcquired(ipam, "10.0.0.0/8", 100, b)
+}
+
+func BenchmarkAcquireIPWith10000AcquiredSQLite(b *testing.B) {
+	storage, err := startSQLite()
+	if err != nil {
+		panic(err)
+	}
+	err = storage.cleanup()
+	if err != nil {
+		panic(err)
+	}
+	ipam := NewWithStorage(storage).(*ipamer)
+	benchmarkAcquireIPWithAcquired(ipam, "10.0.0.0/8", 10000, b)
+}
+
+func BenchmarkAcquireIPWith10000AcquiredPostgres(b *testing.B) {
+	_, storage, err := startPostgres()
+	if err != nil {
+		panic(err)
+	}
+	defer storage.db.Close()
+	err = storage.cleanup()
+	if err != nil {
+		panic(err)
+	}
+	ipam := NewWithStorage(storage).(*ipamer)
+	benchmarkAcquireIPWithAcquired(ipam, "10.0.0.0/8", 10000, b)
+}
+
 func benchmarkAcquireChildPrefix(parentLength, childLength int, b *testing.B) {
+	benchmarkAcquireChildPrefixFrom(fmt.Sprintf("192.168.0.0/%d", parentLength), childLength, b)
+}
+func benchmarkAcquireChildPrefixFrom(parentCidr string, childLength int, b *testing.B) {
 	ipam := New()
-	p, err := ipam.NewPrefix(fmt.Sprintf("192.168.0.0/%d", parentLength),tenantid)
+	p, err := ipam.NewPrefix(parentCidr, tenantid)
 	if err != nil {
 		panic(err)
 	}
@@ -124,6 +291,12 @@ func BenchmarkAcquireChildPrefix7(b *testing.B)  { benchmarkAcquireChildPrefix(1
 func BenchmarkAcquireChildPrefix8(b *testing.B)  { benchmarkAcquireChildPrefix(16, 22, b) }
 func BenchmarkAcquireChildPrefix9(b *testing.B)  { benchmarkAcquireChildPrefix(16, 24, b) }
 func BenchmarkAcquireChildPrefix10(b *testing.B) { benchmarkAcquireChildPrefix(16, 26, b) }
+func BenchmarkAcquireChildPrefixIPv6_48(b *testing.B) {
+	benchmarkAcquireChildPrefixFrom("2001:db8::/48", 64, b)
+}
+func BenchmarkAcquireChildPrefixIPv6_32(b *testing.B) {
+	benchmarkAcquireChildPrefixFrom("2001:db8::/32", 64, b)
+}
 
 func BenchmarkPrefixOverlapping(b *testing.B) {
 	ipam := New()
@@ -136,5 +309,3 @@ func BenchmarkPrefixOverlapping(b *testing.B) {
 		}
 	}
 }
-*/
-
@@ -1,10 +1,12 @@
 package ipam
 
 import (
+	"context"
 	"net"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
@@ -46,11 +48,11 @@ func TestIpamer_AcquireIP(t *testing.T) {
 			want: nil,
 		},
 		{
-			name: "Want next IP, but network is full",
+			name: "Want next IP, host route has no reserved ip",
 			fields: fields{
 				prefixCIDR: "192.168.4.0/32",
 			},
-			want: nil,
+			want: &IP{IP: net.ParseIP("192.168.4.0")},
 		},
 	}
 	for _, tt := range tests {
@@ -314,15 +316,19 @@ func TestIpamer_AcquireChildPrefix(t *testing.T) {
 
 		// different length
 		cp, err = ipam.AcquireChildPrefix(prefix.Cidr, 22, tenantid)
-		require.NotNil(t, err)
-		require.Equal(t, "given length:22 is not equal to existing child prefix length:21", err.Error())
-		require.Nil(t, cp)
+		require.Nil(t, err)
+		require.NotNil(t, cp)
+		require.True(t, strings.HasSuffix(cp.Cidr, "/22"))
 
 		// No more ChildPrefixes
 		cp, err = ipam.AcquireChildPrefix(prefix.Cidr, 21, tenantid)
+		require.NotNil(t, err)
+		require.Equal(t, "no more child prefixes contained in prefix pool", err.Error())
+		require.Nil(t, cp)
+		cp, err = ipam.AcquireChildPrefix(prefix.Cidr, 22, tenantid)
 		require.Nil(t, err)
 		require.NotNil(t, cp)
-		cp, err = ipam.AcquireChildPrefix(prefix.Cidr, 21,tenantid)
+		cp, err = ipam.AcquireChildPrefix(prefix.Cidr, 22,tenantid)
 		require.NotNil(t, err)
 		require.Equal(t, "no more child prefixes contained in prefix pool", err.Error())
 		require.Nil(t, cp)
@@ -361,6 +367,128 @@ func TestIpamer_AcquireChildPrefix(t *testing.T) {
 	})
 }
 
+func TestIpamer_AcquireChildPrefixVariableLength(t *testing.T) {
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		prefix, err := ipam.NewPrefix("10.1.0.0/16", tenantid)
+		require.Nil(t, err)
+
+		rack1, err := ipam.AcquireChildPrefix(prefix.Cidr, 24, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, "10.1.0.0/24", rack1.Cidr)
+		mgmt1, err := ipam.AcquireChildPrefix(prefix.Cidr, 28, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, "10.1.1.0/28", mgmt1.Cidr)
+		mgmt2, err := ipam.AcquireChildPrefix(prefix.Cidr, 28, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, "10.1.1.16/28", mgmt2.Cidr)
+		// the next /24 must be aligned and skip the /28s
+		rack2, err := ipam.AcquireChildPrefix(prefix.Cidr, 24, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, "10.1.2.0/24", rack2.Cidr)
+
+		prefix = ipam.PrefixFrom(prefix.Cidr, tenantid)
+		require.Equal(t, uint64(4), prefix.acquiredPrefixes())
+
+		// releasing a /28 frees exactly its block
+		err = ipam.ReleaseChildPrefix(mgmt1, tenantid)
+		require.Nil(t, err)
+		mgmt3, err := ipam.AcquireChildPrefix(prefix.Cidr, 28, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, "10.1.1.0/28", mgmt3.Cidr)
+
+		// releasing the /24 makes it available for smaller lengths
+		err = ipam.ReleaseChildPrefix(rack1, tenantid)
+		require.Nil(t, err)
+		c, err := ipam.AcquireChildPrefix(prefix.Cidr, 25, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, "10.1.0.0/25", c.Cidr)
+
+		// a released child can not be released twice
+		err = ipam.ReleaseChildPrefix(rack1, tenantid)
+		require.NotNil(t, err)
+
+		prefix = ipam.PrefixFrom(prefix.Cidr, tenantid)
+		require.Equal(t, uint64(4), prefix.acquiredPrefixes())
+	})
+}
+
+func TestIpamer_AvailablePrefixesOfVariableLength(t *testing.T) {
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		prefix, err := ipam.NewPrefix("10.2.0.0/24", tenantid)
+		require.Nil(t, err)
+		subnet, err := ipam.AcquireChildPrefix(prefix.Cidr, 26, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, uint64(4), ipam.PrefixFrom(prefix.Cidr, tenantid).Usage().AvailablePrefixes)
+
+		mgmt, err := ipam.AcquireChildPrefix(prefix.Cidr, 28, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, "10.2.0.64/28", mgmt.Cidr)
+		// the /26 and /28 and the eleven /28 in the remaining 176 addresses
+		usage := ipam.PrefixFrom(prefix.Cidr, tenantid).Usage()
+		require.Equal(t, uint64(2), usage.AcquiredPrefixes)
+		require.Equal(t, uint64(13), usage.AvailablePrefixes)
+
+		err = ipam.ReleaseChildPrefix(subnet, tenantid)
+		require.Nil(t, err)
+		usage = ipam.PrefixFrom(prefix.Cidr, tenantid).Usage()
+		require.Equal(t, uint64(1), usage.AcquiredPrefixes)
+		require.Equal(t, uint64(16), usage.AvailablePrefixes)
+	})
+}
+
+func TestIpamer_AcquireChildPrefixIPv6(t *testing.T) {
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		prefix, err := ipam.NewPrefix("2001:db8::/32", tenantid)
+		require.Nil(t, err)
+
+		c1, err := ipam.AcquireChildPrefix(prefix.Cidr, 64, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, "2001:db8::/64", c1.Cidr)
+		c2, err := ipam.AcquireChildPrefix(prefix.Cidr, 48, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, "2001:db8:1::/48", c2.Cidr)
+		c3, err := ipam.AcquireChildPrefix(prefix.Cidr, 64, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, "2001:db8:0:1::/64", c3.Cidr)
+
+		prefix = ipam.PrefixFrom(prefix.Cidr, tenantid)
+		require.Equal(t, uint64(3), prefix.acquiredPrefixes())
+		// the /64s which still fit next to the /48 and the acquired child prefixes
+		require.Equal(t, uint64(1)<<32-uint64(1)<<16+1, prefix.availablePrefixes())
+		require.Equal(t, 3, len(prefix.availableChildPrefixes))
+
+		err = ipam.ReleaseChildPrefix(c1, tenantid)
+		require.Nil(t, err)
+		c4, err := ipam.AcquireChildPrefix(prefix.Cidr, 56, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, "2001:db8:0:100::/56", c4.Cidr)
+	})
+}
+
+func TestPrefix_freeChildPrefixLegacyPool(t *testing.T) {
+	// earlier versions stored all possible child prefixes upfront
+	p := Prefix{
+		Cidr: "10.0.0.0/23",
+		availableChildPrefixes: map[string]bool{
+			"10.0.0.0/24": true,
+			"10.0.1.0/24": false,
+		},
+		childPrefixLength: 24,
+	}
+	ipnet, err := p.IPNet()
+	require.Nil(t, err)
+	start, _ := ipToInt(ipnet.IP)
+	free, err := p.freeChildPrefix(ipnet, 24, start)
+	require.Nil(t, err)
+	require.Equal(t, "10.0.0.0/24", free.String())
+	free, err = p.freeChildPrefix(ipnet, 23, start)
+	require.Nil(t, err)
+	require.Nil(t, free)
+
+	p.dropAvailableChildPrefixes()
+	require.Equal(t, map[string]bool{"10.0.1.0/24": false}, p.availableChildPrefixes)
+}
+
 func TestIpamer_AcquireChildPrefixNoDuplicatesUntilFull(t *testing.T) {
 
 	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
@@ -592,8 +720,8 @@ func TestIpamerAcquireIP(t *testing.T) {
 			panic(err)
 		}
 		for n := 0; n < 10; n++ {
-			if len(p.Ips) != 2 {
-				t.Fatalf("expected 2 ips in prefix, got %d", len(p.Ips))
+			if len(p.Ips) != 0 {
+				t.Fatalf("expected no ips in prefix, got %d", len(p.Ips))
 			}
 			ip, err := ipam.AcquireIP(p.Cidr,tenantid)
 			if err != nil {
@@ -657,6 +785,7 @@ func TestPrefixDeepCopy(t *testing.T) {
 		childPrefixLength:      256,
 		Ips:                    map[string]bool{},
 		version:                2,
+		reserved:               map[string]bool{"4.1.1.0": true, "4.1.1.255": true},
 	}
 
 	p1.availableChildPrefixes["4.1.2.0/24"] = true
@@ -669,4 +798,149 @@ func TestPrefixDeepCopy(t *testing.T) {
 	require.Equal(t, p1, p2)
 	require.False(t, &(p1.availableChildPrefixes) == &(p2.availableChildPrefixes))
 	require.False(t, &(p1.Ips) == &(p2.Ips))
+	require.False(t, &(p1.reserved) == &(p2.reserved))
+}
+
+func TestIpamer_AcquireIPContextCanceled(t *testing.T) {
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		prefix, err := ipam.NewPrefix("192.168.0.0/24", tenantid)
+		require.Nil(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		ip, err := ipam.AcquireIPContext(ctx, prefix.Cidr, tenantid)
+		require.Nil(t, ip)
+		require.True(t, errors.Is(err, context.Canceled), "error must be context.Canceled")
+
+		prefix = ipam.PrefixFrom(prefix.Cidr, tenantid)
+		require.Equal(t, uint64(2), prefix.acquiredips())
+	})
+}
+
+func TestRetryOnOptimisticLockStopsOnDoneContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	err := retryOnOptimisticLock(ctx, func() error {
+		attempts++
+		cancel()
+		return newOptimisticLockError("concurrent update")
+	})
+	require.NotNil(t, err)
+	require.Equal(t, 1, attempts)
+}
+
+func TestRetryOnOptimisticLockStopsWaitingOnDoneContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := retryOnOptimisticLock(ctx, func() error {
+		return newOptimisticLockError("concurrent update")
+	})
+	require.True(t, errors.Is(err, context.DeadlineExceeded), "error must be context.DeadlineExceeded")
+	// the shortest delay between two attempts is 50ms
+	require.True(t, time.Since(start) < 50*time.Millisecond, "delay must not be waited after the context is done")
+}
+
+func TestIpamer_ReadContextCanceled(t *testing.T) {
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		prefix, err := ipam.NewPrefix("192.168.0.0/24", tenantid)
+		require.Nil(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err = ipam.DescendantPrefixesContext(ctx, prefix.Cidr, tenantid)
+		require.True(t, errors.Is(err, context.Canceled), "error must be context.Canceled")
+		require.False(t, errors.Is(err, ErrNotFound))
+	})
+}
+
+func TestIpamer_AcquireChildPrefixStoredWithParent(t *testing.T) {
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		parent, err := ipam.NewPrefix("10.111.0.0/16", tenantid)
+		require.Nil(t, err)
+
+		child, err := ipam.AcquireChildPrefix(parent.Cidr, 24, tenantid)
+		require.Nil(t, err)
+		stored := ipam.PrefixFrom(child.Cidr, tenantid)
+		require.NotNil(t, stored)
+		require.Equal(t, parent.Cidr, stored.ParentCidr)
+		require.Equal(t, map[string]bool{child.Cidr: false}, ipam.PrefixFrom(parent.Cidr, tenantid).availableChildPrefixes)
+
+		// a prefix in the place of the next child leaves the parent unchanged
+		_, err = ipam.NewPrefix("10.111.1.0/24", tenantid)
+		require.Nil(t, err)
+		_, err = ipam.AcquireChildPrefix(parent.Cidr, 24, tenantid)
+		require.EqualError(t, err, "child prefix:10.111.1.0/24 of prefix:10.111.0.0/16 already exists")
+		require.Len(t, ipam.PrefixFrom(parent.Cidr, tenantid).availableChildPrefixes, 1)
+
+		// a child with ips is neither deleted nor released from its parent
+		_, err = ipam.AcquireIP(child.Cidr, tenantid)
+		require.Nil(t, err)
+		err = ipam.ReleaseChildPrefix(child, tenantid)
+		require.EqualError(t, err, "prefix 10.111.0.0/24 has ips, deletion not possible")
+		require.NotNil(t, ipam.PrefixFrom(child.Cidr, tenantid))
+		require.Len(t, ipam.PrefixFrom(parent.Cidr, tenantid).availableChildPrefixes, 1)
+
+		err = ipam.ReleaseIPFromPrefix(child.Cidr, "10.111.0.1", tenantid)
+		require.Nil(t, err)
+		err = ipam.ReleaseChildPrefix(child, tenantid)
+		require.Nil(t, err)
+		require.Nil(t, ipam.PrefixFrom(child.Cidr, tenantid))
+		require.Empty(t, ipam.PrefixFrom(parent.Cidr, tenantid).availableChildPrefixes)
+	})
+}
+
+func TestIpamer_AdoptLeftOverChildPrefix(t *testing.T) {
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		parent, err := ipam.NewPrefix("10.112.0.0/16", tenantid)
+		require.Nil(t, err)
+		first, err := ipam.AcquireChildPrefix(parent.Cidr, 24, tenantid)
+		require.Nil(t, err)
+		second, err := ipam.AcquireChildPrefix(parent.Cidr, 24, tenantid)
+		require.Nil(t, err)
+		_, err = ipam.AcquireIP(second.Cidr, tenantid)
+		require.Nil(t, err)
+
+		// children which were stored without being marked in the parent
+		stored, err := ipam.storage.ReadPrefix(parent.Cidr, tenantid)
+		require.Nil(t, err)
+		stored.availableChildPrefixes = map[string]bool{}
+		_, err = ipam.storage.UpdatePrefix(stored, tenantid)
+		require.Nil(t, err)
+
+		// an unused child is acquired again
+		adopted, err := ipam.AcquireChildPrefix(parent.Cidr, 24, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, first.Cidr, adopted.Cidr)
+		require.Equal(t, map[string]bool{first.Cidr: false}, ipam.PrefixFrom(parent.Cidr, tenantid).availableChildPrefixes)
+
+		// a child in use is left to a repair
+		_, err = ipam.AcquireChildPrefix(parent.Cidr, 24, tenantid)
+		require.EqualError(t, err, "child prefix:10.112.1.0/24 is in use but not marked as acquired by prefix:10.112.0.0/16, Check can repair it")
+		require.Len(t, ipam.PrefixFrom(parent.Cidr, tenantid).availableChildPrefixes, 1)
+	})
+}
+
+// singlePrefixStorage is a Storage which can not modify several prefixes together.
+type singlePrefixStorage struct {
+	Storage
+}
+
+func TestIpamer_ChildPrefixWithoutMultiPrefixStorage(t *testing.T) {
+	storage := NewMemory()
+	ipam := &ipamer{storage: &singlePrefixStorage{Storage: storage}}
+	parent, err := ipam.NewPrefix("10.113.0.0/16", tenantid)
+	require.Nil(t, err)
+
+	_, err = ipam.AcquireChildPrefix(parent.Cidr, 24, tenantid)
+	require.True(t, errors.Is(err, ErrNotAtomic), "error must be ErrNotAtomic")
+	require.Nil(t, ipam.PrefixFrom("10.113.0.0/24", tenantid))
+	require.Empty(t, ipam.PrefixFrom(parent.Cidr, tenantid).availableChildPrefixes)
+
+	child, err := (&ipamer{storage: storage}).AcquireChildPrefix(parent.Cidr, 24, tenantid)
+	require.Nil(t, err)
+	err = ipam.ReleaseChildPrefix(child, tenantid)
+	require.True(t, errors.Is(err, ErrNotAtomic), "error must be ErrNotAtomic")
+	require.NotNil(t, ipam.PrefixFrom(child.Cidr, tenantid))
+	require.Equal(t, map[string]bool{child.Cidr: false}, ipam.PrefixFrom(parent.Cidr, tenantid).availableChildPrefixes)
 }
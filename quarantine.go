@@ -0,0 +1,89 @@
+package ipam
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// WithReleaseQuarantine keeps released ips of the prefix quarantined for the given duration,
+// AcquireIP and AcquireSpecificIP do not hand them out again before the quarantine ended.
+// This reduces collisions with stale DNS records, ARP caches or firewall rules of the previous holder.
+func WithReleaseQuarantine(d time.Duration) PrefixOption {
+	return func(p *Prefix) error {
+		if d < 0 {
+			return fmt.Errorf("quarantine duration:%s must not be negative", d)
+		}
+		p.quarantine = d
+		return nil
+	}
+}
+
+// quarantineIP quarantines the released ip if the prefix has a quarantine duration,
+// it returns false if the ip is not quarantined.
+func (p *Prefix) quarantineIP(ip string, now time.Time) bool {
+	if p.quarantine <= 0 {
+		return false
+	}
+	if p.quarantined == nil {
+		p.quarantined = make(map[string]time.Time)
+	}
+	p.quarantined[ip] = now.Add(p.quarantine).UTC().Truncate(time.Microsecond)
+	return true
+}
+
+// endQuarantine makes the quarantined ips whose quarantine ended before now free again.
+func (p *Prefix) endQuarantine(now time.Time) error {
+	for ip, until := range p.quarantined {
+		if until.After(now) {
+			continue
+		}
+		delete(p.quarantined, ip)
+		if p.freeRanges == nil || p.used(ip) {
+			continue
+		}
+		i, err := ipStringToInt(ip)
+		if err != nil {
+			return err
+		}
+		if !p.excluded(i) {
+			p.addFree(i)
+		}
+	}
+	return nil
+}
+
+// quarantinedIPs returns the quarantined ips of the prefix as set.
+func (p *Prefix) quarantinedIPs() map[string]bool {
+	result := make(map[string]bool, len(p.quarantined))
+	for ip := range p.quarantined {
+		result[ip] = true
+	}
+	return result
+}
+
+// QuarantinedIPs returns the released ips of the prefix which are quarantined ordered by address.
+// The quarantine of some of them may have ended already, they are freed on the next acquisition.
+func (p *Prefix) QuarantinedIPs() []string {
+	result := make([]string, 0, len(p.quarantined))
+	for ip := range p.quarantined {
+		result = append(result, ip)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, _ := ipStringToInt(result[i])
+		b, _ := ipStringToInt(result[j])
+		return a.Cmp(b) < 0
+	})
+	return result
+}
+
+func copyTimes(m map[string]time.Time) map[string]time.Time {
+	if m == nil {
+		return nil
+	}
+	result := make(map[string]time.Time, len(m))
+	for k, v := range m {
+		result[k] = v
+	}
+	return result
+}
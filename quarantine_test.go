@@ -0,0 +1,120 @@
+package ipam
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIpamer_ReleaseQuarantine(t *testing.T) {
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+		ipam.clock = func() time.Time { return now }
+
+		p, err := ipam.NewPrefix("10.70.0.0/30", tenantid, WithReservedIPs(), WithReleaseQuarantine(time.Hour))
+		require.Nil(t, err)
+		for _, expected := range []string{"10.70.0.0", "10.70.0.1", "10.70.0.2"} {
+			ip, err := ipam.AcquireIP(p.Cidr, tenantid)
+			require.Nil(t, err)
+			require.Equal(t, expected, ip.IP.String())
+		}
+		err = ipam.ReleaseIPFromPrefix(p.Cidr, "10.70.0.0", tenantid)
+		require.Nil(t, err)
+		err = ipam.ReleaseIPFromPrefix(p.Cidr, "10.70.0.1", tenantid)
+		require.Nil(t, err)
+
+		p = ipam.PrefixFrom(p.Cidr, tenantid)
+		require.Equal(t, []string{"10.70.0.0", "10.70.0.1"}, p.QuarantinedIPs())
+		require.Equal(t, uint64(2), p.Usage().QuarantinedIPs)
+		require.Equal(t, map[string]bool{"10.70.0.2": true}, p.Ips)
+
+		// released ips are not handed out again during their quarantine
+		ip, err := ipam.AcquireIP(p.Cidr, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, "10.70.0.3", ip.IP.String())
+		_, err = ipam.AcquireIP(p.Cidr, tenantid)
+		require.True(t, errors.Is(err, ErrNoIPAvailable))
+		_, err = ipam.AcquireSpecificIP(p.Cidr, "10.70.0.1", tenantid)
+		require.True(t, errors.Is(err, ErrIPinUse))
+		require.EqualError(t, err, "IPinUseError: requested ip: 10.70.0.1, is quarantined until 2020-01-01T13:00:00Z")
+
+		// the quarantine ends after its duration
+		now = now.Add(time.Hour)
+		ip, err = ipam.AcquireSpecificIP(p.Cidr, "10.70.0.1", tenantid)
+		require.Nil(t, err)
+		require.Equal(t, "10.70.0.1", ip.IP.String())
+		ip, err = ipam.AcquireIP(p.Cidr, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, "10.70.0.0", ip.IP.String())
+		require.Empty(t, ipam.PrefixFrom(p.Cidr, tenantid).QuarantinedIPs())
+
+		// expired leases are quarantined as well
+		err = ipam.ReleaseIPFromPrefix(p.Cidr, "10.70.0.3", tenantid)
+		require.Nil(t, err)
+		now = now.Add(time.Hour)
+		ip, err = ipam.AcquireIP(p.Cidr, tenantid, WithLease(time.Minute))
+		require.Nil(t, err)
+		require.Equal(t, "10.70.0.3", ip.IP.String())
+		now = now.Add(time.Minute)
+		_, err = ipam.ReleaseExpiredLeases(tenantid)
+		require.Nil(t, err)
+		require.Equal(t, []string{"10.70.0.3"}, ipam.PrefixFrom(p.Cidr, tenantid).QuarantinedIPs())
+
+		// a prefix with only quarantined ips can be deleted
+		for _, ip := range []string{"10.70.0.0", "10.70.0.1", "10.70.0.2"} {
+			err = ipam.ReleaseIPFromPrefix(p.Cidr, ip, tenantid)
+			require.Nil(t, err)
+		}
+		_, err = ipam.DeletePrefix(p.Cidr, tenantid)
+		require.Nil(t, err)
+
+		_, err = ipam.NewPrefix("10.71.0.0/24", tenantid, WithReleaseQuarantine(-time.Second))
+		require.EqualError(t, err, "quarantine duration:-1s must not be negative")
+	})
+}
+
+func TestIpamer_ReleaseWithoutQuarantine(t *testing.T) {
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		p, err := ipam.NewPrefix("10.72.0.0/24", tenantid)
+		require.Nil(t, err)
+		ip, err := ipam.AcquireIP(p.Cidr, tenantid)
+		require.Nil(t, err)
+		_, err = ipam.ReleaseIP(ip, tenantid)
+		require.Nil(t, err)
+		again, err := ipam.AcquireIP(p.Cidr, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, ip.IP.String(), again.IP.String())
+		require.Empty(t, ipam.PrefixFrom(p.Cidr, tenantid).QuarantinedIPs())
+	})
+}
+
+func Test_sql_Quarantine(t *testing.T) {
+	testWithSQLBackends(t, func(t *testing.T, db *sql) {
+		now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+		ipam := &ipamer{}
+		p, err := ipam.newPrefix("10.73.0.0/24", WithReleaseQuarantine(time.Hour))
+		require.Nil(t, err)
+		created, err := db.CreatePrefix(*p, tenantid)
+		require.Nil(t, err)
+		created.Ips["10.73.0.1"] = true
+		updated, err := db.UpdatePrefix(created, tenantid)
+		require.Nil(t, err)
+		err = updated.release("10.73.0.1", now)
+		require.Nil(t, err)
+		_, err = db.UpdatePrefix(updated, tenantid)
+		require.Nil(t, err)
+
+		var states []string
+		err = db.db.Select(&states, "SELECT state FROM ips WHERE tenantid=$1 AND prefix=$2", tenantid, p.Cidr)
+		require.Nil(t, err)
+		require.Equal(t, []string{ipStateQuarantined}, states)
+
+		read, err := db.ReadPrefix(p.Cidr, tenantid)
+		require.Nil(t, err)
+		require.Empty(t, read.Ips)
+		require.Equal(t, time.Hour, read.quarantine)
+		require.Equal(t, map[string]time.Time{"10.73.0.1": now.Add(time.Hour)}, read.quarantined)
+	})
+}
@@ -0,0 +1,202 @@
+package ipam
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	goredis "github.com/go-redis/redis"
+	"github.com/pkg/errors"
+)
+
+// redis stores prefixes in one hash per tenant, the fields are the cidrs
+// and the values the json serialized prefixes.
+type redis struct {
+	client *goredis.Client
+}
+
+// NewRedisStorage creates a new Storage which uses redis at the given address.
+func NewRedisStorage(addr, password string, db int) (*redis, error) {
+	client := goredis.NewClient(&goredis.Options{
+		Addr:     addr,
+		Password: password,
+		DB:       db,
+	})
+	err := client.Ping().Err()
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to redis:%v", err)
+	}
+	return &redis{
+		client: client,
+	}, nil
+}
+
+// Close closes the connection to redis.
+func (r *redis) Close() error {
+	return r.client.Close()
+}
+
+func tenantKey(tenantid string) string {
+	return "ipam:prefixes:" + tenantid
+}
+
+func (r *redis) CreatePrefix(prefix Prefix, tenantid string) (Prefix, error) {
+	prefix.version = int64(0)
+	pj, err := json.Marshal(prefix.toPrefixJSON())
+	if err != nil {
+		return Prefix{}, fmt.Errorf("unable to marshal prefix:%v", err)
+	}
+	created, err := r.client.HSetNX(tenantKey(tenantid), prefix.Cidr, pj).Result()
+	if err != nil {
+		return Prefix{}, fmt.Errorf("unable to create prefix:%v", err)
+	}
+	if !created {
+		return r.ReadPrefix(prefix.Cidr, tenantid)
+	}
+	return prefix, nil
+}
+
+func (r *redis) ReadPrefix(prefix string, tenantid string) (Prefix, error) {
+	value, err := r.client.HGet(tenantKey(tenantid), prefix).Bytes()
+	if err == goredis.Nil {
+		return Prefix{}, errors.Errorf("Prefix %s not found", prefix)
+	}
+	if err != nil {
+		return Prefix{}, fmt.Errorf("unable to read prefix:%v", err)
+	}
+	return unmarshalPrefix(value)
+}
+
+func (r *redis) ReadAllPrefixes(tenantid string) ([]Prefix, error) {
+	values, err := r.client.HVals(tenantKey(tenantid)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read prefixes:%v", err)
+	}
+	result := []Prefix{}
+	for _, v := range values {
+		p, err := unmarshalPrefix([]byte(v))
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, p)
+	}
+	return result, nil
+}
+
+// UpdatePrefix tries to update the prefix.
+// Returns OptimisticLockError if it does not succeed due to a concurrent update.
+func (r *redis) UpdatePrefix(prefix Prefix, tenantid string) (Prefix, error) {
+	oldVersion := prefix.version
+	prefix.version = oldVersion + 1
+	pn, err := json.Marshal(prefix.toPrefixJSON())
+	if err != nil {
+		return Prefix{}, fmt.Errorf("unable to marshal prefix:%v", err)
+	}
+	key := tenantKey(tenantid)
+	err = r.client.Watch(func(tx *goredis.Tx) error {
+		value, err := tx.HGet(key, prefix.Cidr).Bytes()
+		if err == goredis.Nil {
+			return fmt.Errorf("prefix not found:%s", prefix.Cidr)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read prefix:%v", err)
+		}
+		existing, err := unmarshalPrefix(value)
+		if err != nil {
+			return err
+		}
+		if existing.version != oldVersion {
+			return newOptimisticLockError(fmt.Sprintf("prefix %s has version %d, expected %d", prefix.Cidr, existing.version, oldVersion))
+		}
+		_, err = tx.TxPipelined(func(pipe goredis.Pipeliner) error {
+			pipe.HSet(key, prefix.Cidr, pn)
+			return nil
+		})
+		return err
+	}, key)
+	if err == goredis.TxFailedErr {
+		return Prefix{}, newOptimisticLockError("prefixes of tenant " + tenantid + " were modified concurrently")
+	}
+	if err != nil {
+		return Prefix{}, err
+	}
+	return prefix, nil
+}
+
+func (r *redis) DeletePrefix(prefix Prefix, tenantid string) (Prefix, error) {
+	err := r.client.HDel(tenantKey(tenantid), prefix.Cidr).Err()
+	if err != nil {
+		return Prefix{}, fmt.Errorf("unable to delete prefix:%v", err)
+	}
+	return prefix, nil
+}
+
+// ApplyChanges applies the changes of a transaction in a single MULTI/EXEC block,
+// the hashes of all involved tenants are watched for concurrent modifications.
+func (r *redis) ApplyChanges(ctx context.Context, changes []PrefixChange) error {
+	// the redis client does not abort commands when the context is done
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var keys []string
+	seen := make(map[string]bool)
+	for _, c := range changes {
+		key := tenantKey(c.Tenantid)
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	values := make([][]byte, len(changes))
+	for n, c := range changes {
+		if c.Op == ChangeDelete {
+			continue
+		}
+		prefix := c.Prefix
+		if c.Op == ChangeCreate {
+			prefix.version = int64(0)
+		} else {
+			prefix.version++
+		}
+		pj, err := json.Marshal(prefix.toPrefixJSON())
+		if err != nil {
+			return fmt.Errorf("unable to marshal prefix:%v", err)
+		}
+		values[n] = pj
+	}
+	err := r.client.Watch(func(tx *goredis.Tx) error {
+		for _, c := range changes {
+			var stored *Prefix
+			value, err := tx.HGet(tenantKey(c.Tenantid), c.Prefix.Cidr).Bytes()
+			if err != nil && err != goredis.Nil {
+				return fmt.Errorf("unable to read prefix:%v", err)
+			}
+			if err == nil {
+				existing, err := unmarshalPrefix(value)
+				if err != nil {
+					return err
+				}
+				stored = &existing
+			}
+			err = c.Conflict(stored)
+			if err != nil {
+				return err
+			}
+		}
+		_, err := tx.TxPipelined(func(pipe goredis.Pipeliner) error {
+			for n, c := range changes {
+				if c.Op == ChangeDelete {
+					pipe.HDel(tenantKey(c.Tenantid), c.Prefix.Cidr)
+					continue
+				}
+				pipe.HSet(tenantKey(c.Tenantid), c.Prefix.Cidr, values[n])
+			}
+			return nil
+		})
+		return err
+	}, keys...)
+	if err == goredis.TxFailedErr {
+		return newOptimisticLockError("prefixes were modified concurrently")
+	}
+	return err
+}
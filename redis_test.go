@@ -0,0 +1,77 @@
+package ipam
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_redis_UpdatePrefix_OptimisticLock(t *testing.T) {
+	r, err := startRedis()
+	require.Nil(t, err)
+	require.Nil(t, r.cleanup())
+
+	prefix := Prefix{Cidr: "13.0.0.0/16"}
+	_, err = r.CreatePrefix(prefix, tenantid)
+	require.Nil(t, err)
+
+	p1, err := r.ReadPrefix(prefix.Cidr, tenantid)
+	require.Nil(t, err)
+	p2, err := r.ReadPrefix(prefix.Cidr, tenantid)
+	require.Nil(t, err)
+
+	p1.ParentCidr = "13.0.0.0/8"
+	_, err = r.UpdatePrefix(p1, tenantid)
+	require.Nil(t, err)
+
+	// p2 was read before p1 was updated
+	p2.ParentCidr = "13.0.0.0/12"
+	_, err = r.UpdatePrefix(p2, tenantid)
+	require.NotNil(t, err)
+	_, isOptimisticLock := errors.Cause(err).(OptimisticLockError)
+	require.True(t, isOptimisticLock, "error must be of type OptimisticLockError")
+
+	p, err := r.ReadPrefix(prefix.Cidr, tenantid)
+	require.Nil(t, err)
+	require.Equal(t, "13.0.0.0/8", p.ParentCidr)
+
+	// Not existing Prefix
+	_, err = r.UpdatePrefix(Prefix{Cidr: "1.2.3.4/24"}, tenantid)
+	require.NotNil(t, err)
+	require.Equal(t, "prefix not found:1.2.3.4/24", err.Error())
+}
+
+func Test_redis_ConcurrentAcquireIP(t *testing.T) {
+	r, err := startRedis()
+	require.Nil(t, err)
+	require.Nil(t, r.cleanup())
+
+	ipamer := NewWithStorage(r)
+	const parentCidr = "2.7.0.0/16"
+	_, err = ipamer.NewPrefix(parentCidr, tenantid)
+	require.Nil(t, err)
+
+	count := 30
+	var wg sync.WaitGroup
+	ips := make(chan string, count)
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ip, err := ipamer.AcquireIP(parentCidr, tenantid)
+			require.Nil(t, err)
+			ips <- ip.IP.String()
+		}()
+	}
+	wg.Wait()
+	close(ips)
+
+	ipMap := make(map[string]bool)
+	for ip := range ips {
+		require.False(t, ipMap[ip], "ip:%s already acquired", ip)
+		ipMap[ip] = true
+	}
+	require.Equal(t, count, len(ipMap))
+}
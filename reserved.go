@@ -0,0 +1,151 @@
+package ipam
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+)
+
+// Reservation returns addresses of a prefix which are reserved on creation of the prefix.
+// Reserved addresses are stored apart from the acquired ips and are never acquired or released.
+type Reservation func(ipnet *net.IPNet) ([]net.IP, error)
+
+// WithReservedIPs replaces the default reservation of the prefix with the given reservations,
+// without reservations no address of the prefix is reserved.
+// By default the network and broadcast address of IPv4 prefixes up to /30 and the subnet-router anycast
+// address of IPv6 prefixes up to /126 are reserved, no address of smaller prefixes is reserved.
+func WithReservedIPs(reservations ...Reservation) PrefixOption {
+	return func(p *Prefix) error {
+		ipnet, err := p.IPNet()
+		if err != nil {
+			return err
+		}
+		p.reserved = make(map[string]bool)
+		for _, r := range reservations {
+			ips, err := r(ipnet)
+			if err != nil {
+				return err
+			}
+			for _, ip := range ips {
+				p.reserved[ip.String()] = true
+			}
+		}
+		return nil
+	}
+}
+
+// ReserveNetworkAndBroadcast reserves the first and the last address of the prefix.
+func ReserveNetworkAndBroadcast() Reservation {
+	return func(ipnet *net.IPNet) ([]net.IP, error) {
+		start, bits := ipToInt(ipnet.IP)
+		ones, _ := ipnet.Mask.Size()
+		last := new(big.Int).Add(start, blockSize(bits, ones))
+		last.Sub(last, big.NewInt(1))
+		return []net.IP{intToIP(start, bits), intToIP(last, bits)}, nil
+	}
+}
+
+// ReserveFirst reserves the n addresses behind the network address, e.g. for gateways.
+func ReserveFirst(n int) Reservation {
+	return func(ipnet *net.IPNet) ([]net.IP, error) {
+		start, bits := ipToInt(ipnet.IP)
+		ones, _ := ipnet.Mask.Size()
+		if n < 0 || big.NewInt(int64(n)).Cmp(blockSize(bits, ones)) >= 0 {
+			return nil, fmt.Errorf("unable to reserve the first %d ips of %s", n, ipnet)
+		}
+		ips := make([]net.IP, 0, n)
+		ip := new(big.Int).Set(start)
+		for i := 0; i < n; i++ {
+			ip.Add(ip, big.NewInt(1))
+			ips = append(ips, intToIP(ip, bits))
+		}
+		return ips, nil
+	}
+}
+
+// ReserveIPs reserves the given addresses, each must be contained in the prefix.
+func ReserveIPs(ips ...string) Reservation {
+	return func(ipnet *net.IPNet) ([]net.IP, error) {
+		result := make([]net.IP, 0, len(ips))
+		for _, s := range ips {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("given ip:%s in not valid", s)
+			}
+			if !ipnet.Contains(ip) {
+				return nil, fmt.Errorf("given ip:%s is not in %s", s, ipnet)
+			}
+			result = append(result, ip)
+		}
+		return result, nil
+	}
+}
+
+// ReserveSubnetRouterAnycast reserves the subnet-router anycast address of an IPv6 prefix,
+// which is the first address of the prefix.
+func ReserveSubnetRouterAnycast() Reservation {
+	return func(ipnet *net.IPNet) ([]net.IP, error) {
+		if ipnet.IP.To4() != nil {
+			return nil, fmt.Errorf("subnet-router anycast address is only defined for IPv6, not for %s", ipnet)
+		}
+		return []net.IP{ipnet.IP}, nil
+	}
+}
+
+// defaultReservation returns the reservation of prefixes created without WithReservedIPs.
+// Point-to-point links (RFC 3021, RFC 6164) and host routes have no reserved addresses.
+func defaultReservation(ipnet *net.IPNet) Reservation {
+	ones, bits := ipnet.Mask.Size()
+	switch {
+	case bits == 32 && ones < 31:
+		return ReserveNetworkAndBroadcast()
+	case bits == 128 && ones < 127:
+		return ReserveSubnetRouterAnycast()
+	}
+	return func(*net.IPNet) ([]net.IP, error) {
+		return nil, nil
+	}
+}
+
+// legacyReserved returns the addresses which earlier versions stored as acquired ips on creation of the prefix.
+func legacyReserved(cidr string) map[string]bool {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil
+	}
+	ips, _ := ReserveNetworkAndBroadcast()(ipnet)
+	reserved := make(map[string]bool)
+	for _, ip := range ips {
+		reserved[ip.String()] = true
+	}
+	return reserved
+}
+
+// ReservedIPs returns the reserved addresses of the prefix ordered by address.
+func (p *Prefix) ReservedIPs() []string {
+	result := make([]string, 0, len(p.reserved))
+	for ip := range p.reserved {
+		result = append(result, ip)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, _ := ipStringToInt(result[i])
+		b, _ := ipStringToInt(result[j])
+		return a.Cmp(b) < 0
+	})
+	return result
+}
+
+// dropReservedIPs removes reserved addresses from the acquired ips.
+func (p *Prefix) dropReservedIPs() {
+	for ip := range p.reserved {
+		delete(p.Ips, ip)
+	}
+}
+
+// used returns true if the ip is acquired, reserved or quarantined.
+func (p *Prefix) used(ip string) bool {
+	_, acquired := p.Ips[ip]
+	_, quarantined := p.quarantined[ip]
+	return acquired || p.reserved[ip] || quarantined
+}
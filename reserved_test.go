@@ -0,0 +1,123 @@
+package ipam
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIpamer_NewPrefixDefaultReservation(t *testing.T) {
+	tests := []struct {
+		cidr     string
+		reserved []string
+		first    string
+	}{
+		{cidr: "10.20.0.0/24", reserved: []string{"10.20.0.0", "10.20.0.255"}, first: "10.20.0.1"},
+		{cidr: "10.20.1.0/31", reserved: []string{}, first: "10.20.1.0"},
+		{cidr: "10.20.2.1/32", reserved: []string{}, first: "10.20.2.1"},
+		{cidr: "2001:db8:20::/64", reserved: []string{"2001:db8:20::"}, first: "2001:db8:20::1"},
+		{cidr: "2001:db8:21::/127", reserved: []string{}, first: "2001:db8:21::"},
+		{cidr: "2001:db8:22::1/128", reserved: []string{}, first: "2001:db8:22::1"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+			p, err := ipam.NewPrefix(tt.cidr, tenantid)
+			require.Nil(t, err)
+			p = ipam.PrefixFrom(p.Cidr, tenantid)
+			require.Equal(t, tt.reserved, p.ReservedIPs())
+			require.Empty(t, p.Ips)
+
+			ip, err := ipam.AcquireIP(p.Cidr, tenantid)
+			require.Nil(t, err)
+			require.Equal(t, tt.first, ip.IP.String())
+		})
+	}
+}
+
+func TestIpamer_NewPrefixWithReservedIPs(t *testing.T) {
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		p, err := ipam.NewPrefix("10.21.0.0/29", tenantid, WithReservedIPs(ReserveNetworkAndBroadcast(), ReserveFirst(2), ReserveIPs("10.21.0.5")))
+		require.Nil(t, err)
+		require.Equal(t, []string{"10.21.0.0", "10.21.0.1", "10.21.0.2", "10.21.0.5", "10.21.0.7"}, p.ReservedIPs())
+		require.Equal(t, uint64(5), p.Usage().ReservedIPs)
+		require.Equal(t, uint64(5), p.Usage().AcquiredIPs)
+
+		_, err = ipam.AcquireSpecificIP(p.Cidr, "10.21.0.5", tenantid)
+		require.True(t, errors.Is(err, ErrIPinUse))
+		err = ipam.ReleaseIPFromPrefix(p.Cidr, "10.21.0.1", tenantid)
+		require.True(t, errors.Is(err, ErrNotFound))
+
+		for _, expected := range []string{"10.21.0.3", "10.21.0.4", "10.21.0.6"} {
+			ip, err := ipam.AcquireIP(p.Cidr, tenantid)
+			require.Nil(t, err)
+			require.Equal(t, expected, ip.IP.String())
+		}
+		_, err = ipam.AcquireIP(p.Cidr, tenantid)
+		require.True(t, errors.Is(err, ErrNoIPAvailable))
+
+		// without reservations every ip can be acquired
+		p, err = ipam.NewPrefix("10.21.1.0/30", tenantid, WithReservedIPs())
+		require.Nil(t, err)
+		require.Empty(t, p.ReservedIPs())
+		ip, err := ipam.AcquireIP(p.Cidr, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, "10.21.1.0", ip.IP.String())
+
+		// a prefix with only reserved ips can be deleted
+		p, err = ipam.NewPrefix("2001:db8:23::/64", tenantid, WithReservedIPs(ReserveSubnetRouterAnycast(), ReserveFirst(3)))
+		require.Nil(t, err)
+		require.Equal(t, []string{"2001:db8:23::", "2001:db8:23::1", "2001:db8:23::2", "2001:db8:23::3"}, p.ReservedIPs())
+		_, err = ipam.DeletePrefix(p.Cidr, tenantid)
+		require.Nil(t, err)
+	})
+}
+
+func TestIpamer_NewPrefixInvalidReservation(t *testing.T) {
+	ipam := New()
+	_, err := ipam.NewPrefix("10.22.0.0/24", tenantid, WithReservedIPs(ReserveSubnetRouterAnycast()))
+	require.EqualError(t, err, "subnet-router anycast address is only defined for IPv6, not for 10.22.0.0/24")
+	_, err = ipam.NewPrefix("10.22.0.0/24", tenantid, WithReservedIPs(ReserveIPs("10.23.0.1")))
+	require.EqualError(t, err, "given ip:10.23.0.1 is not in 10.22.0.0/24")
+	_, err = ipam.NewPrefix("10.22.0.0/30", tenantid, WithReservedIPs(ReserveFirst(4)))
+	require.EqualError(t, err, "unable to reserve the first 4 ips of 10.22.0.0/30")
+	require.Nil(t, ipam.PrefixFrom("10.22.0.0/24", tenantid))
+}
+
+// earlier versions stored the network and broadcast address as ips
+func Test_unmarshalPrefixLegacyReserved(t *testing.T) {
+	p, err := unmarshalPrefix([]byte(`{"Cidr":"10.24.0.0/24","IPs":{"10.24.0.0":true,"10.24.0.1":true,"10.24.0.255":true}}`))
+	require.Nil(t, err)
+	require.Equal(t, []string{"10.24.0.0", "10.24.0.255"}, p.ReservedIPs())
+	require.Equal(t, map[string]bool{"10.24.0.1": true}, p.Ips)
+
+	p, err = unmarshalPrefix([]byte(`{"Cidr":"10.24.0.0/24","IPs":{"10.24.0.1":true},"Reserved":[]}`))
+	require.Nil(t, err)
+	require.Empty(t, p.ReservedIPs())
+	require.Equal(t, map[string]bool{"10.24.0.1": true}, p.Ips)
+}
+
+func Test_sql_LegacyReserved(t *testing.T) {
+	testWithSQLBackends(t, func(t *testing.T, db *sql) {
+		_, err := db.db.Exec("INSERT INTO prefixes (cidr, prefix, tenantid) VALUES ($1, $2, $3)", "10.25.0.0/24", `{"Cidr":"10.25.0.0/24","Version":0}`, tenantid)
+		require.Nil(t, err)
+		for _, ip := range []string{"10.25.0.0", "10.25.0.1", "10.25.0.255"} {
+			_, err = db.db.Exec("INSERT INTO ips (tenantid, prefix, ip, state) VALUES ($1, $2, $3, $4)", tenantid, "10.25.0.0/24", ip, ipStateAcquired)
+			require.Nil(t, err)
+		}
+
+		p, err := db.ReadPrefix("10.25.0.0/24", tenantid)
+		require.Nil(t, err)
+		require.Equal(t, []string{"10.25.0.0", "10.25.0.255"}, p.ReservedIPs())
+		require.Equal(t, map[string]bool{"10.25.0.1": true}, p.Ips)
+
+		// the reserved ips are removed from the ips table on the next update
+		_, err = db.UpdatePrefix(p, tenantid)
+		require.Nil(t, err)
+		var ips []string
+		err = db.db.Select(&ips, "SELECT ip FROM ips WHERE tenantid=$1 AND prefix=$2", tenantid, p.Cidr)
+		require.Nil(t, err)
+		require.Equal(t, []string{"10.25.0.1"}, ips)
+	})
+}
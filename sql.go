@@ -1,50 +1,421 @@
 package ipam
 
 import (
+	"context"
+	dbsql "database/sql"
 	"encoding/json"
 	"fmt"
+	"math/big"
+	"net"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	sqlite3 "github.com/mattn/go-sqlite3"
 )
 
+// dialect distinguishes the sql databases which differ in their json and locking support.
+type dialect int
+
+const (
+	dialectPostgres dialect = iota
+	dialectSQLite
+)
+
+// jsonField returns the expression which extracts the given top level field of the prefix json.
+func (d dialect) jsonField(name string) string {
+	return d.jsonColumnField("prefix", name)
+}
+
+// jsonColumnField returns the expression which extracts the given top level field of the json in the column.
+func (d dialect) jsonColumnField(column, name string) string {
+	if d == dialectSQLite {
+		return fmt.Sprintf("json_extract(%s, '$.%s')", column, name)
+	}
+	return fmt.Sprintf("%s->>'%s'", column, name)
+}
+
+// versionCondition returns the where condition which matches the Version stored in the prefix json
+// against the query parameter with the given index.
+func (d dialect) versionCondition(param int) string {
+	return fmt.Sprintf("%s=$%d", d.jsonField("Version"), param)
+}
+
+const (
+	// ipStateAcquired is the state of an ip row in the ips table which is in use.
+	ipStateAcquired = "acquired"
+	// ipStateQuarantined is the state of an ip row in the ips table which was released and is quarantined,
+	// the expires column holds the end of the quarantine.
+	ipStateQuarantined = "quarantined"
+)
+
+// insertBatchSize is the number of rows inserted with a single statement.
+const insertBatchSize = 100
+
 type sql struct {
-	db *sqlx.DB
+	db      *sqlx.DB
+	ownsDB  bool // the pool was opened by the storage and is closed by Close
+	dialect dialect
+	schema  string
+	tables  *strings.Replacer
+}
+
+// SQLOption configures a sql storage.
+type SQLOption func(*sqlOptions)
+
+type sqlOptions struct {
+	driverName      string
+	maxOpenConns    int
+	maxIdleConns    int
+	connMaxLifetime time.Duration
+	schema          string
+	tablePrefix     string
+}
+
+// WithDriverName sets the name of the database/sql driver used to open a DSN, default is "postgres".
+func WithDriverName(name string) SQLOption {
+	return func(o *sqlOptions) {
+		o.driverName = name
+	}
+}
+
+// WithMaxOpenConns sets the maximum number of open connections of the pool opened by the storage.
+func WithMaxOpenConns(n int) SQLOption {
+	return func(o *sqlOptions) {
+		o.maxOpenConns = n
+	}
+}
+
+// WithMaxIdleConns sets the maximum number of idle connections of the pool opened by the storage.
+func WithMaxIdleConns(n int) SQLOption {
+	return func(o *sqlOptions) {
+		o.maxIdleConns = n
+	}
+}
+
+// WithConnMaxLifetime sets the maximum time a connection of the pool opened by the storage is reused.
+func WithConnMaxLifetime(d time.Duration) SQLOption {
+	return func(o *sqlOptions) {
+		o.connMaxLifetime = d
+	}
+}
+
+// WithSchema places the tables in the given postgres schema, which is created if it does not exist.
+func WithSchema(name string) SQLOption {
+	return func(o *sqlOptions) {
+		o.schema = name
+	}
+}
+
+// WithTablePrefix prefixes the names of all tables and indexes, which allows
+// multiple ipam instances in one database.
+func WithTablePrefix(prefix string) SQLOption {
+	return func(o *sqlOptions) {
+		o.tablePrefix = prefix
+	}
+}
+
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func newSQLOptions(opts []SQLOption) sqlOptions {
+	o := sqlOptions{
+		driverName: "postgres",
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// configuresPool returns true if one of the pool options is set.
+func (o sqlOptions) configuresPool() bool {
+	return o.maxOpenConns > 0 || o.maxIdleConns > 0 || o.connMaxLifetime > 0
+}
+
+// newSQL creates the storage on the given database, configures its pool and migrates its schema.
+func newSQL(db *sqlx.DB, d dialect, o sqlOptions) (*sql, error) {
+	s, err := newUnmigratedSQL(db, d, o)
+	if err != nil {
+		return nil, err
+	}
+	err = s.Migrate(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// newUnmigratedSQL creates the storage on the given database and configures its pool.
+func newUnmigratedSQL(db *sqlx.DB, d dialect, o sqlOptions) (*sql, error) {
+	if o.tablePrefix != "" && !identifier.MatchString(o.tablePrefix) {
+		return nil, fmt.Errorf("invalid table prefix:%q", o.tablePrefix)
+	}
+	if o.schema != "" {
+		if d == dialectSQLite {
+			return nil, fmt.Errorf("sqlite does not support schemas")
+		}
+		if !identifier.MatchString(o.schema) {
+			return nil, fmt.Errorf("invalid schema:%q", o.schema)
+		}
+	}
+	if o.maxOpenConns > 0 {
+		db.SetMaxOpenConns(o.maxOpenConns)
+	}
+	if o.maxIdleConns > 0 {
+		db.SetMaxIdleConns(o.maxIdleConns)
+	}
+	if o.connMaxLifetime > 0 {
+		db.SetConnMaxLifetime(o.connMaxLifetime)
+	}
+	qualifier := o.tablePrefix
+	if o.schema != "" {
+		qualifier = o.schema + "." + o.tablePrefix
+	}
+	s := &sql{
+		db:      db,
+		dialect: d,
+		schema:  o.schema,
+		tables: strings.NewReplacer(
+			"{prefixes}", qualifier+"prefixes",
+			"{ips}", qualifier+"ips",
+			"{child_prefixes}", qualifier+"child_prefixes",
+			"{bindings}", qualifier+"bindings",
+			"{free_ranges}", qualifier+"free_ranges",
+			"{schema_migrations}", qualifier+"schema_migrations",
+			"{table_prefix}", o.tablePrefix,
+		),
+	}
+	return s, nil
+}
+
+// Close closes the connection pool of the storage if the storage opened it,
+// a pool given to NewPostgresStorageFromDB stays open and is closed by the caller.
+func (s *sql) Close() error {
+	if !s.ownsDB {
+		return nil
+	}
+	return s.db.Close()
+}
+
+// q replaces the table placeholders of the query with the configured table names.
+func (s *sql) q(query string) string {
+	return s.tables.Replace(query)
 }
 
 type prefixJSON struct {
 	Prefix
-	AvailableChildPrefixes map[string]bool // available child prefixes of this prefix
-	ChildPrefixLength      int             // the length of the child prefixes
-	IPs                    map[string]bool // The ips contained in this prefix
-	Version                int64           // Version is used for optimistic locking
+	AvailableChildPrefixes map[string]bool       // available child prefixes of this prefix
+	ChildPrefixLength      int                   // the length of the child prefixes
+	IPs                    map[string]bool       // The ips contained in this prefix
+	Version                int64                 // Version is used for optimistic locking
+	FreeRanges             []string              `json:",omitempty"` // free ranges of ips as first-last
+	AllocationStrategy     AllocationStrategy    `json:",omitempty"` // the allocation strategy of this prefix
+	Cursor                 string                `json:",omitempty"` // the position behind the last acquisition as ip
+	Reserved               []string              // reserved ips, nil for prefixes which stored them as ips
+	Exclusions             []string              `json:",omitempty"` // ranges excluded from acquiring ips as first-last
+	Metadata               map[string]IPMetadata `json:",omitempty"` // metadata of the acquired ips
+	Leases                 map[string]time.Time  `json:",omitempty"` // expiry of the leased ips
+	Quarantine             time.Duration         `json:",omitempty"` // how long released ips stay quarantined
+	Quarantined            map[string]time.Time  `json:",omitempty"` // end of the quarantine of released ips
+	Bindings               map[string]string     `json:",omitempty"` // ips bound to sticky keys
 }
 
-func (p prefixJSON) toPrefix() Prefix {
-	return Prefix{
+func (p prefixJSON) toPrefix() (Prefix, error) {
+	exclusions, err := parseExclusionRanges(p.Exclusions)
+	if err != nil {
+		return Prefix{}, fmt.Errorf("unable to parse exclusion ranges of prefix:%s %v", p.Cidr, err)
+	}
+	reserved := legacyReserved(p.Cidr)
+	if p.Reserved != nil {
+		reserved = make(map[string]bool, len(p.Reserved))
+		for _, ip := range p.Reserved {
+			reserved[ip] = true
+		}
+	}
+	prefix := Prefix{
 		Cidr:                   p.Cidr,
 		ParentCidr:             p.ParentCidr,
+		Description:            p.Description,
+		Labels:                 p.Labels,
 		availableChildPrefixes: p.AvailableChildPrefixes,
 		childPrefixLength:      p.ChildPrefixLength,
 		Ips:                    p.IPs,
 		version:                p.Version,
+		freeRanges:             parseFreeRanges(p.FreeRanges),
+		allocationStrategy:     p.AllocationStrategy,
+		cursor:                 parseCursor(p.Cursor),
+		reserved:               reserved,
+		exclusions:             exclusions,
+		metadata:               p.Metadata,
+		leases:                 p.Leases,
+		quarantine:             p.Quarantine,
+		quarantined:            p.Quarantined,
+		bindings:               p.Bindings,
 	}
+	prefix.dropReservedIPs()
+	return prefix, nil
+}
+
+// unmarshalPrefix creates a Prefix from its json serialization.
+func unmarshalPrefix(value []byte) (Prefix, error) {
+	var pre prefixJSON
+	err := json.Unmarshal(value, &pre)
+	if err != nil {
+		return Prefix{}, fmt.Errorf("unable to unmarshal prefix:%v", err)
+	}
+	return pre.toPrefix()
 }
 
 func (p Prefix) toPrefixJSON() prefixJSON {
 	return prefixJSON{
 		Prefix: Prefix{
-			Cidr:       p.Cidr,
-			ParentCidr: p.ParentCidr,
+			Cidr:        p.Cidr,
+			ParentCidr:  p.ParentCidr,
+			Description: p.Description,
+			Labels:      p.Labels,
 		},
 		AvailableChildPrefixes: p.availableChildPrefixes,
 		ChildPrefixLength:      p.childPrefixLength,
 		IPs:                    p.Ips,
 		Version:                p.version,
+		FreeRanges:             p.formatFreeRanges(),
+		AllocationStrategy:     p.allocationStrategy,
+		Cursor:                 p.formatCursor(),
+		Reserved:               p.ReservedIPs(),
+		Exclusions:             p.ExclusionRanges(),
+		Metadata:               p.metadata,
+		Leases:                 p.leases,
+		Quarantine:             p.quarantine,
+		Quarantined:            p.quarantined,
+		Bindings:               p.bindings,
+	}
+}
+
+// prefixRecord returns the json stored in the prefixes table, the ips, child prefixes, sticky keys
+// and free ranges are stored in their own tables.
+func (p Prefix) prefixRecord() ([]byte, error) {
+	pj := p.toPrefixJSON()
+	pj.IPs = nil
+	pj.AvailableChildPrefixes = nil
+	pj.FreeRanges = nil
+	pj.Metadata = nil
+	pj.Leases = nil
+	pj.Quarantined = nil
+	pj.Bindings = nil
+	return json.Marshal(pj)
+}
+
+// storedRows are the rows which store a prefix in the sql storage, the record of the prefixes table
+// and the rows of the ips, child_prefixes, bindings and free_ranges tables by ip, cidr, sticky key and first ip.
+type storedRows struct {
+	record   string
+	ips      map[string]ipState
+	children map[string]bool
+	bindings map[string]string
+	ranges   map[string]string
+	partial  bool // only some of the ips were read by ReadPartialPrefix
+}
+
+// partial returns true if the prefix was read by ReadPartialPrefix without all of its ips.
+func (p *Prefix) partial() bool {
+	return p.stored != nil && p.stored.partial
+}
+
+// rows returns the rows which store the prefix in the sql storage.
+func (p Prefix) rows() (*storedRows, error) {
+	record, err := p.prefixRecord()
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal prefix:%v", err)
+	}
+	ips := make(map[string]ipState, len(p.Ips)+len(p.quarantined))
+	for ip := range p.Ips {
+		ips[ip] = ipState{state: ipStateAcquired, metadata: p.metadata[ip], expires: p.leases[ip]}
+	}
+	for ip, until := range p.quarantined {
+		ips[ip] = ipState{state: ipStateQuarantined, expires: until}
+	}
+	ranges, err := p.freeRangeRows()
+	if err != nil {
+		return nil, err
+	}
+	return &storedRows{
+		record:   string(record),
+		ips:      ips,
+		children: copyMap(p.availableChildPrefixes),
+		bindings: copyLabels(p.bindings),
+		ranges:   ranges,
+		partial:  p.partial(),
+	}, nil
+}
+
+// freeRangeRows returns the free ranges of the prefix as last ip by first ip. The free ranges of a partially
+// read prefix are kept up to date by the acquisition, for all others they are calculated from the ips,
+// which also covers ips modified without the Ipamer.
+func (p Prefix) freeRangeRows() (map[string]string, error) {
+	if !p.partial() {
+		err := p.rebuildFreeRanges()
+		if err != nil {
+			return nil, err
+		}
+	}
+	ipnet, err := p.IPNet()
+	if err != nil {
+		return nil, err
+	}
+	_, bits := ipnet.Mask.Size()
+	result := make(map[string]string, len(p.freeRanges))
+	for _, r := range p.freeRanges {
+		last := new(big.Int).Sub(r.end, big.NewInt(1))
+		result[intToIP(r.start, bits).String()] = intToIP(last, bits).String()
+	}
+	return result, nil
+}
+
+type childPrefixRow struct {
+	Parent    string `db:"parent"`
+	Cidr      string `db:"cidr"`
+	Available bool   `db:"available"`
+}
+
+type bindingRow struct {
+	Prefix string `db:"prefix"`
+	Key    string `db:"sticky_key"`
+	IP     string `db:"ip"`
+}
+
+type freeRangeRow struct {
+	Prefix string `db:"prefix"`
+	First  string `db:"first_ip"`
+	Last   string `db:"last_ip"`
+}
+
+type ipRow struct {
+	Prefix   string           `db:"prefix"`
+	IP       string           `db:"ip"`
+	State    string           `db:"state"`
+	Metadata dbsql.NullString `db:"metadata"`
+	Expires  dbsql.NullTime   `db:"expires"`
+}
+
+// ipState returns the columns of the row besides its key.
+func (r ipRow) ipState() (ipState, error) {
+	metadata, err := unmarshalMetadata(r.Metadata)
+	if err != nil {
+		return ipState{}, err
+	}
+	state := ipState{state: r.State, metadata: metadata}
+	if r.Expires.Valid {
+		state.expires = r.Expires.Time.UTC()
 	}
+	return state, nil
 }
 
-func (s *sql) prefixExists(prefix Prefix, tenantid string) (*Prefix, bool) {
-	p, err := s.ReadPrefix(prefix.Cidr, tenantid)
+func (s *sql) prefixExists(ctx context.Context, prefix Prefix, tenantid string) (*Prefix, bool) {
+	p, err := s.ReadPrefixContext(ctx, prefix.Cidr, tenantid)
 	if err != nil {
 		return nil, false
 	}
@@ -52,102 +423,1124 @@ func (s *sql) prefixExists(prefix Prefix, tenantid string) (*Prefix, bool) {
 }
 
 func (s *sql) CreatePrefix(prefix Prefix, tenantid string) (Prefix, error) {
-	existingPrefix, exists := s.prefixExists(prefix, tenantid)
+	return s.CreatePrefixContext(context.Background(), prefix, tenantid)
+}
+
+func (s *sql) CreatePrefixContext(ctx context.Context, prefix Prefix, tenantid string) (Prefix, error) {
+	existingPrefix, exists := s.prefixExists(ctx, prefix, tenantid)
 	if exists {
 		return *existingPrefix, nil
 	}
 	prefix.version = int64(0)
-	pj, err := json.Marshal(prefix.toPrefixJSON())
+	tx, err := s.db.BeginTxx(ctx, nil)
 	if err != nil {
-		return Prefix{}, fmt.Errorf("unable to marshal prefix:%v", err)
+		return Prefix{}, fmt.Errorf("unable to start transaction:%v", err)
 	}
-	tx, err := s.db.Beginx()
+	prefix.stored, err = s.insertPrefix(ctx, tx, prefix, tenantid)
 	if err != nil {
-		return Prefix{}, fmt.Errorf("unable to start transaction:%v", err)
+		return Prefix{}, rollback(tx, err)
 	}
-	tx.MustExec("INSERT INTO prefixes (cidr, prefix, tenantid) VALUES ($1, $2, $3)", prefix.Cidr, pj, tenantid)
 	return prefix, tx.Commit()
 }
 
+// insertPrefix inserts the record of the prefix with its ips and child prefixes and returns the inserted rows.
+func (s *sql) insertPrefix(ctx context.Context, tx *sqlx.Tx, prefix Prefix, tenantid string) (*storedRows, error) {
+	rows, err := prefix.rows()
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, s.q("INSERT INTO {prefixes} (cidr, prefix, tenantid, parent_cidr) VALUES ($1, $2, $3, $4)"), prefix.Cidr, rows.record, tenantid, textColumn(prefix.ParentCidr))
+	if err != nil {
+		return nil, fmt.Errorf("unable to insert prefix:%v", err)
+	}
+	err = s.writeIPs(ctx, tx, prefix.Cidr, tenantid, nil, rows.ips)
+	if err != nil {
+		return nil, err
+	}
+	err = s.writeChildPrefixes(ctx, tx, prefix.Cidr, tenantid, nil, rows.children)
+	if err != nil {
+		return nil, err
+	}
+	err = s.writeBindings(ctx, tx, prefix.Cidr, tenantid, nil, rows.bindings)
+	if err != nil {
+		return nil, err
+	}
+	err = s.writeFreeRanges(ctx, tx, prefix.Cidr, tenantid, nil, rows.ranges)
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
 func (s *sql) ReadPrefix(prefix string, tenantid string) (Prefix, error) {
+	return s.ReadPrefixContext(context.Background(), prefix, tenantid)
+}
+
+func (s *sql) ReadPrefixContext(ctx context.Context, prefix string, tenantid string) (Prefix, error) {
 	var result []byte
-	err := s.db.Get(&result, "SELECT prefix FROM prefixes WHERE cidr=$1 AND tenantid=$2", prefix, tenantid)
+	err := s.db.GetContext(ctx, &result, s.q("SELECT prefix FROM {prefixes} WHERE cidr=$1 AND tenantid=$2"), prefix, tenantid)
 	if err != nil {
 		return Prefix{}, fmt.Errorf("unable to read prefix:%v", err)
 	}
-	var pre prefixJSON
-	err = json.Unmarshal(result, &pre)
+	p, err := unmarshalPrefix(result)
 	if err != nil {
-		return Prefix{}, fmt.Errorf("unable to unmarshal prefix:%v", err)
+		return Prefix{}, err
+	}
+	// the prefix row is read first, every modification of the child prefixes increments its version,
+	// therefore an update based on newer child prefixes than the version fails with an OptimisticLockError.
+	var ips []ipRow
+	err = s.db.SelectContext(ctx, &ips, s.q("SELECT prefix, ip, state, metadata, expires FROM {ips} WHERE tenantid=$1 AND prefix=$2"), tenantid, prefix)
+	if err != nil {
+		return Prefix{}, fmt.Errorf("unable to read ips:%v", err)
+	}
+	var children []childPrefixRow
+	err = s.db.SelectContext(ctx, &children, s.q("SELECT parent, cidr, available FROM {child_prefixes} WHERE tenantid=$1 AND parent=$2"), tenantid, prefix)
+	if err != nil {
+		return Prefix{}, fmt.Errorf("unable to read child prefixes:%v", err)
+	}
+	var bindings []bindingRow
+	err = s.db.SelectContext(ctx, &bindings, s.q("SELECT prefix, sticky_key, ip FROM {bindings} WHERE tenantid=$1 AND prefix=$2"), tenantid, prefix)
+	if err != nil {
+		return Prefix{}, fmt.Errorf("unable to read sticky keys:%v", err)
+	}
+	var ranges []freeRangeRow
+	err = s.db.SelectContext(ctx, &ranges, s.q("SELECT prefix, first_ip, last_ip FROM {free_ranges} WHERE tenantid=$1 AND prefix=$2"), tenantid, prefix)
+	if err != nil {
+		return Prefix{}, fmt.Errorf("unable to read free ranges:%v", err)
+	}
+	prefixes := []Prefix{p}
+	err = assignAllocations(prefixes, ips, children, bindings, ranges)
+	if err != nil {
+		return Prefix{}, err
 	}
+	return prefixes[0], nil
+}
 
-	return pre.toPrefix(), nil
+// ReadPartialPrefix reads the prefix with its child prefixes, sticky keys and free ranges, of its ips only the given ones,
+// the ones bound to a sticky key and the ones whose lease or quarantine ended at now are read.
+// The ips are looked up by key and by the expires index, the cost does not grow with the number of acquired ips.
+func (s *sql) ReadPartialPrefix(ctx context.Context, prefix string, tenantid string, ips []string, now time.Time) (Prefix, error) {
+	var result []byte
+	err := s.db.GetContext(ctx, &result, s.q("SELECT prefix FROM {prefixes} WHERE cidr=$1 AND tenantid=$2"), prefix, tenantid)
+	if err != nil {
+		return Prefix{}, fmt.Errorf("unable to read prefix:%v", err)
+	}
+	p, err := unmarshalPrefix(result)
+	if err != nil {
+		return Prefix{}, err
+	}
+	queries := []string{
+		"SELECT prefix, ip, state, metadata, expires FROM {ips} WHERE tenantid=$1 AND prefix=$2 AND expires<=$3",
+		`SELECT i.prefix, i.ip, i.state, i.metadata, i.expires FROM {ips} AS i, {bindings} AS b
+WHERE b.tenantid=$1 AND b.prefix=$2 AND i.tenantid=b.tenantid AND i.prefix=b.prefix AND i.ip=b.ip`,
+	}
+	args := [][]interface{}{{tenantid, prefix, now.UTC()}, {tenantid, prefix}}
+	if len(ips) > 0 {
+		queries = append(queries, "SELECT prefix, ip, state, metadata, expires FROM {ips} WHERE tenantid=$1 AND prefix=$2 AND ip IN ("+placeholders(3, len(ips))+")")
+		ipArgs := []interface{}{tenantid, prefix}
+		for _, ip := range ips {
+			ipArgs = append(ipArgs, ip)
+		}
+		args = append(args, ipArgs)
+	}
+	var rows []ipRow
+	read := make(map[string]bool)
+	for i, query := range queries {
+		var ipChunk []ipRow
+		err = s.db.SelectContext(ctx, &ipChunk, s.q(query), args[i]...)
+		if err != nil {
+			return Prefix{}, fmt.Errorf("unable to read ips:%v", err)
+		}
+		for _, row := range ipChunk {
+			if !read[row.IP] {
+				read[row.IP] = true
+				rows = append(rows, row)
+			}
+		}
+	}
+	var children []childPrefixRow
+	err = s.db.SelectContext(ctx, &children, s.q("SELECT parent, cidr, available FROM {child_prefixes} WHERE tenantid=$1 AND parent=$2"), tenantid, prefix)
+	if err != nil {
+		return Prefix{}, fmt.Errorf("unable to read child prefixes:%v", err)
+	}
+	var bindings []bindingRow
+	err = s.db.SelectContext(ctx, &bindings, s.q("SELECT prefix, sticky_key, ip FROM {bindings} WHERE tenantid=$1 AND prefix=$2"), tenantid, prefix)
+	if err != nil {
+		return Prefix{}, fmt.Errorf("unable to read sticky keys:%v", err)
+	}
+	var ranges []freeRangeRow
+	err = s.db.SelectContext(ctx, &ranges, s.q("SELECT prefix, first_ip, last_ip FROM {free_ranges} WHERE tenantid=$1 AND prefix=$2"), tenantid, prefix)
+	if err != nil {
+		return Prefix{}, fmt.Errorf("unable to read free ranges:%v", err)
+	}
+	prefixes := []Prefix{p}
+	err = assignAllocations(prefixes, rows, children, bindings, ranges)
+	if err != nil {
+		return Prefix{}, err
+	}
+	prefixes[0].stored.partial = true
+	return prefixes[0], nil
 }
 
 func (s *sql) ReadAllPrefixes(tenantid string) ([]Prefix, error) {
+	return s.ReadAllPrefixesContext(context.Background(), tenantid)
+}
+
+func (s *sql) ReadAllPrefixesContext(ctx context.Context, tenantid string) ([]Prefix, error) {
+	var prefixes [][]byte
+	err := s.db.SelectContext(ctx, &prefixes, s.q("SELECT prefix FROM {prefixes} WHERE tenantid=$1"), tenantid)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read prefixes:%v", err)
+	}
+
+	result := []Prefix{}
+	for _, v := range prefixes {
+		p, err := unmarshalPrefix(v)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, p)
+	}
+	var ips []ipRow
+	err = s.db.SelectContext(ctx, &ips, s.q("SELECT prefix, ip, state, metadata, expires FROM {ips} WHERE tenantid=$1"), tenantid)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read ips:%v", err)
+	}
+	var children []childPrefixRow
+	err = s.db.SelectContext(ctx, &children, s.q("SELECT parent, cidr, available FROM {child_prefixes} WHERE tenantid=$1"), tenantid)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read child prefixes:%v", err)
+	}
+	var bindings []bindingRow
+	err = s.db.SelectContext(ctx, &bindings, s.q("SELECT prefix, sticky_key, ip FROM {bindings} WHERE tenantid=$1"), tenantid)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read sticky keys:%v", err)
+	}
+	var ranges []freeRangeRow
+	err = s.db.SelectContext(ctx, &ranges, s.q("SELECT prefix, first_ip, last_ip FROM {free_ranges} WHERE tenantid=$1"), tenantid)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read free ranges:%v", err)
+	}
+	err = assignAllocations(result, ips, children, bindings, ranges)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ReadPrefixesWithLabels reads the prefixes of the tenant which have all of the given labels.
+// On Postgres the labels are matched by json containment which is supported by the GIN index of the prefixes.
+func (s *sql) ReadPrefixesWithLabels(ctx context.Context, labels map[string]string, tenantid string) ([]Prefix, error) {
+	query := s.q("SELECT prefix FROM {prefixes} WHERE tenantid=$1")
+	args := []interface{}{tenantid}
+	if s.dialect == dialectSQLite {
+		for k, v := range labels {
+			query += fmt.Sprintf(" AND json_extract(prefix, $%d)=$%d", len(args)+1, len(args)+2)
+			args = append(args, fmt.Sprintf("$.Labels.%q", k), v)
+		}
+	} else {
+		contained, err := json.Marshal(map[string]map[string]string{"Labels": labels})
+		if err != nil {
+			return nil, fmt.Errorf("unable to marshal labels:%v", err)
+		}
+		query += " AND prefix @> $2::jsonb"
+		args = append(args, string(contained))
+	}
+	return s.readPrefixes(ctx, tenantid, query, args...)
+}
+
+// ReadIPsByOwner reads the acquired ips of the tenant whose metadata has the given owner
+// with the owner index of the ips table, the owner is stored in its own column besides the metadata.
+func (s *sql) ReadIPsByOwner(ctx context.Context, owner string, tenantid string) ([]IP, error) {
+	var rows []ipRow
+	query := s.q("SELECT prefix, ip, state, metadata, expires FROM {ips} WHERE tenantid=$1 AND owner=$2 AND state=$3")
+	err := s.db.SelectContext(ctx, &rows, query, tenantid, owner, ipStateAcquired)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read ips:%v", err)
+	}
+	result := []IP{}
+	for _, row := range rows {
+		state, err := row.ipState()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, IP{
+			IP:           net.ParseIP(row.IP),
+			ParentPrefix: row.Prefix,
+			Metadata:     state.metadata,
+			Expires:      state.expires,
+		})
+	}
+	return result, nil
+}
+
+// readPrefixes reads the prefixes of the tenant selected by the query with their ips and child prefixes,
+// the query must select the prefix column of the prefixes table.
+func (s *sql) readPrefixes(ctx context.Context, tenantid string, query string, args ...interface{}) ([]Prefix, error) {
 	var prefixes [][]byte
-	err := s.db.Select(&prefixes, "SELECT prefix FROM prefixes WHERE tenantid=$1", tenantid)
+	err := s.db.SelectContext(ctx, &prefixes, query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("unable to read prefixes:%v", err)
 	}
 
 	result := []Prefix{}
+	var cidrs []interface{}
 	for _, v := range prefixes {
-		var pre prefixJSON
-		err = json.Unmarshal(v, &pre)
+		p, err := unmarshalPrefix(v)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, p)
+		cidrs = append(cidrs, p.Cidr)
+	}
+	var ips []ipRow
+	var children []childPrefixRow
+	var bindings []bindingRow
+	var ranges []freeRangeRow
+	for start := 0; start < len(cidrs); start += insertBatchSize {
+		end := start + insertBatchSize
+		if end > len(cidrs) {
+			end = len(cidrs)
+		}
+		in := placeholders(2, end-start)
+		chunkArgs := append([]interface{}{tenantid}, cidrs[start:end]...)
+		var ipChunk []ipRow
+		err = s.db.SelectContext(ctx, &ipChunk, s.q("SELECT prefix, ip, state, metadata, expires FROM {ips} WHERE tenantid=$1 AND prefix IN ("+in+")"), chunkArgs...)
 		if err != nil {
-			return nil, fmt.Errorf("unable to unmarshal prefix:%v", err)
+			return nil, fmt.Errorf("unable to read ips:%v", err)
 		}
-		result = append(result, pre.toPrefix())
+		ips = append(ips, ipChunk...)
+		var childChunk []childPrefixRow
+		err = s.db.SelectContext(ctx, &childChunk, s.q("SELECT parent, cidr, available FROM {child_prefixes} WHERE tenantid=$1 AND parent IN ("+in+")"), chunkArgs...)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read child prefixes:%v", err)
+		}
+		children = append(children, childChunk...)
+		var bindingChunk []bindingRow
+		err = s.db.SelectContext(ctx, &bindingChunk, s.q("SELECT prefix, sticky_key, ip FROM {bindings} WHERE tenantid=$1 AND prefix IN ("+in+")"), chunkArgs...)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read sticky keys:%v", err)
+		}
+		bindings = append(bindings, bindingChunk...)
+		var rangeChunk []freeRangeRow
+		err = s.db.SelectContext(ctx, &rangeChunk, s.q("SELECT prefix, first_ip, last_ip FROM {free_ranges} WHERE tenantid=$1 AND prefix IN ("+in+")"), chunkArgs...)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read free ranges:%v", err)
+		}
+		ranges = append(ranges, rangeChunk...)
+	}
+	err = assignAllocations(result, ips, children, bindings, ranges)
+	if err != nil {
+		return nil, err
 	}
 	return result, nil
 }
 
+// ReadChildPrefixes reads the prefixes of the tenant whose parent is the given prefix,
+// the parent is looked up with the parent index of the prefixes.
+func (s *sql) ReadChildPrefixes(ctx context.Context, cidr string, tenantid string) ([]Prefix, error) {
+	query := s.q("SELECT prefix FROM {prefixes} WHERE tenantid=$1 AND parent_cidr=$2")
+	return s.readPrefixes(ctx, tenantid, query, tenantid, cidr)
+}
+
+// ReadDescendantPrefixes reads the children of the given prefix, their children and so on with a recursive query.
+func (s *sql) ReadDescendantPrefixes(ctx context.Context, cidr string, tenantid string) ([]Prefix, error) {
+	query := s.q(`WITH RECURSIVE descendants(cidr) AS (
+	SELECT cidr FROM {prefixes} WHERE tenantid=$1 AND parent_cidr=$2
+	UNION
+	SELECT p.cidr FROM {prefixes} AS p, descendants AS d WHERE p.tenantid=$1 AND p.parent_cidr=d.cidr
+)
+SELECT prefix FROM {prefixes} WHERE tenantid=$1 AND cidr IN (SELECT cidr FROM descendants)`)
+	return s.readPrefixes(ctx, tenantid, query, tenantid, cidr)
+}
+
+// ReadAncestorPrefixes reads the parent of the given prefix, its parent and so on up to the root with a recursive query.
+func (s *sql) ReadAncestorPrefixes(ctx context.Context, cidr string, tenantid string) ([]Prefix, error) {
+	query := s.q(`WITH RECURSIVE ancestors(cidr) AS (
+	SELECT parent_cidr FROM {prefixes} WHERE tenantid=$1 AND cidr=$2
+	UNION
+	SELECT p.parent_cidr FROM {prefixes} AS p, ancestors AS a WHERE p.tenantid=$1 AND p.cidr=a.cidr
+)
+SELECT prefix FROM {prefixes} WHERE tenantid=$1 AND cidr IN (SELECT cidr FROM ancestors)`)
+	return s.readPrefixes(ctx, tenantid, query, tenantid, cidr)
+}
+
+// placeholders returns n comma separated query parameters starting with the given index.
+func placeholders(first, n int) string {
+	params := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		params = append(params, fmt.Sprintf("$%d", first+i))
+	}
+	return strings.Join(params, ",")
+}
+
+// assignAllocations fills the ips with their metadata and leases, the quarantined ips, the available child prefixes,
+// the sticky keys and the free ranges of the prefixes from the given rows.
+// The rows are kept with the prefixes to write only the rows which differ from them on update.
+func assignAllocations(prefixes []Prefix, ips []ipRow, children []childPrefixRow, bindings []bindingRow, ranges []freeRangeRow) error {
+	byCidr := make(map[string]*Prefix, len(prefixes))
+	for i := range prefixes {
+		p := &prefixes[i]
+		p.Ips = make(map[string]bool)
+		p.availableChildPrefixes = make(map[string]bool)
+		p.freeRanges = []ipRange{}
+		p.stored = &storedRows{
+			ips:      make(map[string]ipState),
+			children: make(map[string]bool),
+			ranges:   make(map[string]string),
+		}
+		p.bindings = nil
+		byCidr[p.Cidr] = p
+	}
+	for _, ip := range ips {
+		p, ok := byCidr[ip.Prefix]
+		if !ok {
+			continue
+		}
+		state, err := ip.ipState()
+		if err != nil {
+			return err
+		}
+		p.stored.ips[ip.IP] = state
+		if state.state == ipStateQuarantined {
+			if p.quarantined == nil {
+				p.quarantined = make(map[string]time.Time)
+			}
+			p.quarantined[ip.IP] = state.expires
+			continue
+		}
+		p.Ips[ip.IP] = true
+		p.setMetadata(ip.IP, state.metadata)
+		if !state.expires.IsZero() {
+			p.setLease(ip.IP, state.expires)
+		}
+	}
+	for _, child := range children {
+		p, ok := byCidr[child.Parent]
+		if ok {
+			p.availableChildPrefixes[child.Cidr] = child.Available
+			p.stored.children[child.Cidr] = child.Available
+		}
+	}
+	for _, b := range bindings {
+		p, ok := byCidr[b.Prefix]
+		if ok {
+			p.bind(b.Key, b.IP)
+		}
+	}
+	for _, r := range ranges {
+		p, ok := byCidr[r.Prefix]
+		if !ok {
+			continue
+		}
+		free, err := parseIPRange(r.First + "-" + r.Last)
+		if err != nil {
+			return fmt.Errorf("unable to parse free range of prefix:%s %v", r.Prefix, err)
+		}
+		p.freeRanges = append(p.freeRanges, free)
+		p.stored.ranges[r.First] = r.Last
+	}
+	for _, p := range byCidr {
+		sort.Slice(p.freeRanges, func(i, j int) bool {
+			return p.freeRanges[i].start.Cmp(p.freeRanges[j].start) < 0
+		})
+		p.dropReservedIPs()
+		record, err := p.prefixRecord()
+		if err != nil {
+			return fmt.Errorf("unable to marshal prefix:%v", err)
+		}
+		p.stored.record = string(record)
+		p.stored.bindings = copyLabels(p.bindings)
+	}
+	return nil
+}
+
 // UpdatePrefix tries to update the prefix.
 // Returns OptimisticLockError if it does not succeed due to a concurrent update.
+// Only the rows in which the prefix differs from the rows it was read with are written.
 func (s *sql) UpdatePrefix(prefix Prefix, tenantid string) (Prefix, error) {
-	oldVersion := prefix.version
-	prefix.version = oldVersion + 1
-	pn, err := json.Marshal(prefix.toPrefixJSON())
+	return s.UpdatePrefixContext(context.Background(), prefix, tenantid)
+}
+
+func (s *sql) UpdatePrefixContext(ctx context.Context, prefix Prefix, tenantid string) (Prefix, error) {
+	tx, err := s.db.BeginTxx(ctx, nil)
 	if err != nil {
-		return Prefix{}, fmt.Errorf("unable to marshal prefix:%v", err)
+		return Prefix{}, fmt.Errorf("unable to start transaction:%v", err)
 	}
-	tx, err := s.db.Beginx()
+	prefix, err = s.updatePrefix(ctx, tx, prefix, tenantid)
 	if err != nil {
-		return Prefix{}, fmt.Errorf("unable to start transaction:%v", err)
+		return Prefix{}, rollback(tx, err)
+	}
+	return prefix, tx.Commit()
+}
+
+// updatePrefix writes the rows in which the prefix differs from the rows it was read with,
+// the stored rows are read if the prefix was not read from this storage.
+// The record is replaced and its version incremented only if the record or the child prefixes changed,
+// acquiring and releasing ips writes just their rows and the free ranges around them. Returns OptimisticLockError if the stored prefix
+// has another version or one of the written rows was modified concurrently.
+func (s *sql) updatePrefix(ctx context.Context, tx *sqlx.Tx, prefix Prefix, tenantid string) (Prefix, error) {
+	old := prefix.stored
+	if old == nil {
+		var err error
+		old, err = s.readRows(ctx, tx, prefix.Cidr, tenantid)
+		if err != nil {
+			return Prefix{}, err
+		}
 	}
-	result := tx.MustExec("SELECT prefix FROM prefixes WHERE cidr=$1 AND tenantid=$2 AND prefix->>'Version'=$3 FOR UPDATE", prefix.Cidr, tenantid, oldVersion)
-	rows, err := result.RowsAffected()
+	rows, err := prefix.rows()
 	if err != nil {
 		return Prefix{}, err
 	}
-	if rows == 0 {
-		err := tx.Rollback()
+	if rows.record != old.record || !reflect.DeepEqual(rows.children, old.children) {
+		oldVersion := prefix.version
+		prefix.version = oldVersion + 1
+		pn, err := prefix.prefixRecord()
+		if err != nil {
+			return Prefix{}, fmt.Errorf("unable to marshal prefix:%v", err)
+		}
+		rows.record = string(pn)
+		result, err := tx.ExecContext(ctx, s.q("UPDATE {prefixes} SET prefix=$1, parent_cidr=$2 WHERE cidr=$3 AND tenantid=$4 AND ")+s.dialect.versionCondition(5), rows.record, textColumn(prefix.ParentCidr), prefix.Cidr, tenantid, oldVersion)
 		if err != nil {
-			return Prefix{}, newOptimisticLockError("select for update did not effect any row, but rollback did not work:" + err.Error())
+			return Prefix{}, fmt.Errorf("unable to update prefix:%v", err)
 		}
-		return Prefix{}, newOptimisticLockError("select for update did not effect any row")
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return Prefix{}, err
+		}
+		if affected == 0 {
+			return Prefix{}, newOptimisticLockError("updatePrefix did not effect any row")
+		}
+		// ips are written without incrementing the version, the record must not be based on outdated ips,
+		// a partially read prefix changes only the cursor of the record which does not depend on them
+		if prefix.stored != nil && !old.partial {
+			err = s.checkIPs(ctx, tx, prefix.Cidr, tenantid, old.ips)
+			if err != nil {
+				return Prefix{}, err
+			}
+		}
+	} else {
+		err = s.lockPrefix(ctx, tx, prefix.Cidr, tenantid, prefix.version)
+		if err != nil {
+			return Prefix{}, err
+		}
+	}
+	err = s.writeIPs(ctx, tx, prefix.Cidr, tenantid, old.ips, rows.ips)
+	if err != nil {
+		return Prefix{}, err
+	}
+	err = s.writeChildPrefixes(ctx, tx, prefix.Cidr, tenantid, old.children, rows.children)
+	if err != nil {
+		return Prefix{}, err
 	}
-	result = tx.MustExec("UPDATE prefixes SET prefix=$1 WHERE cidr=$2 AND tenantid=$3 AND prefix->>'Version'=$4", pn, prefix.Cidr, tenantid, oldVersion)
-	rows, err = result.RowsAffected()
+	err = s.writeBindings(ctx, tx, prefix.Cidr, tenantid, old.bindings, rows.bindings)
 	if err != nil {
 		return Prefix{}, err
 	}
-	if rows == 0 {
-		err := tx.Rollback()
+	err = s.writeFreeRanges(ctx, tx, prefix.Cidr, tenantid, old.ranges, rows.ranges)
+	if err != nil {
+		return Prefix{}, err
+	}
+	prefix.stored = rows
+	return prefix, nil
+}
+
+// lockPrefix returns an OptimisticLockError if the stored prefix does not have the given version.
+// On postgres the prefix row is share locked, which lets ips be written concurrently
+// while an update of the record waits for them.
+func (s *sql) lockPrefix(ctx context.Context, tx *sqlx.Tx, cidr string, tenantid string, version int64) error {
+	query := s.q("SELECT cidr FROM {prefixes} WHERE cidr=$1 AND tenantid=$2 AND ") + s.dialect.versionCondition(3)
+	// sqlite locks the whole database on write, row locks are neither needed nor supported
+	if s.dialect != dialectSQLite {
+		query += " FOR SHARE"
+	}
+	var cidrs []string
+	err := tx.SelectContext(ctx, &cidrs, query, cidr, tenantid, version)
+	if err != nil {
+		return fmt.Errorf("unable to read prefix:%v", err)
+	}
+	if len(cidrs) == 0 {
+		return newOptimisticLockError(fmt.Sprintf("prefix %s was modified or deleted concurrently", cidr))
+	}
+	return nil
+}
+
+// readRows reads the ip, child prefix, sticky key and free range rows of the prefix, the record is left empty.
+func (s *sql) readRows(ctx context.Context, tx *sqlx.Tx, cidr string, tenantid string) (*storedRows, error) {
+	var ips []ipRow
+	err := tx.SelectContext(ctx, &ips, s.q("SELECT prefix, ip, state, metadata, expires FROM {ips} WHERE tenantid=$1 AND prefix=$2"), tenantid, cidr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read ips:%v", err)
+	}
+	var children []childPrefixRow
+	err = tx.SelectContext(ctx, &children, s.q("SELECT parent, cidr, available FROM {child_prefixes} WHERE tenantid=$1 AND parent=$2"), tenantid, cidr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read child prefixes:%v", err)
+	}
+	var bindings []bindingRow
+	err = tx.SelectContext(ctx, &bindings, s.q("SELECT prefix, sticky_key, ip FROM {bindings} WHERE tenantid=$1 AND prefix=$2"), tenantid, cidr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read sticky keys:%v", err)
+	}
+	var ranges []freeRangeRow
+	err = tx.SelectContext(ctx, &ranges, s.q("SELECT prefix, first_ip, last_ip FROM {free_ranges} WHERE tenantid=$1 AND prefix=$2"), tenantid, cidr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read free ranges:%v", err)
+	}
+	rows := &storedRows{
+		ips:      make(map[string]ipState, len(ips)),
+		children: make(map[string]bool, len(children)),
+		bindings: make(map[string]string, len(bindings)),
+		ranges:   make(map[string]string, len(ranges)),
+	}
+	for _, ip := range ips {
+		state, err := ip.ipState()
 		if err != nil {
-			return Prefix{}, newOptimisticLockError("updatePrefix did not effect any row, but rollback did not work:" + err.Error())
+			return nil, err
 		}
-		return Prefix{}, newOptimisticLockError("updatePrefix did not effect any row")
+		rows.ips[ip.IP] = state
 	}
-	return prefix, tx.Commit()
+	for _, child := range children {
+		rows.children[child.Cidr] = child.Available
+	}
+	for _, b := range bindings {
+		rows.bindings[b.Key] = b.IP
+	}
+	for _, r := range ranges {
+		rows.ranges[r.First] = r.Last
+	}
+	return rows, nil
+}
+
+// checkIPs returns an OptimisticLockError if the stored ips of the prefix or their states differ from the given ones.
+func (s *sql) checkIPs(ctx context.Context, tx *sqlx.Tx, cidr string, tenantid string, ips map[string]ipState) error {
+	var stored []struct {
+		IP    string `db:"ip"`
+		State string `db:"state"`
+	}
+	err := tx.SelectContext(ctx, &stored, s.q("SELECT ip, state FROM {ips} WHERE tenantid=$1 AND prefix=$2"), tenantid, cidr)
+	if err != nil {
+		return fmt.Errorf("unable to read ips:%v", err)
+	}
+	if len(stored) != len(ips) {
+		return newOptimisticLockError(fmt.Sprintf("ips of prefix %s were modified concurrently", cidr))
+	}
+	for _, row := range stored {
+		if ips[row.IP].state != row.State {
+			return newOptimisticLockError(fmt.Sprintf("ips of prefix %s were modified concurrently", cidr))
+		}
+	}
+	return nil
 }
 
 func (s *sql) DeletePrefix(prefix Prefix, tenantid string) (Prefix, error) {
-	tx, err := s.db.Beginx()
+	return s.DeletePrefixContext(context.Background(), prefix, tenantid)
+}
+
+func (s *sql) DeletePrefixContext(ctx context.Context, prefix Prefix, tenantid string) (Prefix, error) {
+	tx, err := s.db.BeginTxx(ctx, nil)
 	if err != nil {
 		return Prefix{}, fmt.Errorf("unable to start transaction:%v", err)
 	}
-	tx.MustExec("DELETE from prefixes WHERE cidr=$1 AND tenantid=$2", prefix.Cidr, tenantid)
+	// the prefix row is deleted first, it waits for concurrent writers of ips which lock it
+	_, err = tx.ExecContext(ctx, s.q("DELETE FROM {prefixes} WHERE cidr=$1 AND tenantid=$2"), prefix.Cidr, tenantid)
+	if err != nil {
+		return Prefix{}, rollback(tx, fmt.Errorf("unable to delete prefix:%v", err))
+	}
+	err = s.deleteAllocations(ctx, tx, prefix.Cidr, tenantid)
+	if err != nil {
+		return Prefix{}, rollback(tx, err)
+	}
 	return prefix, tx.Commit()
 }
+
+// deleteAllocations deletes the ips, child prefixes, sticky keys and free ranges of the prefix.
+func (s *sql) deleteAllocations(ctx context.Context, tx *sqlx.Tx, cidr string, tenantid string) error {
+	_, err := tx.ExecContext(ctx, s.q("DELETE FROM {ips} WHERE tenantid=$1 AND prefix=$2"), tenantid, cidr)
+	if err != nil {
+		return fmt.Errorf("unable to delete ips:%v", err)
+	}
+	_, err = tx.ExecContext(ctx, s.q("DELETE FROM {child_prefixes} WHERE tenantid=$1 AND parent=$2"), tenantid, cidr)
+	if err != nil {
+		return fmt.Errorf("unable to delete child prefixes:%v", err)
+	}
+	_, err = tx.ExecContext(ctx, s.q("DELETE FROM {bindings} WHERE tenantid=$1 AND prefix=$2"), tenantid, cidr)
+	if err != nil {
+		return fmt.Errorf("unable to delete sticky keys:%v", err)
+	}
+	_, err = tx.ExecContext(ctx, s.q("DELETE FROM {free_ranges} WHERE tenantid=$1 AND prefix=$2"), tenantid, cidr)
+	if err != nil {
+		return fmt.Errorf("unable to delete free ranges:%v", err)
+	}
+	return nil
+}
+
+// ApplyChanges applies the changes of a transaction in a single database transaction.
+func (s *sql) ApplyChanges(ctx context.Context, changes []PrefixChange) error {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("unable to start transaction:%v", err)
+	}
+	for _, c := range changes {
+		err = s.applyChange(ctx, tx, c)
+		if err != nil {
+			return rollback(tx, err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sql) applyChange(ctx context.Context, tx *sqlx.Tx, c PrefixChange) error {
+	prefix := c.Prefix
+	switch c.Op {
+	case ChangeCreate:
+		var count int
+		err := tx.GetContext(ctx, &count, s.q("SELECT COUNT(*) FROM {prefixes} WHERE cidr=$1 AND tenantid=$2"), prefix.Cidr, c.Tenantid)
+		if err != nil {
+			return fmt.Errorf("unable to read prefix:%v", err)
+		}
+		if count > 0 {
+			return newOptimisticLockError(fmt.Sprintf("prefix %s was created concurrently", prefix.Cidr))
+		}
+		prefix.version = int64(0)
+		_, err = s.insertPrefix(ctx, tx, prefix, c.Tenantid)
+		return err
+	case ChangeUpdate:
+		_, err := s.updatePrefix(ctx, tx, prefix, c.Tenantid)
+		return err
+	case ChangeDelete:
+		result, err := tx.ExecContext(ctx, s.q("DELETE FROM {prefixes} WHERE cidr=$1 AND tenantid=$2 AND ")+s.dialect.versionCondition(3), prefix.Cidr, c.Tenantid, prefix.version)
+		if err != nil {
+			return fmt.Errorf("unable to delete prefix:%v", err)
+		}
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rows == 0 {
+			return newOptimisticLockError(fmt.Sprintf("prefix %s was modified or deleted concurrently", prefix.Cidr))
+		}
+		return s.deleteAllocations(ctx, tx, prefix.Cidr, c.Tenantid)
+	}
+	return nil
+}
+
+// writeIPs writes the ip rows in which the desired ips of the prefix differ from the old ones.
+// Rows are deleted and updated only if they still have their old state and inserted rows must not exist,
+// the primary key of the ips table guarantees that an ip is acquired only once.
+// Returns OptimisticLockError if a row was modified concurrently.
+func (s *sql) writeIPs(ctx context.Context, tx *sqlx.Tx, cidr string, tenantid string, old, desired map[string]ipState) error {
+	for ip, was := range old {
+		want, ok := desired[ip]
+		if ok && want.equal(was) {
+			continue
+		}
+		var result dbsql.Result
+		var err error
+		if !ok {
+			result, err = tx.ExecContext(ctx, s.q("DELETE FROM {ips} WHERE tenantid=$1 AND prefix=$2 AND ip=$3 AND state=$4"), tenantid, cidr, ip, was.state)
+		} else {
+			metadata, merr := marshalMetadata(want.metadata)
+			if merr != nil {
+				return merr
+			}
+			result, err = tx.ExecContext(ctx, s.q("UPDATE {ips} SET state=$1, metadata=$2, expires=$3, owner=$4 WHERE tenantid=$5 AND prefix=$6 AND ip=$7 AND state=$8"), want.state, metadata, expiresColumn(want.expires), textColumn(want.metadata.Owner), tenantid, cidr, ip, was.state)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to write ip:%v", err)
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			return newOptimisticLockError(fmt.Sprintf("ip %s of prefix %s was modified concurrently", ip, cidr))
+		}
+	}
+	var rows [][]interface{}
+	for ip, want := range desired {
+		if _, ok := old[ip]; ok {
+			continue
+		}
+		metadata, err := marshalMetadata(want.metadata)
+		if err != nil {
+			return err
+		}
+		rows = append(rows, []interface{}{tenantid, cidr, ip, want.state, metadata, expiresColumn(want.expires), textColumn(want.metadata.Owner)})
+	}
+	return s.insertRows(ctx, tx, "{ips}", []string{"tenantid", "prefix", "ip", "state", "metadata", "expires", "owner"}, rows)
+}
+
+// ipState are the columns of an ip row in the ips table besides its key.
+type ipState struct {
+	state    string
+	metadata IPMetadata
+	expires  time.Time // the expiry of the lease of an acquired ip or the end of the quarantine, zero for none
+}
+
+func (s ipState) equal(o ipState) bool {
+	return s.state == o.state && reflect.DeepEqual(s.metadata, o.metadata) && s.expires.Equal(o.expires)
+}
+
+// expiresColumn returns the value of the expires column of the ips table, nil for the zero time.
+func expiresColumn(expires time.Time) interface{} {
+	if expires.IsZero() {
+		return nil
+	}
+	return expires
+}
+
+// textColumn returns the value of a nullable text column, nil for the empty string.
+func textColumn(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	return value
+}
+
+// writeChildPrefixes writes the child prefix rows in which the desired child prefixes of the prefix differ from the old ones.
+// Child prefixes are only written together with the record, whose version protects them from concurrent modifications.
+func (s *sql) writeChildPrefixes(ctx context.Context, tx *sqlx.Tx, cidr string, tenantid string, old, desired map[string]bool) error {
+	for child, was := range old {
+		available, ok := desired[child]
+		if ok && available == was {
+			continue
+		}
+		var err error
+		if !ok {
+			_, err = tx.ExecContext(ctx, s.q("DELETE FROM {child_prefixes} WHERE tenantid=$1 AND parent=$2 AND cidr=$3"), tenantid, cidr, child)
+		} else {
+			_, err = tx.ExecContext(ctx, s.q("UPDATE {child_prefixes} SET available=$1 WHERE tenantid=$2 AND parent=$3 AND cidr=$4"), available, tenantid, cidr, child)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to write child prefix:%v", err)
+		}
+	}
+	var rows [][]interface{}
+	for child, available := range desired {
+		if _, ok := old[child]; ok {
+			continue
+		}
+		rows = append(rows, []interface{}{tenantid, cidr, child, available})
+	}
+	return s.insertRows(ctx, tx, "{child_prefixes}", []string{"tenantid", "parent", "cidr", "available"}, rows)
+}
+
+// writeBindings writes the sticky key rows in which the desired sticky keys of the prefix differ from the old ones.
+// Like ips they are written without the record, rows are deleted and updated only if they are still bound
+// to their old ip and inserted rows must not exist, otherwise an OptimisticLockError is returned.
+func (s *sql) writeBindings(ctx context.Context, tx *sqlx.Tx, cidr string, tenantid string, old, desired map[string]string) error {
+	for key, was := range old {
+		ip, ok := desired[key]
+		if ok && ip == was {
+			continue
+		}
+		var result dbsql.Result
+		var err error
+		if !ok {
+			result, err = tx.ExecContext(ctx, s.q("DELETE FROM {bindings} WHERE tenantid=$1 AND prefix=$2 AND sticky_key=$3 AND ip=$4"), tenantid, cidr, key, was)
+		} else {
+			result, err = tx.ExecContext(ctx, s.q("UPDATE {bindings} SET ip=$1 WHERE tenantid=$2 AND prefix=$3 AND sticky_key=$4 AND ip=$5"), ip, tenantid, cidr, key, was)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to write sticky key:%v", err)
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			return newOptimisticLockError(fmt.Sprintf("sticky key %s of prefix %s was modified concurrently", key, cidr))
+		}
+	}
+	var rows [][]interface{}
+	for key, ip := range desired {
+		if _, ok := old[key]; ok {
+			continue
+		}
+		rows = append(rows, []interface{}{tenantid, cidr, key, ip})
+	}
+	return s.insertRows(ctx, tx, "{bindings}", []string{"tenantid", "prefix", "sticky_key", "ip"}, rows)
+}
+
+// writeFreeRanges writes the free range rows in which the desired free ranges of the prefix differ from the old ones.
+// Like ips they are written without the record, rows are deleted and updated only if they still end at their old
+// last ip and inserted rows must not exist, otherwise an OptimisticLockError is returned.
+func (s *sql) writeFreeRanges(ctx context.Context, tx *sqlx.Tx, cidr string, tenantid string, old, desired map[string]string) error {
+	for first, was := range old {
+		last, ok := desired[first]
+		if ok && last == was {
+			continue
+		}
+		var result dbsql.Result
+		var err error
+		if !ok {
+			result, err = tx.ExecContext(ctx, s.q("DELETE FROM {free_ranges} WHERE tenantid=$1 AND prefix=$2 AND first_ip=$3 AND last_ip=$4"), tenantid, cidr, first, was)
+		} else {
+			result, err = tx.ExecContext(ctx, s.q("UPDATE {free_ranges} SET last_ip=$1 WHERE tenantid=$2 AND prefix=$3 AND first_ip=$4 AND last_ip=$5"), last, tenantid, cidr, first, was)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to write free range:%v", err)
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			return newOptimisticLockError(fmt.Sprintf("free range %s-%s of prefix %s was modified concurrently", first, was, cidr))
+		}
+	}
+	var rows [][]interface{}
+	for first, last := range desired {
+		if _, ok := old[first]; ok {
+			continue
+		}
+		rows = append(rows, []interface{}{tenantid, cidr, first, last})
+	}
+	return s.insertRows(ctx, tx, "{free_ranges}", []string{"tenantid", "prefix", "first_ip", "last_ip"}, rows)
+}
+
+// insertRows inserts the rows into the table placeholder with multi row inserts of insertBatchSize rows.
+// Returns OptimisticLockError if one of the rows exists already.
+func (s *sql) insertRows(ctx context.Context, tx *sqlx.Tx, table string, columns []string, rows [][]interface{}) error {
+	for start := 0; start < len(rows); start += insertBatchSize {
+		end := start + insertBatchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+		values := make([]string, 0, end-start)
+		args := make([]interface{}, 0, (end-start)*len(columns))
+		for _, row := range rows[start:end] {
+			params := make([]string, len(row))
+			for i, v := range row {
+				args = append(args, v)
+				params[i] = fmt.Sprintf("$%d", len(args))
+			}
+			values = append(values, "("+strings.Join(params, ",")+")")
+		}
+		query := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s", s.q(table), strings.Join(columns, ","), strings.Join(values, ","))
+		_, err := tx.ExecContext(ctx, query, args...)
+		if isUniqueViolation(err) {
+			return newOptimisticLockError(fmt.Sprintf("rows inserted into %s exist already:%v", s.q(table), err))
+		}
+		if err != nil {
+			return fmt.Errorf("unable to insert into %s:%v", s.q(table), err)
+		}
+	}
+	return nil
+}
+
+// migrateAllocations moves the ips and child prefixes which earlier versions stored inside
+// the json of the prefixes table into the ips and child_prefixes tables.
+// The json is decoded as it was stored at schema version 1, all other fields of it are kept unchanged.
+func (s *sql) migrateAllocations(ctx context.Context, tx *sqlx.Tx) error {
+	var records []struct {
+		Cidr     string `db:"cidr"`
+		Tenantid string `db:"tenantid"`
+		Prefix   []byte `db:"prefix"`
+	}
+	err := tx.SelectContext(ctx, &records, s.q("SELECT cidr, tenantid, prefix FROM {prefixes} WHERE ")+s.dialect.jsonField("IPs")+" IS NOT NULL OR "+s.dialect.jsonField("AvailableChildPrefixes")+" IS NOT NULL")
+	if err != nil {
+		return fmt.Errorf("unable to read prefixes to migrate:%v", err)
+	}
+	for _, r := range records {
+		var fields map[string]json.RawMessage
+		err := json.Unmarshal(r.Prefix, &fields)
+		if err != nil {
+			return fmt.Errorf("unable to unmarshal prefix:%s %v", r.Cidr, err)
+		}
+		var allocations struct {
+			IPs                    map[string]bool
+			AvailableChildPrefixes map[string]bool
+		}
+		err = json.Unmarshal(r.Prefix, &allocations)
+		if err != nil {
+			return fmt.Errorf("unable to unmarshal prefix:%s %v", r.Cidr, err)
+		}
+		delete(fields, "IPs")
+		delete(fields, "AvailableChildPrefixes")
+		pj, err := json.Marshal(fields)
+		if err != nil {
+			return fmt.Errorf("unable to marshal prefix:%v", err)
+		}
+		_, err = tx.ExecContext(ctx, s.q("UPDATE {prefixes} SET prefix=$1 WHERE cidr=$2 AND tenantid=$3"), string(pj), r.Cidr, r.Tenantid)
+		if err != nil {
+			return fmt.Errorf("unable to update prefix:%v", err)
+		}
+		// the rows are inserted with the columns of schema version 2, later migrations add columns
+		var ips [][]interface{}
+		for ip := range allocations.IPs {
+			ips = append(ips, []interface{}{r.Tenantid, r.Cidr, ip, ipStateAcquired})
+		}
+		err = s.insertRows(ctx, tx, "{ips}", []string{"tenantid", "prefix", "ip", "state"}, ips)
+		if err != nil {
+			return err
+		}
+		var children [][]interface{}
+		for cidr, available := range allocations.AvailableChildPrefixes {
+			children = append(children, []interface{}{r.Tenantid, r.Cidr, cidr, available})
+		}
+		err = s.insertRows(ctx, tx, "{child_prefixes}", []string{"tenantid", "parent", "cidr", "available"}, children)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateParentCidrs copies the parent of the prefixes from their json into the parent_cidr column,
+// which is written together with the json from then on.
+func (s *sql) migrateParentCidrs(ctx context.Context, tx *sqlx.Tx) error {
+	parent := s.dialect.jsonField("ParentCidr")
+	_, err := tx.ExecContext(ctx, s.q("UPDATE {prefixes} SET parent_cidr="+parent+" WHERE "+parent+"<>''"))
+	if err != nil {
+		return fmt.Errorf("unable to migrate parents of prefixes:%v", err)
+	}
+	return nil
+}
+
+// migrateOwners copies the owner of the ips from their metadata into the owner column,
+// which is written together with the metadata from then on.
+func (s *sql) migrateOwners(ctx context.Context, tx *sqlx.Tx) error {
+	owner := s.dialect.jsonColumnField("metadata", "Owner")
+	_, err := tx.ExecContext(ctx, s.q("UPDATE {ips} SET owner="+owner+" WHERE "+owner+"<>''"))
+	if err != nil {
+		return fmt.Errorf("unable to migrate owners of ips:%v", err)
+	}
+	return nil
+}
+
+// migrateBindings moves the sticky keys which earlier versions stored inside the json of the prefixes table
+// into the bindings table and removes the free ranges from the json, they are calculated from the ips.
+// The json is decoded as it was stored at schema version 6, all other fields of it are kept unchanged.
+func (s *sql) migrateBindings(ctx context.Context, tx *sqlx.Tx) error {
+	var records []struct {
+		Cidr     string `db:"cidr"`
+		Tenantid string `db:"tenantid"`
+		Prefix   []byte `db:"prefix"`
+	}
+	err := tx.SelectContext(ctx, &records, s.q("SELECT cidr, tenantid, prefix FROM {prefixes} WHERE ")+s.dialect.jsonField("Bindings")+" IS NOT NULL OR "+s.dialect.jsonField("FreeRanges")+" IS NOT NULL")
+	if err != nil {
+		return fmt.Errorf("unable to read prefixes to migrate:%v", err)
+	}
+	for _, r := range records {
+		var fields map[string]json.RawMessage
+		err := json.Unmarshal(r.Prefix, &fields)
+		if err != nil {
+			return fmt.Errorf("unable to unmarshal prefix:%s %v", r.Cidr, err)
+		}
+		var sticky struct {
+			Bindings map[string]string
+		}
+		err = json.Unmarshal(r.Prefix, &sticky)
+		if err != nil {
+			return fmt.Errorf("unable to unmarshal prefix:%s %v", r.Cidr, err)
+		}
+		delete(fields, "Bindings")
+		delete(fields, "FreeRanges")
+		pj, err := json.Marshal(fields)
+		if err != nil {
+			return fmt.Errorf("unable to marshal prefix:%v", err)
+		}
+		_, err = tx.ExecContext(ctx, s.q("UPDATE {prefixes} SET prefix=$1 WHERE cidr=$2 AND tenantid=$3"), string(pj), r.Cidr, r.Tenantid)
+		if err != nil {
+			return fmt.Errorf("unable to update prefix:%v", err)
+		}
+		var rows [][]interface{}
+		for key, ip := range sticky.Bindings {
+			rows = append(rows, []interface{}{r.Tenantid, r.Cidr, key, ip})
+		}
+		err = s.insertRows(ctx, tx, "{bindings}", []string{"tenantid", "prefix", "sticky_key", "ip"}, rows)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateFreeRanges stores the free ranges of all prefixes in the free_ranges table,
+// they are calculated from the reserved ips and exclusion ranges of the prefixes and the rows of their ips.
+// The json is decoded as it was stored at schema version 9.
+func (s *sql) migrateFreeRanges(ctx context.Context, tx *sqlx.Tx) error {
+	var records []struct {
+		Cidr     string `db:"cidr"`
+		Tenantid string `db:"tenantid"`
+		Prefix   []byte `db:"prefix"`
+	}
+	err := tx.SelectContext(ctx, &records, s.q("SELECT cidr, tenantid, prefix FROM {prefixes}"))
+	if err != nil {
+		return fmt.Errorf("unable to read prefixes to migrate:%v", err)
+	}
+	for _, r := range records {
+		var config struct {
+			Reserved   []string
+			Exclusions []string
+		}
+		err := json.Unmarshal(r.Prefix, &config)
+		if err != nil {
+			return fmt.Errorf("unable to unmarshal prefix:%s %v", r.Cidr, err)
+		}
+		exclusions, err := parseExclusionRanges(config.Exclusions)
+		if err != nil {
+			return fmt.Errorf("unable to parse exclusion ranges of prefix:%s %v", r.Cidr, err)
+		}
+		p := Prefix{
+			Cidr:        r.Cidr,
+			Ips:         make(map[string]bool),
+			reserved:    legacyReserved(r.Cidr),
+			exclusions:  exclusions,
+			quarantined: make(map[string]time.Time),
+		}
+		if config.Reserved != nil {
+			p.reserved = make(map[string]bool, len(config.Reserved))
+			for _, ip := range config.Reserved {
+				p.reserved[ip] = true
+			}
+		}
+		var ips []ipRow
+		err = tx.SelectContext(ctx, &ips, s.q("SELECT prefix, ip, state, metadata, expires FROM {ips} WHERE tenantid=$1 AND prefix=$2"), r.Tenantid, r.Cidr)
+		if err != nil {
+			return fmt.Errorf("unable to read ips:%v", err)
+		}
+		for _, ip := range ips {
+			if ip.State == ipStateQuarantined {
+				p.quarantined[ip.IP] = time.Time{}
+				continue
+			}
+			p.Ips[ip.IP] = true
+		}
+		ranges, err := p.freeRangeRows()
+		if err != nil {
+			return fmt.Errorf("unable to calculate free ranges of prefix:%s %v", r.Cidr, err)
+		}
+		var rows [][]interface{}
+		for first, last := range ranges {
+			rows = append(rows, []interface{}{r.Tenantid, r.Cidr, first, last})
+		}
+		err = s.insertRows(ctx, tx, "{free_ranges}", []string{"tenantid", "prefix", "first_ip", "last_ip"}, rows)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isUniqueViolation returns true if the error was raised because a row with the same key exists.
+func isUniqueViolation(err error) bool {
+	switch e := err.(type) {
+	case *pq.Error:
+		return e.Code == "23505"
+	case sqlite3.Error:
+		return e.ExtendedCode == sqlite3.ErrConstraintPrimaryKey || e.ExtendedCode == sqlite3.ErrConstraintUnique
+	}
+	return false
+}
+
+// rollback the given transaction and return the error which caused the rollback.
+func rollback(tx *sqlx.Tx, cause error) error {
+	err := tx.Rollback()
+	if err != nil {
+		return fmt.Errorf("%v, rollback failed:%v", cause, err)
+	}
+	return cause
+}
@@ -1,16 +1,20 @@
 package ipam
 
 import (
+	"context"
 	"testing"
 
 	"time"
 
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
 var tenantid = "tenantid123-4567-abcd"
 
 func Test_sql_prefixExists(t *testing.T) {
+	ctx := context.Background()
 	testWithSQLBackends(t, func(t *testing.T, db *sql) {
 		require.NotNil(t, db)
 
@@ -20,39 +24,40 @@ func Test_sql_prefixExists(t *testing.T) {
 		require.Nil(t, err)
 		require.NotNil(t, p)
 		require.Equal(t, prefix.Cidr, p.Cidr)
-		got, exists := db.prefixExists(prefix,tenantid)
+		got, exists := db.prefixExists(ctx, prefix,tenantid)
 		require.True(t, exists)
 		require.Equal(t, got.Cidr, prefix.Cidr)
 
 		// NonExisting Prefix
 		notExistingPrefix := Prefix{Cidr: "10.0.0.0/8"}
-		got, exists = db.prefixExists(notExistingPrefix,tenantid)
+		got, exists = db.prefixExists(ctx, notExistingPrefix,tenantid)
 		require.False(t, exists)
 		require.Nil(t, got)
 
 		// Delete Existing Prefix
 		_, err = db.DeletePrefix(prefix,tenantid)
 		require.Nil(t, err)
-		got, exists = db.prefixExists(prefix,tenantid)
+		got, exists = db.prefixExists(ctx, prefix,tenantid)
 		require.False(t, exists)
 		require.Nil(t, got)
 	})
 }
 
 func Test_sql_CreatePrefix(t *testing.T) {
+	ctx := context.Background()
 	testWithSQLBackends(t, func(t *testing.T, db *sql) {
 		require.NotNil(t, db)
 
 		// Existing Prefix
 		prefix := Prefix{Cidr: "11.0.0.0/16"}
-		got, exists := db.prefixExists(prefix,tenantid)
+		got, exists := db.prefixExists(ctx, prefix,tenantid)
 		require.False(t, exists)
 		require.Nil(t, got)
 		p, err := db.CreatePrefix(prefix,tenantid)
 		require.Nil(t, err)
 		require.NotNil(t, p)
 		require.Equal(t, prefix.Cidr, p.Cidr)
-		got, exists = db.prefixExists(prefix,tenantid)
+		got, exists = db.prefixExists(ctx, prefix,tenantid)
 		require.True(t, exists)
 		require.Equal(t, got.Cidr, prefix.Cidr)
 
@@ -151,6 +156,206 @@ func Test_sql_UpdatePrefix(t *testing.T) {
 	})
 }
 
+func Test_sql_IPRows(t *testing.T) {
+	testWithSQLBackends(t, func(t *testing.T, db *sql) {
+		ipam := NewWithStorage(db)
+		prefix, err := ipam.NewPrefix("14.0.0.0/24", tenantid)
+		require.Nil(t, err)
+		ip, err := ipam.AcquireIP(prefix.Cidr, tenantid)
+		require.Nil(t, err)
+
+		var ips []string
+		err = db.db.Select(&ips, "SELECT ip FROM ips WHERE tenantid=$1 AND prefix=$2 ORDER BY ip", tenantid, prefix.Cidr)
+		require.Nil(t, err)
+		require.Equal(t, []string{"14.0.0.1"}, ips)
+
+		var record []byte
+		err = db.db.Get(&record, "SELECT prefix FROM prefixes WHERE cidr=$1 AND tenantid=$2", prefix.Cidr, tenantid)
+		require.Nil(t, err)
+		require.NotContains(t, string(record), "14.0.0.1")
+
+		_, err = ipam.ReleaseIP(ip, tenantid)
+		require.Nil(t, err)
+		var count int
+		err = db.db.Get(&count, "SELECT count(*) FROM ips WHERE tenantid=$1 AND prefix=$2", tenantid, prefix.Cidr)
+		require.Nil(t, err)
+		require.Equal(t, 0, count)
+
+		_, err = ipam.DeletePrefix(prefix.Cidr, tenantid)
+		require.Nil(t, err)
+		err = db.db.Get(&count, "SELECT count(*) FROM ips WHERE tenantid=$1", tenantid)
+		require.Nil(t, err)
+		require.Equal(t, 0, count)
+		_, err = db.ReadPrefix(prefix.Cidr, tenantid)
+		require.NotNil(t, err)
+	})
+}
+
+func Test_sql_IPRowConflicts(t *testing.T) {
+	testWithSQLBackends(t, func(t *testing.T, db *sql) {
+		// the acquired ip splits the free ips into two free ranges
+		_, err := db.CreatePrefix(Prefix{Cidr: "15.0.0.0/24", Ips: map[string]bool{"15.0.0.128": true}}, tenantid)
+		require.Nil(t, err)
+		p1, err := db.ReadPrefix("15.0.0.0/24", tenantid)
+		require.Nil(t, err)
+		p2, err := db.ReadPrefix("15.0.0.0/24", tenantid)
+		require.Nil(t, err)
+		p3, err := db.ReadPrefix("15.0.0.0/24", tenantid)
+		require.Nil(t, err)
+
+		// writing only ips leaves the version of the prefix unchanged
+		p1.Ips["15.0.0.1"] = true
+		p1, err = db.UpdatePrefix(p1, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, int64(0), p1.version)
+
+		// the same ip acquired concurrently violates the primary key of the ips table
+		p2.Ips["15.0.0.1"] = true
+		_, err = db.UpdatePrefix(p2, tenantid)
+		_, isOptimisticLock := errors.Cause(err).(OptimisticLockError)
+		require.True(t, isOptimisticLock, "error must be of type OptimisticLockError")
+
+		// another ip of the same free range conflicts with the acquired ip on the free range
+		delete(p2.Ips, "15.0.0.1")
+		p2.Ips["15.0.0.2"] = true
+		_, err = db.UpdatePrefix(p2, tenantid)
+		_, isOptimisticLock = errors.Cause(err).(OptimisticLockError)
+		require.True(t, isOptimisticLock, "error must be of type OptimisticLockError")
+
+		// an ip of another free range can be acquired concurrently
+		p3.Ips["15.0.0.200"] = true
+		p3, err = db.UpdatePrefix(p3, tenantid)
+		require.Nil(t, err)
+
+		// an ip released concurrently can not be released again
+		p4, err := db.ReadPrefix("15.0.0.0/24", tenantid)
+		require.Nil(t, err)
+		require.Equal(t, map[string]bool{"15.0.0.1": true, "15.0.0.128": true, "15.0.0.200": true}, p4.Ips)
+		delete(p1.Ips, "15.0.0.1")
+		_, err = db.UpdatePrefix(p1, tenantid)
+		require.Nil(t, err)
+		delete(p4.Ips, "15.0.0.1")
+		_, err = db.UpdatePrefix(p4, tenantid)
+		_, isOptimisticLock = errors.Cause(err).(OptimisticLockError)
+		require.True(t, isOptimisticLock, "error must be of type OptimisticLockError")
+
+		// a change of the record based on outdated ips fails
+		p5, err := db.ReadPrefix("15.0.0.0/24", tenantid)
+		require.Nil(t, err)
+		p3.Ips["15.0.0.201"] = true
+		_, err = db.UpdatePrefix(p3, tenantid)
+		require.Nil(t, err)
+		p5.Description = "outdated"
+		_, err = db.UpdatePrefix(p5, tenantid)
+		_, isOptimisticLock = errors.Cause(err).(OptimisticLockError)
+		require.True(t, isOptimisticLock, "error must be of type OptimisticLockError")
+	})
+}
+
+func Test_sql_ReadPartialPrefix(t *testing.T) {
+	ctx := context.Background()
+	testWithSQLBackends(t, func(t *testing.T, db *sql) {
+		now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+		ipam := NewWithStorage(db).(*ipamer)
+		ipam.clock = func() time.Time { return now }
+		prefix, err := ipam.NewPrefix("19.0.0.0/24", tenantid)
+		require.Nil(t, err)
+		_, err = ipam.AcquireIP(prefix.Cidr, tenantid)
+		require.Nil(t, err)
+		_, err = ipam.AcquireIP(prefix.Cidr, tenantid, WithStickyKey("web"))
+		require.Nil(t, err)
+		_, err = ipam.AcquireIP(prefix.Cidr, tenantid, WithLease(time.Minute))
+		require.Nil(t, err)
+
+		// the free ranges are stored in their own table
+		var ranges []string
+		err = db.db.Select(&ranges, "SELECT first_ip || '-' || last_ip FROM free_ranges WHERE tenantid=$1 AND prefix=$2", tenantid, prefix.Cidr)
+		require.Nil(t, err)
+		require.Equal(t, []string{"19.0.0.4-19.0.0.254"}, ranges)
+
+		// only the given ips, the ips bound to sticky keys and the ips with ended leases are read
+		p, err := db.ReadPartialPrefix(ctx, prefix.Cidr, tenantid, []string{"19.0.0.1"}, now)
+		require.Nil(t, err)
+		require.Equal(t, map[string]bool{"19.0.0.1": true, "19.0.0.2": true}, p.Ips)
+		require.Equal(t, []string{"19.0.0.4-19.0.0.254"}, p.formatFreeRanges())
+		require.True(t, p.partial())
+		p, err = db.ReadPartialPrefix(ctx, prefix.Cidr, tenantid, nil, now.Add(time.Minute))
+		require.Nil(t, err)
+		require.Equal(t, map[string]bool{"19.0.0.2": true, "19.0.0.3": true}, p.Ips)
+
+		// the expired lease ends on the next acquisition, its ip is free again
+		now = now.Add(time.Hour)
+		ip, err := ipam.AcquireIP(prefix.Cidr, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, "19.0.0.3", ip.IP.String())
+		read, err := db.ReadPrefix(prefix.Cidr, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, map[string]bool{"19.0.0.1": true, "19.0.0.2": true, "19.0.0.3": true}, read.Ips)
+		require.Empty(t, read.leases)
+		require.Equal(t, []string{"19.0.0.4-19.0.0.254"}, read.formatFreeRanges())
+	})
+}
+
+func Test_sql_CloseOwnedPoolOnly(t *testing.T) {
+	path := newSQLitePathForTest(t)
+	owned, err := NewSQLiteStorage(path)
+	require.Nil(t, err)
+	require.Nil(t, owned.Close())
+	require.NotNil(t, owned.db.Ping())
+
+	db, err := sqlx.Connect("sqlite3", path)
+	require.Nil(t, err)
+	defer db.Close()
+	given, err := newSQL(db, dialectSQLite, newSQLOptions(nil))
+	require.Nil(t, err)
+	require.Nil(t, given.Close())
+	require.Nil(t, db.Ping())
+}
+
+func Test_sql_migrateAllocations(t *testing.T) {
+	testWithSQLBackends(t, func(t *testing.T, db *sql) {
+		// a prefix as stored at schema version 1 with ips and child prefixes inside the json
+		pj := `{"Cidr":"15.0.0.0/16","ParentCidr":"","AvailableChildPrefixes":{"15.0.0.0/24":false,"15.0.1.0/24":true},"ChildPrefixLength":24,"IPs":{"15.0.0.1":true,"15.0.255.254":true},"Version":3}`
+		_, err := db.db.Exec("INSERT INTO prefixes (cidr, prefix, tenantid) VALUES ($1, $2, $3)", "15.0.0.0/16", pj, tenantid)
+		require.Nil(t, err)
+		prefix := Prefix{
+			Cidr:                   "15.0.0.0/16",
+			Ips:                    map[string]bool{"15.0.0.1": true, "15.0.255.254": true},
+			availableChildPrefixes: map[string]bool{"15.0.0.0/24": false, "15.0.1.0/24": true},
+		}
+
+		migrateAllocations(t, db)
+
+		p, err := db.ReadPrefix(prefix.Cidr, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, prefix.Ips, p.Ips)
+		require.Equal(t, prefix.availableChildPrefixes, p.availableChildPrefixes)
+		require.Equal(t, 24, p.childPrefixLength)
+		require.Equal(t, int64(3), p.version)
+
+		var record []byte
+		err = db.db.Get(&record, "SELECT prefix FROM prefixes WHERE cidr=$1 AND tenantid=$2", prefix.Cidr, tenantid)
+		require.Nil(t, err)
+		require.NotContains(t, string(record), "15.0.255.254")
+		require.Contains(t, string(record), "ChildPrefixLength")
+
+		// migrating again does not change anything
+		migrateAllocations(t, db)
+		p, err = db.ReadPrefix(prefix.Cidr, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, prefix.Ips, p.Ips)
+	})
+}
+
+func migrateAllocations(t *testing.T, db *sql) {
+	ctx := context.Background()
+	tx, err := db.db.BeginTxx(ctx, nil)
+	require.Nil(t, err)
+	err = db.migrateAllocations(ctx, tx)
+	require.Nil(t, err)
+	require.Nil(t, tx.Commit())
+}
+
 func Test_ConcurrentAcquirePrefix(t *testing.T) {
 	testWithSQLBackends(t, func(t *testing.T, db *sql) {
 		require.NotNil(t, db)
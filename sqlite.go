@@ -0,0 +1,30 @@
+package ipam
+
+import (
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+
+	// import for sqlx to use sqlite driver
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// NewSQLiteStorage creates a new Storage which uses a sqlite database stored in the file at path.
+// The sqlite driver requires cgo. WithSchema is not supported and the pool is limited to a single connection.
+func NewSQLiteStorage(path string, opts ...SQLOption) (*sql, error) {
+	db, err := sqlx.Connect("sqlite3", path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open database:%v", err)
+	}
+	o := newSQLOptions(opts)
+	// sqlite allows only one writer at a time, serialize all access
+	// to prevent "database is locked" errors on concurrent transactions.
+	o.maxOpenConns = 1
+	s, err := newSQL(db, dialectSQLite, o)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	s.ownsDB = true
+	return s, nil
+}
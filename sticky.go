@@ -0,0 +1,69 @@
+package ipam
+
+import (
+	"math/big"
+	"net"
+)
+
+// WithStickyKey binds the acquired ip to a key like a MAC address, a pod name or a machine UUID.
+// As long as the key holds its ip, AcquireIP returns that ip again. After the ip was released
+// AcquireIP acquires it again if it is still free, a quarantine of the ip does not apply to its key.
+// Otherwise a new ip is acquired according to the allocation strategy and bound to the key.
+// With the Hash allocation strategy the sticky key is used as key unless WithKey is given.
+func WithStickyKey(key string) AcquireOption {
+	return func(o *acquireOptions) {
+		o.stickyKey = key
+	}
+}
+
+// bind remembers that the ip was acquired with the sticky key,
+// other keys bound to the ip lose their binding. An empty key only removes the bindings of the ip.
+func (p *Prefix) bind(key, ip string) {
+	for k, bound := range p.bindings {
+		if bound == ip && k != key {
+			delete(p.bindings, k)
+		}
+	}
+	if key == "" {
+		return
+	}
+	if p.bindings == nil {
+		p.bindings = make(map[string]string)
+	}
+	p.bindings[key] = ip
+}
+
+// stickyIP returns the ip bound to the key if the key still holds it, otherwise it returns the bound ip
+// as preferred candidate for the acquisition if it can be acquired again.
+// The quarantine of a preferred candidate ends.
+func (p *Prefix) stickyIP(key string, ipnet *net.IPNet) (held string, preferred *big.Int, err error) {
+	ip, ok := p.bindings[key]
+	if key == "" || !ok {
+		return "", nil, nil
+	}
+	if _, acquired := p.Ips[ip]; acquired {
+		return ip, nil, nil
+	}
+	if p.reserved[ip] || !ipnet.Contains(net.ParseIP(ip)) {
+		return "", nil, nil
+	}
+	preferred, err = ipStringToInt(ip)
+	if err != nil {
+		return "", nil, err
+	}
+	if p.excluded(preferred) {
+		return "", nil, nil
+	}
+	if _, quarantined := p.quarantined[ip]; quarantined {
+		delete(p.quarantined, ip)
+		if p.freeRanges != nil {
+			p.addFree(preferred)
+		}
+	}
+	return "", preferred, nil
+}
+
+// StickyKeys returns the sticky keys of the prefix and the ips bound to them.
+func (p *Prefix) StickyKeys() map[string]string {
+	return copyLabels(p.bindings)
+}
@@ -0,0 +1,167 @@
+package ipam
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIpamer_AcquireIPWithStickyKey(t *testing.T) {
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		p, err := ipam.NewPrefix("10.80.0.0/24", tenantid)
+		require.Nil(t, err)
+
+		ip1, err := ipam.AcquireIP(p.Cidr, tenantid, WithStickyKey("aa:bb:cc:dd:ee:01"))
+		require.Nil(t, err)
+		require.Equal(t, "10.80.0.1", ip1.IP.String())
+		ip2, err := ipam.AcquireIP(p.Cidr, tenantid, WithStickyKey("aa:bb:cc:dd:ee:02"))
+		require.Nil(t, err)
+		require.Equal(t, "10.80.0.2", ip2.IP.String())
+
+		// the key still holds its ip
+		ip, err := ipam.AcquireIP(p.Cidr, tenantid, WithStickyKey("aa:bb:cc:dd:ee:01"))
+		require.Nil(t, err)
+		require.Equal(t, ip1.IP.String(), ip.IP.String())
+		require.Len(t, ipam.PrefixFrom(p.Cidr, tenantid).Ips, 2)
+
+		// the released ip is acquired again by its key although lower ips are free
+		err = ipam.ReleaseIPFromPrefix(p.Cidr, ip1.IP.String(), tenantid)
+		require.Nil(t, err)
+		err = ipam.ReleaseIPFromPrefix(p.Cidr, ip2.IP.String(), tenantid)
+		require.Nil(t, err)
+		ip, err = ipam.AcquireIP(p.Cidr, tenantid, WithStickyKey("aa:bb:cc:dd:ee:02"))
+		require.Nil(t, err)
+		require.Equal(t, ip2.IP.String(), ip.IP.String())
+
+		// the ip was acquired by someone else, the key gets a new ip
+		ip, err = ipam.AcquireIP(p.Cidr, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, ip1.IP.String(), ip.IP.String())
+		ip, err = ipam.AcquireIP(p.Cidr, tenantid, WithStickyKey("aa:bb:cc:dd:ee:01"))
+		require.Nil(t, err)
+		require.Equal(t, "10.80.0.3", ip.IP.String())
+		require.Equal(t, map[string]string{
+			"aa:bb:cc:dd:ee:01": "10.80.0.3",
+			"aa:bb:cc:dd:ee:02": "10.80.0.2",
+		}, ipam.PrefixFrom(p.Cidr, tenantid).StickyKeys())
+
+		// a specific ip acquired with a sticky key is bound to it
+		ip, err = ipam.AcquireSpecificIP(p.Cidr, "10.80.0.100", tenantid, WithStickyKey("pod-1"))
+		require.Nil(t, err)
+		err = ipam.ReleaseIPFromPrefix(p.Cidr, ip.IP.String(), tenantid)
+		require.Nil(t, err)
+		ip, err = ipam.AcquireIP(p.Cidr, tenantid, WithStickyKey("pod-1"))
+		require.Nil(t, err)
+		require.Equal(t, "10.80.0.100", ip.IP.String())
+	})
+}
+
+func TestIpamer_StickyKeyWithQuarantineAndStrategies(t *testing.T) {
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+		ipam.clock = func() time.Time { return now }
+
+		// the quarantine does not apply to the key of the released ip
+		p, err := ipam.NewPrefix("10.81.0.0/24", tenantid, WithReleaseQuarantine(time.Hour))
+		require.Nil(t, err)
+		ip1, err := ipam.AcquireIP(p.Cidr, tenantid, WithStickyKey("machine-1"))
+		require.Nil(t, err)
+		_, err = ipam.ReleaseIP(ip1, tenantid)
+		require.Nil(t, err)
+		ip, err := ipam.AcquireIP(p.Cidr, tenantid)
+		require.Nil(t, err)
+		require.NotEqual(t, ip1.IP.String(), ip.IP.String())
+		ip, err = ipam.AcquireIP(p.Cidr, tenantid, WithStickyKey("machine-1"))
+		require.Nil(t, err)
+		require.Equal(t, ip1.IP.String(), ip.IP.String())
+		require.Empty(t, ipam.PrefixFrom(p.Cidr, tenantid).QuarantinedIPs())
+
+		// the sticky key is the key of the Hash strategy
+		p, err = ipam.NewPrefix("10.82.0.0/24", tenantid, WithPrefixAllocationStrategy(Hash))
+		require.Nil(t, err)
+		ip, err = ipam.AcquireIP(p.Cidr, tenantid, WithStickyKey("machine-2"))
+		require.Nil(t, err)
+		hashed, err := ipam.AcquireIP("10.82.0.0/24", tenantid, WithKey("machine-2"))
+		require.Nil(t, err)
+		require.NotEqual(t, ip.IP.String(), hashed.IP.String())
+
+		// reacquiring the bound ip does not move the cursor of the RoundRobin strategy
+		p, err = ipam.NewPrefix("10.83.0.0/24", tenantid, WithPrefixAllocationStrategy(RoundRobin))
+		require.Nil(t, err)
+		for _, key := range []string{"a", "b", "c"} {
+			_, err = ipam.AcquireIP(p.Cidr, tenantid, WithStickyKey(key))
+			require.Nil(t, err)
+		}
+		err = ipam.ReleaseIPFromPrefix(p.Cidr, "10.83.0.1", tenantid)
+		require.Nil(t, err)
+		ip, err = ipam.AcquireIP(p.Cidr, tenantid, WithStickyKey("a"))
+		require.Nil(t, err)
+		require.Equal(t, "10.83.0.1", ip.IP.String())
+		ip, err = ipam.AcquireIP(p.Cidr, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, "10.83.0.4", ip.IP.String())
+	})
+}
+
+func Test_sql_StickyKeys(t *testing.T) {
+	testWithSQLBackends(t, func(t *testing.T, db *sql) {
+		ipam := &ipamer{}
+		p, err := ipam.newPrefix("10.84.0.0/24")
+		require.Nil(t, err)
+		p.bind("pod-1", "10.84.0.5")
+		_, err = db.CreatePrefix(*p, tenantid)
+		require.Nil(t, err)
+
+		read, err := db.ReadPrefix(p.Cidr, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, map[string]string{"pod-1": "10.84.0.5"}, read.StickyKeys())
+
+		// the sticky keys are stored in their own table
+		var record string
+		err = db.db.Get(&record, "SELECT prefix FROM prefixes WHERE cidr=$1 AND tenantid=$2", p.Cidr, tenantid)
+		require.Nil(t, err)
+		require.NotContains(t, record, "pod-1")
+		require.NotContains(t, record, "FreeRanges")
+
+		// a key bound concurrently to another ip can not be bound again
+		other, err := db.ReadPrefix(p.Cidr, tenantid)
+		require.Nil(t, err)
+		read.bind("pod-1", "10.84.0.6")
+		_, err = db.UpdatePrefix(read, tenantid)
+		require.Nil(t, err)
+		other.bind("pod-1", "10.84.0.7")
+		_, err = db.UpdatePrefix(other, tenantid)
+		_, isOptimisticLock := errors.Cause(err).(OptimisticLockError)
+		require.True(t, isOptimisticLock, "error must be of type OptimisticLockError")
+	})
+}
+
+func Test_sql_migrateBindings(t *testing.T) {
+	testWithSQLBackends(t, func(t *testing.T, db *sql) {
+		// a prefix as stored at schema version 5 with sticky keys and free ranges inside the json
+		pj := `{"Cidr":"10.85.0.0/24","ParentCidr":"","ChildPrefixLength":0,"Version":2,"FreeRanges":["10.85.0.2-10.85.0.254"],"Reserved":["10.85.0.0","10.85.0.255"],"Bindings":{"pod-1":"10.85.0.1"}}`
+		_, err := db.db.Exec("INSERT INTO prefixes (cidr, prefix, tenantid) VALUES ($1, $2, $3)", "10.85.0.0/24", pj, tenantid)
+		require.Nil(t, err)
+
+		ctx := context.Background()
+		tx, err := db.db.BeginTxx(ctx, nil)
+		require.Nil(t, err)
+		require.Nil(t, db.migrateBindings(ctx, tx))
+		require.Nil(t, tx.Commit())
+
+		p, err := db.ReadPrefix("10.85.0.0/24", tenantid)
+		require.Nil(t, err)
+		require.Equal(t, map[string]string{"pod-1": "10.85.0.1"}, p.StickyKeys())
+		require.Equal(t, []string{"10.85.0.0", "10.85.0.255"}, p.ReservedIPs())
+		require.Equal(t, int64(2), p.version)
+
+		var record string
+		err = db.db.Get(&record, "SELECT prefix FROM prefixes WHERE cidr=$1 AND tenantid=$2", p.Cidr, tenantid)
+		require.Nil(t, err)
+		require.NotContains(t, record, "Bindings")
+		require.NotContains(t, record, "FreeRanges")
+	})
+}
@@ -1,5 +1,12 @@
 package ipam
 
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
 // Storage is a interface to store ipam objects.
 type Storage interface {
 	CreatePrefix(prefix Prefix, tenantid string) (Prefix, error)
@@ -9,6 +16,65 @@ type Storage interface {
 	DeletePrefix(prefix Prefix, tenantid string) (Prefix, error)
 }
 
+// ContextStorage can be implemented by a Storage whose operations can be aborted with a context,
+// the Ipamer passes the context given to its Context methods to them.
+// The operations of a Storage which does not implement it are not started once the context is done.
+type ContextStorage interface {
+	CreatePrefixContext(ctx context.Context, prefix Prefix, tenantid string) (Prefix, error)
+	ReadPrefixContext(ctx context.Context, prefix string, tenantid string) (Prefix, error)
+	ReadAllPrefixesContext(ctx context.Context, tenantid string) ([]Prefix, error)
+	UpdatePrefixContext(ctx context.Context, prefix Prefix, tenantid string) (Prefix, error)
+	DeletePrefixContext(ctx context.Context, prefix Prefix, tenantid string) (Prefix, error)
+}
+
+// storageWithContext returns the context aware operations of the storage.
+func storageWithContext(storage Storage) ContextStorage {
+	if s, ok := storage.(ContextStorage); ok {
+		return s
+	}
+	return contextChecker{storage: storage}
+}
+
+// contextChecker checks the context before each operation of a Storage which does not implement ContextStorage.
+type contextChecker struct {
+	storage Storage
+}
+
+func (c contextChecker) CreatePrefixContext(ctx context.Context, prefix Prefix, tenantid string) (Prefix, error) {
+	if err := ctx.Err(); err != nil {
+		return Prefix{}, err
+	}
+	return c.storage.CreatePrefix(prefix, tenantid)
+}
+
+func (c contextChecker) ReadPrefixContext(ctx context.Context, prefix string, tenantid string) (Prefix, error) {
+	if err := ctx.Err(); err != nil {
+		return Prefix{}, err
+	}
+	return c.storage.ReadPrefix(prefix, tenantid)
+}
+
+func (c contextChecker) ReadAllPrefixesContext(ctx context.Context, tenantid string) ([]Prefix, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.storage.ReadAllPrefixes(tenantid)
+}
+
+func (c contextChecker) UpdatePrefixContext(ctx context.Context, prefix Prefix, tenantid string) (Prefix, error) {
+	if err := ctx.Err(); err != nil {
+		return Prefix{}, err
+	}
+	return c.storage.UpdatePrefix(prefix, tenantid)
+}
+
+func (c contextChecker) DeletePrefixContext(ctx context.Context, prefix Prefix, tenantid string) (Prefix, error) {
+	if err := ctx.Err(); err != nil {
+		return Prefix{}, err
+	}
+	return c.storage.DeletePrefix(prefix, tenantid)
+}
+
 // OptimisticLockError indicates that the operation could not be executed because the dataset to update has changed in the meantime.
 // clients can decide to read the current dataset and retry the operation.
 type OptimisticLockError struct {
@@ -22,3 +88,84 @@ func (o OptimisticLockError) Error() string {
 func newOptimisticLockError(msg string) OptimisticLockError {
 	return OptimisticLockError{msg: msg}
 }
+
+// ChangeOp is the kind of modification of a prefix in a PrefixChange.
+type ChangeOp int
+
+const (
+	// ChangeCreate creates the prefix, it must not be stored yet.
+	ChangeCreate ChangeOp = iota
+	// ChangeUpdate updates the prefix, it must still be stored with the version it was read with.
+	ChangeUpdate
+	// ChangeDelete deletes the prefix, it must still be stored with the version it was read with.
+	ChangeDelete
+)
+
+// PrefixChange is a modification of a prefix which a MultiPrefixStorage applies together with other changes.
+// For updates and deletes the version of the prefix is the version which is expected in the storage,
+// the change is applied only if the stored prefix still has this version.
+type PrefixChange struct {
+	Tenantid string
+	Prefix   Prefix
+	Op       ChangeOp
+}
+
+// Conflict returns an OptimisticLockError if the change can not be applied to the stored prefix, which is nil if not stored.
+func (c PrefixChange) Conflict(stored *Prefix) error {
+	switch {
+	case c.Op == ChangeCreate && stored != nil:
+		return newOptimisticLockError(fmt.Sprintf("prefix %s was created concurrently", c.Prefix.Cidr))
+	case c.Op != ChangeCreate && stored == nil:
+		return newOptimisticLockError(fmt.Sprintf("prefix %s was deleted concurrently", c.Prefix.Cidr))
+	case c.Op != ChangeCreate && stored.version != c.Prefix.version:
+		return newOptimisticLockError(fmt.Sprintf("prefix %s has version %d, expected %d", c.Prefix.Cidr, stored.version, c.Prefix.version))
+	}
+	return nil
+}
+
+// MultiPrefixStorage is implemented by storages which can apply modifications of several prefixes atomically,
+// e.g. a child prefix together with its parent or the changes of a transaction.
+// ApplyChanges applies either all changes or none, if a created prefix already exists or an updated or deleted
+// prefix has another version than expected an OptimisticLockError is returned.
+// Operations which modify several prefixes at once return ErrNotAtomic on a Storage which does not implement it.
+type MultiPrefixStorage interface {
+	ApplyChanges(ctx context.Context, changes []PrefixChange) error
+}
+
+// ErrNotAtomic is returned if several prefixes must be modified together in a Storage which does not implement MultiPrefixStorage.
+var ErrNotAtomic NotAtomicError
+
+// NotAtomicError is raised if several prefixes can not be modified atomically.
+type NotAtomicError struct {
+}
+
+func (o NotAtomicError) Error() string {
+	return "NotAtomic"
+}
+
+// applyChanges applies the changes to the storage atomically. A single change is applied
+// to every storage, several changes only to a MultiPrefixStorage, otherwise ErrNotAtomic is returned.
+func applyChanges(ctx context.Context, storage Storage, changes []PrefixChange) error {
+	if multi, ok := storage.(MultiPrefixStorage); ok {
+		return multi.ApplyChanges(ctx, changes)
+	}
+	if len(changes) > 1 {
+		return fmt.Errorf("%w: the storage can not modify %d prefixes together", ErrNotAtomic, len(changes))
+	}
+	s := storageWithContext(storage)
+	for _, c := range changes {
+		var err error
+		switch c.Op {
+		case ChangeCreate:
+			_, err = s.CreatePrefixContext(ctx, c.Prefix, c.Tenantid)
+		case ChangeUpdate:
+			_, err = s.UpdatePrefixContext(ctx, c.Prefix, c.Tenantid)
+		case ChangeDelete:
+			_, err = s.DeletePrefixContext(ctx, c.Prefix, c.Tenantid)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "unable to apply change of prefix:%s", c.Prefix.Cidr)
+		}
+	}
+	return nil
+}
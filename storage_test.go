@@ -0,0 +1,56 @@
+package ipam
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_applyChanges(t *testing.T) {
+	ctx := context.Background()
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		parent, err := ipam.NewPrefix("10.110.0.0/16", tenantid)
+		require.Nil(t, err)
+		child, err := ipam.newPrefix("10.110.0.0/24")
+		require.Nil(t, err)
+		child.ParentCidr = parent.Cidr
+		parent.availableChildPrefixes[child.Cidr] = false
+
+		// an outdated version of one prefix leaves all prefixes unchanged
+		stale := *parent.DeepCopy()
+		stale.version = 5
+		err = applyChanges(ctx, ipam.storage, []PrefixChange{
+			{Tenantid: tenantid, Prefix: *child, Op: ChangeCreate},
+			{Tenantid: tenantid, Prefix: stale, Op: ChangeUpdate},
+		})
+		require.IsType(t, OptimisticLockError{}, err)
+		require.Nil(t, ipam.PrefixFrom(child.Cidr, tenantid))
+		require.Empty(t, ipam.PrefixFrom(parent.Cidr, tenantid).availableChildPrefixes)
+
+		err = applyChanges(ctx, ipam.storage, []PrefixChange{
+			{Tenantid: tenantid, Prefix: *child, Op: ChangeCreate},
+			{Tenantid: tenantid, Prefix: *parent, Op: ChangeUpdate},
+		})
+		require.Nil(t, err)
+		stored := ipam.PrefixFrom(parent.Cidr, tenantid)
+		require.Equal(t, map[string]bool{child.Cidr: false}, stored.availableChildPrefixes)
+		require.Equal(t, parent.version+1, stored.version)
+		require.Equal(t, parent.Cidr, ipam.PrefixFrom(child.Cidr, tenantid).ParentCidr)
+
+		// a created prefix must not exist, a deleted one must have the expected version
+		err = applyChanges(ctx, ipam.storage, []PrefixChange{
+			{Tenantid: tenantid, Prefix: *child, Op: ChangeCreate},
+		})
+		require.IsType(t, OptimisticLockError{}, err)
+		err = applyChanges(ctx, ipam.storage, []PrefixChange{
+			{Tenantid: tenantid, Prefix: *parent, Op: ChangeDelete},
+		})
+		require.IsType(t, OptimisticLockError{}, err)
+		err = applyChanges(ctx, ipam.storage, []PrefixChange{
+			{Tenantid: tenantid, Prefix: *stored, Op: ChangeDelete},
+		})
+		require.Nil(t, err)
+		require.Nil(t, ipam.PrefixFrom(parent.Cidr, tenantid))
+	})
+}
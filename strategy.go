@@ -0,0 +1,184 @@
+package ipam
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/big"
+	"math/rand"
+	"time"
+)
+
+// AllocationStrategy defines which free ip or child prefix is acquired next.
+type AllocationStrategy string
+
+const (
+	// LowestFree acquires the free ip or child prefix with the lowest address, this is the default.
+	LowestFree = AllocationStrategy("lowest-free")
+	// RoundRobin continues after the last acquired ip or child prefix and wraps around at the end of the prefix,
+	// released ips are only reused after all other ips were used.
+	RoundRobin = AllocationStrategy("round-robin")
+	// Random acquires a random free ip or child prefix.
+	Random = AllocationStrategy("random")
+	// Hash acquires the ip or child prefix at the position derived from the key given with WithKey,
+	// or the next free one after it. The same key results in the same ip as long as it is free.
+	Hash = AllocationStrategy("hash")
+)
+
+func (s AllocationStrategy) validate() error {
+	switch s {
+	case "", LowestFree, RoundRobin, Random, Hash:
+		return nil
+	}
+	return fmt.Errorf("unknown allocation strategy:%s", s)
+}
+
+// Option configures a Ipamer.
+type Option func(*ipamer)
+
+// WithAllocationStrategy sets the allocation strategy of all prefixes which were created without their own strategy.
+func WithAllocationStrategy(strategy AllocationStrategy) Option {
+	return func(i *ipamer) {
+		i.strategy = strategy
+	}
+}
+
+// PrefixOption configures a Prefix on creation.
+type PrefixOption func(*Prefix) error
+
+// WithPrefixAllocationStrategy sets the allocation strategy of the prefix, it takes precedence over the strategy of the Ipamer.
+func WithPrefixAllocationStrategy(strategy AllocationStrategy) PrefixOption {
+	return func(p *Prefix) error {
+		err := strategy.validate()
+		if err != nil {
+			return err
+		}
+		p.allocationStrategy = strategy
+		return nil
+	}
+}
+
+// AcquireOption configures the acquisition of an ip or child prefix.
+type AcquireOption func(*acquireOptions)
+
+type acquireOptions struct {
+	key                string
+	overrideExclusions bool
+	metadata           IPMetadata
+	lease              time.Duration
+	stickyKey          string
+}
+
+// WithKey sets the key the Hash allocation strategy derives the acquired ip or child prefix from.
+func WithKey(key string) AcquireOption {
+	return func(o *acquireOptions) {
+		o.key = key
+	}
+}
+
+func newAcquireOptions(opts []AcquireOption) acquireOptions {
+	var o acquireOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.key == "" {
+		o.key = o.stickyKey
+	}
+	return o
+}
+
+// strategyOf returns the allocation strategy which applies to the prefix.
+func (i *ipamer) strategyOf(p *Prefix) AllocationStrategy {
+	if p.allocationStrategy != "" {
+		return p.allocationStrategy
+	}
+	if i.strategy != "" {
+		return i.strategy
+	}
+	return LowestFree
+}
+
+// searchStart returns the address in the range from start inclusive to end exclusive
+// where the search for a free ip or child prefix begins.
+func (i *ipamer) searchStart(p *Prefix, start, end *big.Int, o acquireOptions) (*big.Int, error) {
+	size := new(big.Int).Sub(end, start)
+	strategy := i.strategyOf(p)
+	switch strategy {
+	case LowestFree:
+	case RoundRobin:
+		if p.cursor != nil && p.cursor.Cmp(start) >= 0 && p.cursor.Cmp(end) < 0 {
+			return new(big.Int).Set(p.cursor), nil
+		}
+	case Random:
+		offset := new(big.Int).Rand(rand.New(rand.NewSource(rand.Int63())), size)
+		return offset.Add(offset, start), nil
+	case Hash:
+		if o.key == "" {
+			return nil, fmt.Errorf("allocation strategy %s requires a key", Hash)
+		}
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(o.key))
+		offset := new(big.Int).SetUint64(h.Sum64())
+		offset.Mod(offset, size)
+		return offset.Add(offset, start), nil
+	default:
+		return nil, strategy.validate()
+	}
+	return new(big.Int).Set(start), nil
+}
+
+// advanceCursor remembers next as the position after the last acquisition, wrapping around at end.
+func (p *Prefix) advanceCursor(next, start, end *big.Int) {
+	if next.Cmp(end) >= 0 {
+		next = start
+	}
+	p.cursor = new(big.Int).Set(next)
+}
+
+// nextFree returns the first free ip at or after from, wrapping around at the end of the free ranges.
+// It returns nil if the prefix is full.
+func (p *Prefix) nextFree(from *big.Int) *big.Int {
+	if len(p.freeRanges) == 0 {
+		return nil
+	}
+	i := p.freeRangeIndexFrom(from)
+	if i == len(p.freeRanges) {
+		return new(big.Int).Set(p.freeRanges[0].start)
+	}
+	r := p.freeRanges[i]
+	if r.start.Cmp(from) > 0 {
+		return new(big.Int).Set(r.start)
+	}
+	return new(big.Int).Set(from)
+}
+
+// formatCursor serializes the cursor of the prefix as ip, empty if there is none.
+func (p *Prefix) formatCursor() string {
+	if p.cursor == nil {
+		return ""
+	}
+	ipnet, err := p.IPNet()
+	if err != nil {
+		return ""
+	}
+	_, bits := ipnet.Mask.Size()
+	return intToIP(p.cursor, bits).String()
+}
+
+// parseCursor deserializes a cursor formatted with formatCursor, nil if it is empty or invalid.
+func parseCursor(s string) *big.Int {
+	if s == "" {
+		return nil
+	}
+	cursor, err := ipStringToInt(s)
+	if err != nil {
+		return nil
+	}
+	return cursor
+}
+
+func copyInt(i *big.Int) *big.Int {
+	if i == nil {
+		return nil
+	}
+	return new(big.Int).Set(i)
+}
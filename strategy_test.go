@@ -0,0 +1,168 @@
+package ipam
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIpamer_AcquireIPRoundRobin(t *testing.T) {
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		p, err := ipam.NewPrefix("10.10.0.0/29", tenantid, WithPrefixAllocationStrategy(RoundRobin))
+		require.Nil(t, err)
+
+		ip1, err := ipam.AcquireIP(p.Cidr, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, "10.10.0.1", ip1.IP.String())
+		ip2, err := ipam.AcquireIP(p.Cidr, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, "10.10.0.2", ip2.IP.String())
+
+		// a released ip is not handed out again until the cursor wraps around
+		_, err = ipam.ReleaseIP(ip1, tenantid)
+		require.Nil(t, err)
+		for _, expected := range []string{"10.10.0.3", "10.10.0.4", "10.10.0.5", "10.10.0.6", "10.10.0.1"} {
+			ip, err := ipam.AcquireIP(p.Cidr, tenantid)
+			require.Nil(t, err)
+			require.Equal(t, expected, ip.IP.String())
+		}
+		_, err = ipam.AcquireIP(p.Cidr, tenantid)
+		require.True(t, errors.Is(err, ErrNoIPAvailable))
+	})
+}
+
+func TestIpamer_AcquireIPIpamerStrategy(t *testing.T) {
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		ipam.strategy = RoundRobin
+		p, err := ipam.NewPrefix("10.10.1.0/29", tenantid)
+		require.Nil(t, err)
+		lowest, err := ipam.NewPrefix("10.10.2.0/29", tenantid, WithPrefixAllocationStrategy(LowestFree))
+		require.Nil(t, err)
+
+		for _, cidr := range []string{p.Cidr, lowest.Cidr} {
+			ip, err := ipam.AcquireIP(cidr, tenantid)
+			require.Nil(t, err)
+			_, err = ipam.ReleaseIP(ip, tenantid)
+			require.Nil(t, err)
+		}
+		ip, err := ipam.AcquireIP(p.Cidr, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, "10.10.1.2", ip.IP.String())
+		// the strategy of the prefix takes precedence
+		ip, err = ipam.AcquireIP(lowest.Cidr, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, "10.10.2.1", ip.IP.String())
+	})
+}
+
+func TestIpamer_AcquireIPHash(t *testing.T) {
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		p1, err := ipam.NewPrefix("10.11.0.0/24", tenantid, WithPrefixAllocationStrategy(Hash))
+		require.Nil(t, err)
+		p2, err := ipam.NewPrefix("10.12.0.0/24", tenantid, WithPrefixAllocationStrategy(Hash))
+		require.Nil(t, err)
+
+		_, err = ipam.AcquireIP(p1.Cidr, tenantid)
+		require.EqualError(t, err, "allocation strategy hash requires a key")
+
+		ip1, err := ipam.AcquireIP(p1.Cidr, tenantid, WithKey("machine-1"))
+		require.Nil(t, err)
+		ip2, err := ipam.AcquireIP(p2.Cidr, tenantid, WithKey("machine-1"))
+		require.Nil(t, err)
+		// the same key results in the same offset in prefixes of the same size
+		require.Equal(t, ip1.IP.To4()[3], ip2.IP.To4()[3])
+
+		// a released ip is acquired again with the same key
+		_, err = ipam.ReleaseIP(ip1, tenantid)
+		require.Nil(t, err)
+		ip, err := ipam.AcquireIP(p1.Cidr, tenantid, WithKey("machine-1"))
+		require.Nil(t, err)
+		require.Equal(t, ip1.IP.String(), ip.IP.String())
+
+		// the next free ip is acquired if the one of the key is in use
+		ip, err = ipam.AcquireIP(p1.Cidr, tenantid, WithKey("machine-1"))
+		require.Nil(t, err)
+		require.NotEqual(t, ip1.IP.String(), ip.IP.String())
+	})
+}
+
+func TestIpamer_AcquireIPRandom(t *testing.T) {
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		p, err := ipam.NewPrefix("10.13.0.0/28", tenantid, WithPrefixAllocationStrategy(Random))
+		require.Nil(t, err)
+		ipnet, err := p.IPNet()
+		require.Nil(t, err)
+
+		acquired := make(map[string]bool)
+		for n := 0; n < 14; n++ {
+			ip, err := ipam.AcquireIP(p.Cidr, tenantid)
+			require.Nil(t, err)
+			require.True(t, ipnet.Contains(ip.IP))
+			require.False(t, acquired[ip.IP.String()], "%s acquired twice", ip.IP)
+			acquired[ip.IP.String()] = true
+		}
+		_, err = ipam.AcquireIP(p.Cidr, tenantid)
+		require.True(t, errors.Is(err, ErrNoIPAvailable))
+	})
+}
+
+func TestIpamer_AcquireChildPrefixRoundRobin(t *testing.T) {
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		p, err := ipam.NewPrefix("10.14.0.0/22", tenantid, WithPrefixAllocationStrategy(RoundRobin))
+		require.Nil(t, err)
+
+		c1, err := ipam.AcquireChildPrefix(p.Cidr, 24, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, "10.14.0.0/24", c1.Cidr)
+		c2, err := ipam.AcquireChildPrefix(p.Cidr, 24, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, "10.14.1.0/24", c2.Cidr)
+		err = ipam.ReleaseChildPrefix(c1, tenantid)
+		require.Nil(t, err)
+
+		for _, expected := range []string{"10.14.2.0/24", "10.14.3.0/24", "10.14.0.0/24"} {
+			c, err := ipam.AcquireChildPrefix(p.Cidr, 24, tenantid)
+			require.Nil(t, err)
+			require.Equal(t, expected, c.Cidr)
+		}
+		_, err = ipam.AcquireChildPrefix(p.Cidr, 24, tenantid)
+		require.EqualError(t, err, "no more child prefixes contained in prefix pool")
+	})
+}
+
+func TestIpamer_AcquireChildPrefixHash(t *testing.T) {
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		p, err := ipam.NewPrefix("2001:db8:10::/48", tenantid, WithPrefixAllocationStrategy(Hash))
+		require.Nil(t, err)
+
+		c1, err := ipam.AcquireChildPrefix(p.Cidr, 64, tenantid, WithKey("cluster-1"))
+		require.Nil(t, err)
+		_, ipnet, err := net.ParseCIDR(c1.Cidr)
+		require.Nil(t, err)
+		ones, _ := ipnet.Mask.Size()
+		require.Equal(t, 64, ones)
+
+		err = ipam.ReleaseChildPrefix(c1, tenantid)
+		require.Nil(t, err)
+		c, err := ipam.AcquireChildPrefix(p.Cidr, 64, tenantid, WithKey("cluster-1"))
+		require.Nil(t, err)
+		require.Equal(t, c1.Cidr, c.Cidr)
+		c, err = ipam.AcquireChildPrefix(p.Cidr, 64, tenantid, WithKey("cluster-1"))
+		require.Nil(t, err)
+		require.NotEqual(t, c1.Cidr, c.Cidr)
+	})
+}
+
+func TestIpamer_NewPrefixUnknownStrategy(t *testing.T) {
+	ipam := New()
+	_, err := ipam.NewPrefix("10.15.0.0/24", tenantid, WithPrefixAllocationStrategy("first-fit"))
+	require.EqualError(t, err, "unknown allocation strategy:first-fit")
+
+	ipam = New(WithAllocationStrategy("first-fit"))
+	p, err := ipam.NewPrefix("10.15.0.0/24", tenantid)
+	require.Nil(t, err)
+	_, err = ipam.AcquireIP(p.Cidr, tenantid)
+	require.EqualError(t, err, "unknown allocation strategy:first-fit")
+}
@@ -2,16 +2,26 @@ package ipam
 
 import (
 	"context"
+	"io/ioutil"
+	"path/filepath"
 	"sync"
 	"testing"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/testcontainers/testcontainers-go"
 	"github.com/testcontainers/testcontainers-go/wait"
+	bbolt "go.etcd.io/bbolt"
 )
 
 var (
 	pgOnce      sync.Once
 	crOnce      sync.Once
+	sqliteOnce  sync.Once
+	sqliteStore *sql
+	boltOnce    sync.Once
+	boltStore   *bolt
+	redisOnce   sync.Once
+	redisServer *miniredis.Miniredis
 	pgContainer testcontainers.Container
 	crContainer testcontainers.Container
 )
@@ -89,6 +99,33 @@ func startCockroach() (container testcontainers.Container, dn *sql, err error) {
 	return crContainer, db, err
 }
 
+// startSQLite returns always the same storage which is cleaned up before every test,
+// opening the database file for every test would leak its connections.
+func startSQLite() (*sql, error) {
+	var err error
+	sqliteOnce.Do(func() {
+		dir, e := ioutil.TempDir("", "go-ipam")
+		if e != nil {
+			panic(e.Error())
+		}
+		sqliteStore, err = NewSQLiteStorage(filepath.Join(dir, "ipam.db"))
+	})
+	return sqliteStore, err
+}
+
+// startBolt returns always the same storage because the database file can only be opened once.
+func startBolt() (*bolt, error) {
+	var err error
+	boltOnce.Do(func() {
+		dir, e := ioutil.TempDir("", "go-ipam")
+		if e != nil {
+			panic(e.Error())
+		}
+		boltStore, err = NewBoltStorage(filepath.Join(dir, "ipam.bolt"))
+	})
+	return boltStore, err
+}
+
 // func stopDB(c testcontainers.Container) error {
 // 	ctx := context.Background()
 // 	return c.Terminate(ctx)
@@ -138,24 +175,63 @@ func newCockroachWithCleanup() (*ExtendedSQL, error) {
 
 // cleanup database before test
 func (e *ExtendedSQL) cleanup() error {
-	tx := e.sql.db.MustBegin()
-	_, err := e.sql.db.Exec("TRUNCATE TABLE prefixes")
-	if err != nil {
-		return err
-	}
-	return tx.Commit()
+	return e.sql.cleanup()
 }
 
 // cleanup database before test
 func (sql *sql) cleanup() error {
+	truncate := []string{"TRUNCATE TABLE {prefixes}, {ips}, {child_prefixes}, {bindings}, {free_ranges}"}
+	if sql.dialect == dialectSQLite {
+		truncate = []string{"DELETE FROM {prefixes}", "DELETE FROM {ips}", "DELETE FROM {child_prefixes}", "DELETE FROM {bindings}", "DELETE FROM {free_ranges}"}
+	}
 	tx := sql.db.MustBegin()
-	_, err := sql.db.Exec("TRUNCATE TABLE prefixes")
-	if err != nil {
-		return err
+	for _, stmt := range truncate {
+		_, err := tx.Exec(sql.q(stmt))
+		if err != nil {
+			return rollback(tx, err)
+		}
 	}
 	return tx.Commit()
 }
 
+// startRedis returns a storage connected to a in process redis server.
+func startRedis() (*redis, error) {
+	redisOnce.Do(func() {
+		var err error
+		redisServer, err = miniredis.Run()
+		if err != nil {
+			panic(err.Error())
+		}
+	})
+	return NewRedisStorage(redisServer.Addr(), "", 0)
+}
+
+// cleanup database before test
+func (r *redis) cleanup() error {
+	return r.client.FlushDB().Err()
+}
+
+// cleanup database before test
+func (b *bolt) cleanup() error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		var tenants [][]byte
+		err := tx.ForEach(func(name []byte, _ *bbolt.Bucket) error {
+			tenants = append(tenants, name)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, tenant := range tenants {
+			err := tx.DeleteBucket(tenant)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 type testMethod func(t *testing.T, ipam *ipamer)
 
 func testWithBackends(t *testing.T, fn testMethod) {
@@ -214,15 +290,58 @@ type StorageProvider struct {
 
 func storageProviders() []StorageProvider {
 	return []StorageProvider{
-		//{
-		//	name: "Memory",
-		//	provide: func() Storage {
-		//		return NewMemory()
-		//	},
-		//	providesql: func() *sql {
-		//		return nil
-		//	},
-		//},
+		{
+			name: "Memory",
+			provide: func() Storage {
+				return NewMemory()
+			},
+			providesql: func() *sql {
+				return nil
+			},
+		},
+		{
+			name: "SQLite",
+			provide: func() Storage {
+				storage, err := startSQLite()
+				if err != nil {
+					panic("error getting sqlite storage")
+				}
+				return storage
+			},
+			providesql: func() *sql {
+				storage, err := startSQLite()
+				if err != nil {
+					panic("error getting sqlite storage")
+				}
+				return storage
+			},
+		},
+		{
+			name: "Bolt",
+			provide: func() Storage {
+				storage, err := startBolt()
+				if err != nil {
+					panic("error getting bolt storage")
+				}
+				return storage
+			},
+			providesql: func() *sql {
+				return nil
+			},
+		},
+		{
+			name: "Redis",
+			provide: func() Storage {
+				storage, err := startRedis()
+				if err != nil {
+					panic("error getting redis storage")
+				}
+				return storage
+			},
+			providesql: func() *sql {
+				return nil
+			},
+		},
 		{
 			name: "Postgres",
 			provide: func() Storage {
@@ -0,0 +1,257 @@
+package ipam
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// stagedPrefix is the state of a prefix modified in a transaction.
+type stagedPrefix struct {
+	prefix      Prefix // the prefix as seen inside the transaction
+	op          ChangeOp
+	deleted     bool
+	baseVersion int64 // the version of the prefix in the underlying storage, unused for created prefixes
+}
+
+// stagedKey identifies a staged prefix.
+type stagedKey struct {
+	tenantid string
+	cidr     string
+}
+
+// txStorage stages all modifications of prefixes on top of an underlying storage,
+// reads return the staged prefixes and fall through to the underlying storage for all others.
+// changes returns the staged modifications to be applied to the underlying storage.
+type txStorage struct {
+	base   Storage
+	staged map[string]map[string]*stagedPrefix // staged prefixes by tenantid and cidr
+	order  []stagedKey                         // the staged prefixes in the order of their first modification
+	lock   sync.Mutex
+}
+
+func newTxStorage(base Storage) *txStorage {
+	return &txStorage{
+		base:   base,
+		staged: make(map[string]map[string]*stagedPrefix),
+	}
+}
+
+func (t *txStorage) lookup(cidr, tenantid string) *stagedPrefix {
+	return t.staged[tenantid][cidr]
+}
+
+func (t *txStorage) stage(s *stagedPrefix, tenantid string) {
+	tenantPrefixes, ok := t.staged[tenantid]
+	if !ok {
+		tenantPrefixes = make(map[string]*stagedPrefix)
+		t.staged[tenantid] = tenantPrefixes
+	}
+	if _, ok := tenantPrefixes[s.prefix.Cidr]; !ok {
+		t.order = append(t.order, stagedKey{tenantid: tenantid, cidr: s.prefix.Cidr})
+	}
+	tenantPrefixes[s.prefix.Cidr] = s
+}
+
+// current returns the prefix as seen inside the transaction, nil if it does not exist.
+// The storages do not distinguish a missing prefix from other read errors, both are treated as missing.
+func (t *txStorage) current(ctx context.Context, cidr, tenantid string) *stagedPrefix {
+	s := t.lookup(cidr, tenantid)
+	if s != nil {
+		if s.deleted {
+			return nil
+		}
+		return s
+	}
+	p, err := storageWithContext(t.base).ReadPrefixContext(ctx, cidr, tenantid)
+	if err != nil {
+		return nil
+	}
+	return &stagedPrefix{prefix: p, op: ChangeUpdate, baseVersion: p.version}
+}
+
+func (t *txStorage) CreatePrefix(prefix Prefix, tenantid string) (Prefix, error) {
+	return t.CreatePrefixContext(context.Background(), prefix, tenantid)
+}
+
+func (t *txStorage) CreatePrefixContext(ctx context.Context, prefix Prefix, tenantid string) (Prefix, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	existing := t.current(ctx, prefix.Cidr, tenantid)
+	if existing != nil {
+		return *existing.prefix.DeepCopy(), nil
+	}
+	prefix.version = int64(0)
+	s := &stagedPrefix{prefix: *prefix.DeepCopy(), op: ChangeCreate}
+	// a prefix deleted and created again in the transaction replaces the stored one
+	if deleted := t.lookup(prefix.Cidr, tenantid); deleted != nil && deleted.op != ChangeCreate {
+		s.op = ChangeUpdate
+		s.baseVersion = deleted.baseVersion
+	}
+	t.stage(s, tenantid)
+	return prefix, nil
+}
+
+func (t *txStorage) ReadPrefix(prefix string, tenantid string) (Prefix, error) {
+	return t.ReadPrefixContext(context.Background(), prefix, tenantid)
+}
+
+func (t *txStorage) ReadPrefixContext(ctx context.Context, prefix string, tenantid string) (Prefix, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	s := t.lookup(prefix, tenantid)
+	if s == nil {
+		return storageWithContext(t.base).ReadPrefixContext(ctx, prefix, tenantid)
+	}
+	if s.deleted {
+		return Prefix{}, errors.Errorf("Prefix %s not found", prefix)
+	}
+	return *s.prefix.DeepCopy(), nil
+}
+
+func (t *txStorage) ReadAllPrefixes(tenantid string) ([]Prefix, error) {
+	return t.ReadAllPrefixesContext(context.Background(), tenantid)
+}
+
+func (t *txStorage) ReadAllPrefixesContext(ctx context.Context, tenantid string) ([]Prefix, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	stored, err := storageWithContext(t.base).ReadAllPrefixesContext(ctx, tenantid)
+	if err != nil {
+		return nil, err
+	}
+	ps := make([]Prefix, 0, len(stored))
+	for _, p := range stored {
+		if t.lookup(p.Cidr, tenantid) == nil {
+			ps = append(ps, p)
+		}
+	}
+	for _, s := range t.staged[tenantid] {
+		if !s.deleted {
+			ps = append(ps, *s.prefix.DeepCopy())
+		}
+	}
+	return ps, nil
+}
+
+// UpdatePrefix stages the update of the prefix.
+// Returns OptimisticLockError if the prefix was modified since it was read.
+func (t *txStorage) UpdatePrefix(prefix Prefix, tenantid string) (Prefix, error) {
+	return t.UpdatePrefixContext(context.Background(), prefix, tenantid)
+}
+
+func (t *txStorage) UpdatePrefixContext(ctx context.Context, prefix Prefix, tenantid string) (Prefix, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if prefix.Cidr == "" {
+		return Prefix{}, fmt.Errorf("prefix not present:%v", prefix)
+	}
+	s := t.current(ctx, prefix.Cidr, tenantid)
+	if s == nil {
+		return Prefix{}, fmt.Errorf("prefix not found:%s", prefix.Cidr)
+	}
+	if s.prefix.version != prefix.version {
+		return Prefix{}, newOptimisticLockError(fmt.Sprintf("prefix %s has version %d, expected %d", prefix.Cidr, s.prefix.version, prefix.version))
+	}
+	prefix.version++
+	t.stage(&stagedPrefix{prefix: *prefix.DeepCopy(), op: s.op, baseVersion: s.baseVersion}, tenantid)
+	return prefix, nil
+}
+
+func (t *txStorage) DeletePrefix(prefix Prefix, tenantid string) (Prefix, error) {
+	return t.DeletePrefixContext(context.Background(), prefix, tenantid)
+}
+
+func (t *txStorage) DeletePrefixContext(ctx context.Context, prefix Prefix, tenantid string) (Prefix, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	s := t.current(ctx, prefix.Cidr, tenantid)
+	if s != nil {
+		t.stage(&stagedPrefix{prefix: s.prefix, op: s.op, deleted: true, baseVersion: s.baseVersion}, tenantid)
+	}
+	return *prefix.DeepCopy(), nil
+}
+
+// changes returns the staged modifications in the order of their first modification.
+// The version of updated and deleted prefixes is the version they had in the underlying storage.
+func (t *txStorage) changes() []PrefixChange {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var result []PrefixChange
+	for _, o := range t.order {
+		s := t.lookup(o.cidr, o.tenantid)
+		c := PrefixChange{Tenantid: o.tenantid, Prefix: *s.prefix.DeepCopy(), Op: s.op}
+		switch {
+		case s.deleted && s.op == ChangeCreate:
+			// created and deleted again, the underlying storage never sees it
+			continue
+		case s.deleted:
+			c.Op = ChangeDelete
+		}
+		if c.Op != ChangeCreate {
+			c.Prefix.version = s.baseVersion
+		}
+		result = append(result, c)
+	}
+	return result
+}
+
+// ApplyChanges stages the changes of a nested transaction.
+func (t *txStorage) ApplyChanges(ctx context.Context, changes []PrefixChange) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// check all changes before any of them is staged
+	current := make([]*stagedPrefix, len(changes))
+	for n, c := range changes {
+		s := t.current(ctx, c.Prefix.Cidr, c.Tenantid)
+		var stored *Prefix
+		if s != nil {
+			stored = &s.prefix
+		}
+		err := c.Conflict(stored)
+		if err != nil {
+			return err
+		}
+		current[n] = s
+	}
+	for n, c := range changes {
+		s := &stagedPrefix{prefix: *c.Prefix.DeepCopy(), op: ChangeCreate}
+		if c.Op == ChangeCreate {
+			if deleted := t.lookup(c.Prefix.Cidr, c.Tenantid); deleted != nil && deleted.op != ChangeCreate {
+				s.op = ChangeUpdate
+				s.baseVersion = deleted.baseVersion
+			}
+		} else {
+			s.op = current[n].op
+			s.baseVersion = current[n].baseVersion
+			s.deleted = c.Op == ChangeDelete
+			s.prefix.version++
+		}
+		t.stage(s, c.Tenantid)
+	}
+	return nil
+}
+
+func (i *ipamer) Tx(fn func(tx Ipamer) error) error {
+	return i.TxContext(context.Background(), fn)
+}
+
+func (i *ipamer) TxContext(ctx context.Context, fn func(tx Ipamer) error) error {
+	return retryOnOptimisticLock(ctx, func() error {
+		staged := newTxStorage(i.storage)
+		err := fn(&ipamer{storage: staged, strategy: i.strategy, clock: i.clock})
+		if err != nil {
+			return err
+		}
+		return applyChanges(ctx, i.storage, staged.changes())
+	})
+}
@@ -0,0 +1,202 @@
+package ipam
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIpamer_Tx(t *testing.T) {
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		err := ipam.Tx(func(tx Ipamer) error {
+			site, err := tx.NewPrefix("10.100.0.0/16", tenantid)
+			if err != nil {
+				return err
+			}
+			for n := 0; n < 3; n++ {
+				child, err := tx.AcquireChildPrefix(site.Cidr, 24, tenantid)
+				if err != nil {
+					return err
+				}
+				_, err = tx.AcquireIP(child.Cidr, tenantid)
+				if err != nil {
+					return err
+				}
+			}
+			// the staged modifications are visible inside the transaction
+			require.Nil(t, ipam.PrefixFrom(site.Cidr, tenantid))
+			require.Len(t, tx.PrefixFrom(site.Cidr, tenantid).availableChildPrefixes, 3)
+			return nil
+		})
+		require.Nil(t, err)
+
+		site := ipam.PrefixFrom("10.100.0.0/16", tenantid)
+		require.NotNil(t, site)
+		require.Len(t, site.availableChildPrefixes, 3)
+		child := ipam.PrefixFrom("10.100.2.0/24", tenantid)
+		require.NotNil(t, child)
+		require.Equal(t, site.Cidr, child.ParentCidr)
+		require.Equal(t, map[string]bool{"10.100.2.1": true}, child.Ips)
+
+		// the next ip is acquired from the committed state
+		ip, err := ipam.AcquireIP(child.Cidr, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, "10.100.2.2", ip.IP.String())
+	})
+}
+
+func TestIpamer_TxRollback(t *testing.T) {
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		existing, err := ipam.NewPrefix("10.101.0.0/24", tenantid)
+		require.Nil(t, err)
+		_, err = ipam.AcquireSpecificIP(existing.Cidr, "10.101.0.1", tenantid)
+		require.Nil(t, err)
+
+		failure := fmt.Errorf("gateway not reachable")
+		err = ipam.Tx(func(tx Ipamer) error {
+			site, err := tx.NewPrefix("10.102.0.0/16", tenantid)
+			if err != nil {
+				return err
+			}
+			_, err = tx.AcquireChildPrefix(site.Cidr, 24, tenantid)
+			if err != nil {
+				return err
+			}
+			_, err = tx.AcquireIP(existing.Cidr, tenantid)
+			if err != nil {
+				return err
+			}
+			err = tx.ReleaseIPFromPrefix(existing.Cidr, "10.101.0.1", tenantid)
+			if err != nil {
+				return err
+			}
+			return failure
+		})
+		require.Equal(t, failure, err)
+
+		require.Nil(t, ipam.PrefixFrom("10.102.0.0/16", tenantid))
+		require.Nil(t, ipam.PrefixFrom("10.102.0.0/24", tenantid))
+		require.Equal(t, map[string]bool{"10.101.0.1": true}, ipam.PrefixFrom(existing.Cidr, tenantid).Ips)
+		ip, err := ipam.AcquireIP(existing.Cidr, tenantid)
+		require.Nil(t, err)
+		require.Equal(t, "10.101.0.2", ip.IP.String())
+	})
+}
+
+func TestIpamer_TxWithoutMultiPrefixStorage(t *testing.T) {
+	ipam := &ipamer{storage: &singlePrefixStorage{Storage: NewMemory()}}
+	prefix, err := ipam.NewPrefix("10.104.0.0/24", tenantid)
+	require.Nil(t, err)
+
+	// a single modified prefix is applied
+	err = ipam.Tx(func(tx Ipamer) error {
+		_, err := tx.AcquireSpecificIP(prefix.Cidr, "10.104.0.1", tenantid)
+		return err
+	})
+	require.Nil(t, err)
+	require.Equal(t, uint64(3), ipam.PrefixFrom(prefix.Cidr, tenantid).acquiredips())
+
+	// several modified prefixes are not applied at all
+	err = ipam.Tx(func(tx Ipamer) error {
+		_, err := tx.AcquireSpecificIP(prefix.Cidr, "10.104.0.2", tenantid)
+		if err != nil {
+			return err
+		}
+		_, err = tx.NewPrefix("10.105.0.0/24", tenantid)
+		return err
+	})
+	require.True(t, errors.Is(err, ErrNotAtomic), "error must be ErrNotAtomic")
+	require.Nil(t, ipam.PrefixFrom("10.105.0.0/24", tenantid))
+	require.Equal(t, uint64(3), ipam.PrefixFrom(prefix.Cidr, tenantid).acquiredips())
+}
+
+func TestIpamer_TxDeleteAndRetry(t *testing.T) {
+	testWithBackends(t, func(t *testing.T, ipam *ipamer) {
+		old, err := ipam.NewPrefix("10.103.0.0/24", tenantid)
+		require.Nil(t, err)
+		p, err := ipam.NewPrefix("10.104.0.0/24", tenantid)
+		require.Nil(t, err)
+
+		calls := 0
+		err = ipam.Tx(func(tx Ipamer) error {
+			calls++
+			_, err := tx.DeletePrefix(old.Cidr, tenantid)
+			if err != nil {
+				return err
+			}
+			ip, err := tx.AcquireIP(p.Cidr, tenantid)
+			if err != nil {
+				return err
+			}
+			if calls == 1 {
+				// a concurrent modification of the prefix outside of the transaction
+				_, err = ipam.AcquireIP(p.Cidr, tenantid)
+				require.Nil(t, err)
+				require.Equal(t, "10.104.0.1", ip.IP.String())
+			}
+			return nil
+		})
+		require.Nil(t, err)
+		require.Equal(t, 2, calls)
+		require.Nil(t, ipam.PrefixFrom(old.Cidr, tenantid))
+		require.Equal(t, map[string]bool{"10.104.0.1": true, "10.104.0.2": true}, ipam.PrefixFrom(p.Cidr, tenantid).Ips)
+
+		// a nested transaction is applied to the enclosing one
+		err = ipam.Tx(func(tx Ipamer) error {
+			err := tx.Tx(func(nested Ipamer) error {
+				_, err := nested.NewPrefix("10.105.0.0/24", tenantid)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			require.NotNil(t, tx.PrefixFrom("10.105.0.0/24", tenantid))
+			require.Nil(t, ipam.PrefixFrom("10.105.0.0/24", tenantid))
+			return nil
+		})
+		require.Nil(t, err)
+		require.NotNil(t, ipam.PrefixFrom("10.105.0.0/24", tenantid))
+	})
+}
+
+func Test_sql_applyChanges(t *testing.T) {
+	ctx := context.Background()
+	testWithSQLBackends(t, func(t *testing.T, db *sql) {
+		ipam := &ipamer{}
+		p, err := ipam.newPrefix("10.106.0.0/24")
+		require.Nil(t, err)
+		p.Ips["10.106.0.1"] = true
+		stored, err := db.CreatePrefix(*p, tenantid)
+		require.Nil(t, err)
+		created, err := ipam.newPrefix("10.107.0.0/24")
+		require.Nil(t, err)
+
+		// the outdated version of the update rolls back the creation
+		stale := *stored.DeepCopy()
+		stale.version = 5
+		err = db.ApplyChanges(ctx, []PrefixChange{
+			{Tenantid: tenantid, Prefix: *created, Op: ChangeCreate},
+			{Tenantid: tenantid, Prefix: stale, Op: ChangeUpdate},
+		})
+		require.IsType(t, OptimisticLockError{}, err)
+		_, err = db.ReadPrefix(created.Cidr, tenantid)
+		require.NotNil(t, err)
+
+		err = db.ApplyChanges(ctx, []PrefixChange{
+			{Tenantid: tenantid, Prefix: *created, Op: ChangeCreate},
+			{Tenantid: tenantid, Prefix: stored, Op: ChangeDelete},
+		})
+		require.Nil(t, err)
+		_, err = db.ReadPrefix(created.Cidr, tenantid)
+		require.Nil(t, err)
+		_, err = db.ReadPrefix(stored.Cidr, tenantid)
+		require.NotNil(t, err)
+		var count int
+		err = db.db.GetContext(ctx, &count, db.q("SELECT COUNT(*) FROM {ips} WHERE tenantid=$1 AND prefix=$2"), tenantid, stored.Cidr)
+		require.Nil(t, err)
+		require.Equal(t, 0, count)
+	})
+}